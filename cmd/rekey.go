@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/USA-RedDragon/configulator"
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/secrets"
+	"github.com/spf13/cobra"
+)
+
+func newRekeyCommand(version, commit string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "rekey",
+		Version: fmt.Sprintf("%s - %s", version, commit),
+		Short:   "Re-encrypt the secrets in the database under a new master key",
+		Long: "Re-encrypt the secrets in the database under a new master key.\n\n" +
+			"The current master key is read from the secrets settings. If the new key file " +
+			"does not exist, a new key is generated and written to it. Once this completes, " +
+			"point secrets.key-file at the new key before starting the server.",
+		Annotations: map[string]string{
+			"version": version,
+			"commit":  commit,
+		},
+		RunE:              runRekey,
+		SilenceErrors:     true,
+		DisableAutoGenTag: true,
+	}
+	cmd.Flags().String("new-key-file", "", "File containing the new base64 encoded master key, created if it does not exist")
+	return cmd
+}
+
+func runRekey(cmd *cobra.Command, _ []string) error {
+	err := runRoot(cmd, nil)
+	if err != nil {
+		slog.Error("Encountered an error.", "error", err.Error())
+	}
+
+	ctx := cmd.Context()
+
+	c, err := configulator.FromContext[config.Config](ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get config from context")
+	}
+
+	config, err := c.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	newKeyFile, err := cmd.Flags().GetString("new-key-file")
+	if err != nil {
+		return err
+	}
+	if newKeyFile == "" {
+		return fmt.Errorf("--new-key-file is required")
+	}
+
+	oldKeyring, err := secrets.LoadKeyring(config.Secrets)
+	if err != nil {
+		return fmt.Errorf("failed to load current master key: %w", err)
+	}
+
+	_, err = os.Stat(newKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(newKeyFile, []byte(key+"\n"), 0600)
+		if err != nil {
+			return fmt.Errorf("failed to write new master key: %w", err)
+		}
+		slog.Info("Generated a new master key", "file", newKeyFile)
+	}
+
+	newKeyring, err := secrets.ReadKeyring(newKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load new master key: %w", err)
+	}
+
+	if oldKeyring != nil && oldKeyring.ID() == newKeyring.ID() {
+		return fmt.Errorf("the new master key is the same as the current one")
+	}
+
+	db, err := db.MakeDB(config)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	rewritten, err := models.RekeySecrets(db, oldKeyring, newKeyring)
+	if err != nil {
+		return fmt.Errorf("failed to rekey secrets, nothing was changed: %w", err)
+	}
+
+	slog.Info("Re-encrypted secrets under the new master key", "count", rewritten, "key-id", newKeyring.ID())
+	fmt.Printf("Secrets are now encrypted under %s. Set secrets.key-file to this file and restart the server.\n", newKeyFile)
+
+	return nil
+}
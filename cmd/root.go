@@ -26,7 +26,9 @@ func NewCommand(version, commit string) *cobra.Command {
 	cmd.AddCommand(newGenerateCommand(version, commit))
 	cmd.AddCommand(newNotifyCommand(version, commit))
 	cmd.AddCommand(newNotifyBabelCommand(version, commit))
+	cmd.AddCommand(newRekeyCommand(version, commit))
 	cmd.AddCommand(newServerCommand(version, commit))
+	cmd.AddCommand(newTunnelsCommand(version, commit))
 	return cmd
 }
 
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/USA-RedDragon/configulator"
 	"github.com/USA-RedDragon/mesh-manager/internal/config"
@@ -13,6 +14,7 @@ import (
 	"github.com/USA-RedDragon/mesh-manager/internal/events"
 	"github.com/USA-RedDragon/mesh-manager/internal/ifacewatcher"
 	"github.com/USA-RedDragon/mesh-manager/internal/metrics"
+	"github.com/USA-RedDragon/mesh-manager/internal/quota"
 	"github.com/USA-RedDragon/mesh-manager/internal/server"
 	"github.com/USA-RedDragon/mesh-manager/internal/services"
 	"github.com/USA-RedDragon/mesh-manager/internal/services/babel"
@@ -83,6 +85,12 @@ func runServer(cmd *cobra.Command, _ []string) error {
 	}
 	slog.Info("Database connection established")
 
+	// Close the sessions of tunnels that were up when the server last stopped without cleaning up
+	err = models.EndAllTunnelSessions(db, time.Now(), models.DisconnectUnknown)
+	if err != nil {
+		return err
+	}
+
 	// Clear active status from all tunnels in the db
 	err = models.ClearActiveFromAllTunnels(db)
 	if err != nil {
@@ -91,12 +99,20 @@ func runServer(cmd *cobra.Command, _ []string) error {
 	slog.Info("Cleared active status from all tunnels in the database")
 
 	// Start the wireguard manager
-	wireguardManager, err := wireguard.NewManager(db)
+	wireguardManager, err := wireguard.NewManager(config, db)
 	if err != nil {
 		return err
 	}
 	slog.Info("Wireguard manager initialized")
 
+	// Shared interface and strict AllowedIPs peers learn what they advertise from the routing daemons
+	if config.OLSR {
+		wireguardManager.AddPrefixSource(olsr.NewPrefixSource())
+	}
+	if config.Babel.Enabled {
+		wireguardManager.AddPrefixSource(babel.NewPrefixSource())
+	}
+
 	err = wireguardManager.Run()
 	if err != nil {
 		return err
@@ -114,7 +130,7 @@ func runServer(cmd *cobra.Command, _ []string) error {
 	slog.Info("Event bus initialized")
 
 	// Start the interface watcher
-	ifWatcher, err := ifacewatcher.NewWatcher(db, eventBus.GetChannel())
+	ifWatcher, err := ifacewatcher.NewWatcher(config, db, wireguardManager, eventBus.GetChannel())
 	if err != nil {
 		return err
 	}
@@ -124,6 +140,11 @@ func runServer(cmd *cobra.Command, _ []string) error {
 	}
 	slog.Info("Interface watcher started")
 
+	// Start the quota enforcer
+	quotaEnforcer := quota.NewEnforcer(config, db, wireguardManager, serviceRegistry, eventBus.GetChannel())
+	quotaEnforcer.Start()
+	slog.Info("Quota enforcer started")
+
 	// Start the server
 	srv := server.NewServer(config, db, ifWatcher.Stats, eventBus.GetChannel(), wireguardManager)
 	err = srv.Run(cmd.Root().Version, serviceRegistry)
@@ -150,6 +171,21 @@ func runServer(cmd *cobra.Command, _ []string) error {
 		errGrp := errgroup.Group{}
 		errGrp.SetLimit(1)
 
+		errGrp.Go(func() error {
+			slog.Debug("Stopping quota enforcer")
+			defer slog.Debug("Quota enforcer stopped")
+			quotaEnforcer.Stop()
+			return nil
+		})
+
+		// Stop watching before the tunnels are torn down so their sessions
+		// are recorded as ended by the shutdown rather than by the interfaces going away
+		errGrp.Go(func() error {
+			slog.Debug("Stopping interface watcher")
+			defer slog.Debug("Interface watcher stopped")
+			return ifWatcher.Stop()
+		})
+
 		errGrp.Go(func() error {
 			slog.Debug("Stopping wireguard manager")
 			defer slog.Debug("Wireguard manager stopped")
@@ -162,15 +198,13 @@ func runServer(cmd *cobra.Command, _ []string) error {
 			return srv.Stop()
 		})
 
-		errGrp.Go(func() error {
-			slog.Debug("Stopping interface watcher")
-			defer slog.Debug("Interface watcher stopped")
-			return ifWatcher.Stop()
-		})
-
 		errGrp.Go(func() error {
 			slog.Debug("Clearing active status from all tunnels")
 			defer slog.Debug("Cleared active status from all tunnels")
+			err := models.EndAllTunnelSessions(db, time.Now(), models.DisconnectShutdown)
+			if err != nil {
+				return err
+			}
 			return models.ClearActiveFromAllTunnels(db)
 		})
 
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/configulator"
+	"github.com/USA-RedDragon/mesh-manager/internal/bulk"
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/spf13/cobra"
+)
+
+const tunnelsClientTimeout = 2 * time.Minute
+
+var errImportInvalid = errors.New("some tunnels are invalid, nothing was imported")
+
+func newTunnelsCommand(version, commit string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "tunnels",
+		Version: fmt.Sprintf("%s - %s", version, commit),
+		Short:   "Export and import tunnels through the running server",
+		Annotations: map[string]string{
+			"version": version,
+			"commit":  commit,
+		},
+		SilenceErrors:     true,
+		DisableAutoGenTag: true,
+	}
+	cmd.PersistentFlags().String("server", "", "URL of the server, defaults to the local server on the configured port")
+	cmd.PersistentFlags().String("username", "", "Username to log in with")
+	cmd.PersistentFlags().String("password", "", "Password to log in with, read from MESH_MANAGER_PASSWORD if not set")
+
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "Export tunnels, credentials included",
+		Long:  "Export every tunnel, credentials included, or only those with all of the given tags.",
+		Annotations: map[string]string{
+			"version": version,
+			"commit":  commit,
+		},
+		Args:              cobra.NoArgs,
+		RunE:              runTunnelsExport,
+		SilenceErrors:     true,
+		DisableAutoGenTag: true,
+	}
+	export.Flags().String("format", "json", "Export format, json or csv")
+	export.Flags().StringP("output", "o", "", "File to write the export to, stdout if not set")
+	export.Flags().StringSlice("tag", nil, "Only export tunnels with this tag, may be repeated")
+
+	imp := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import tunnels from an export or an AREDN backup",
+		Long: "Import tunnels from an export.\n\n" +
+			"The file is always checked with a dry run first and the report printed. If every " +
+			"tunnel is valid, they are all created at once and the routing daemons reloaded. " +
+			"Tunnels without an IP or port are allocated one.\n\n" +
+			"AREDN node backups, or the vtun config from one, can be imported with --format aredn. " +
+			"Wireguard tunnels keep their addresses and keys, vtun servers become wireguard servers " +
+			"on the same addresses and vtun clients are skipped.",
+		Annotations: map[string]string{
+			"version": version,
+			"commit":  commit,
+		},
+		Args:              cobra.ExactArgs(1),
+		RunE:              runTunnelsImport,
+		SilenceErrors:     true,
+		DisableAutoGenTag: true,
+	}
+	imp.Flags().String("format", "", "Import format, json, csv or aredn, guessed from the file name if not set")
+	imp.Flags().Bool("dry-run", false, "Only print what would be imported")
+
+	cmd.AddCommand(export, imp)
+	return cmd
+}
+
+func runTunnelsExport(cmd *cobra.Command, _ []string) error {
+	client, err := newTunnelsClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	formatName, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	format, err := bulk.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	tags, err := cmd.Flags().GetStringSlice("tag")
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("format", string(format))
+	for _, tag := range tags {
+		query.Add("tag", tag)
+	}
+	resp, err := client.do(cmd, http.MethodGet, "/tunnels/export?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("failed to export tunnels", resp)
+	}
+
+	out := io.Writer(os.Stdout)
+	if output != "" {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create export file: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	if output != "" {
+		slog.Info("Exported tunnels", "file", output)
+	}
+	return nil
+}
+
+func runTunnelsImport(cmd *cobra.Command, args []string) error {
+	client, err := newTunnelsClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	formatName, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	if formatName == "" {
+		formatName = guessImportFormat(args[0])
+	}
+	format, err := bulk.ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read import file: %w", err)
+	}
+
+	report, err := client.importTunnels(cmd, format, data, true)
+	if err != nil {
+		return err
+	}
+	printImportReport(report)
+	if report.Invalid > 0 {
+		return errImportInvalid
+	}
+	if dryRun {
+		return nil
+	}
+
+	report, err = client.importTunnels(cmd, format, data, false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d tunnels\n", report.Valid)
+	return nil
+}
+
+// guessImportFormat picks the format from the file name. AREDN backups are
+// tarballs, and the tunnel config inside them is named vtun.
+func guessImportFormat(file string) string {
+	name := strings.ToLower(filepath.Base(file))
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(name, suffix) {
+			return string(bulk.FormatAREDN)
+		}
+	}
+	if name == "vtun" {
+		return string(bulk.FormatAREDN)
+	}
+	return strings.TrimPrefix(filepath.Ext(name), ".")
+}
+
+func printImportReport(report bulk.Report) {
+	for _, result := range report.Results {
+		switch {
+		case result.Error != "":
+			fmt.Printf("row %d: %s: error: %s\n", result.Row, result.Hostname, result.Error)
+		case result.Skipped:
+			fmt.Printf("row %d: %s: skipped\n", result.Row, result.Hostname)
+		default:
+			fmt.Printf("row %d: %s: ip %s port %d\n", result.Row, result.Hostname, result.IP, result.WireguardPort)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Printf("row %d: %s: warning: %s\n", result.Row, result.Hostname, warning)
+		}
+	}
+	fmt.Printf("%d valid, %d invalid, %d skipped\n", report.Valid, report.Invalid, report.Skipped)
+}
+
+// tunnelsClient talks to the API of the running server, which owns the
+// wireguard interfaces and routing daemons the tunnels are brought up on
+type tunnelsClient struct {
+	http    *http.Client
+	baseURL string
+}
+
+func newTunnelsClient(cmd *cobra.Command) (*tunnelsClient, error) {
+	err := runRoot(cmd, nil)
+	if err != nil {
+		slog.Error("Encountered an error.", "error", err.Error())
+	}
+
+	c, err := configulator.FromContext[config.Config](cmd.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config from context")
+	}
+
+	config, err := c.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	server, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		server = fmt.Sprintf("http://127.0.0.1:%d", config.Port)
+	}
+	username, err := cmd.Flags().GetString("username")
+	if err != nil {
+		return nil, err
+	}
+	password, err := cmd.Flags().GetString("password")
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		password = os.Getenv("MESH_MANAGER_PASSWORD")
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("--username and --password are required")
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &tunnelsClient{
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: tunnelsClientTimeout,
+		},
+		baseURL: strings.TrimSuffix(server, "/") + "/api/v1",
+	}
+
+	body, err := json.Marshal(apimodels.AuthLogin{Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.do(cmd, http.MethodPost, "/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("failed to log in", resp)
+	}
+
+	return client, nil
+}
+
+func (c *tunnelsClient) do(cmd *cobra.Command, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(cmd.Context(), method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	return c.http.Do(req)
+}
+
+func (c *tunnelsClient) importTunnels(cmd *cobra.Command, format bulk.Format, data []byte, dryRun bool) (bulk.Report, error) {
+	query := url.Values{}
+	query.Set("format", string(format))
+	query.Set("dry_run", fmt.Sprint(dryRun))
+	resp, err := c.do(cmd, http.MethodPost, "/tunnels/import?"+query.Encode(), format.ContentType(), bytes.NewReader(data))
+	if err != nil {
+		return bulk.Report{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error  string       `json:"error"`
+		Report *bulk.Report `json:"report"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return bulk.Report{}, fmt.Errorf("invalid response from server: %s", resp.Status)
+	}
+	// An invalid file comes back as a bad request along with its report
+	if result.Report != nil && (resp.StatusCode == http.StatusOK || result.Report.Invalid > 0) {
+		return *result.Report, nil
+	}
+	if result.Error != "" {
+		return bulk.Report{}, fmt.Errorf("failed to import tunnels: %s", result.Error)
+	}
+	return bulk.Report{}, fmt.Errorf("failed to import tunnels: %s", resp.Status)
+}
+
+func responseError(msg string, resp *http.Response) error {
+	var result struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Error != "" {
+		return fmt.Errorf("%s: %s", msg, result.Error)
+	}
+	return fmt.Errorf("%s: %s", msg, resp.Status)
+}
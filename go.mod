@@ -14,7 +14,6 @@ require (
 	github.com/kachit/gorm-seeder v0.0.3
 	github.com/lmittmann/tint v1.1.2
 	github.com/mavjs/goPwned v0.0.2
-	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
 	github.com/prometheus/client_golang v1.22.0
 	github.com/puzpuzpuz/xsync/v4 v4.1.0
 	github.com/spf13/cobra v1.9.1
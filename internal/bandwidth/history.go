@@ -0,0 +1,146 @@
+package bandwidth
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"gorm.io/gorm"
+)
+
+const (
+	historyFlushInterval = time.Minute
+	historyPruneInterval = time.Hour
+)
+
+type historyKey struct {
+	tunnelID uint
+	minute   time.Time
+}
+
+type historyBytes struct {
+	rx uint64
+	tx uint64
+}
+
+// History buffers the traffic counted by the stat counters and writes it to
+// the database once a minute, rolled up into minute, hour and day buckets for
+// each tunnel and for the node as a whole
+type History struct {
+	db       *gorm.DB
+	config   *config.Config
+	lock     sync.Mutex
+	pending  map[historyKey]historyBytes
+	stopChan chan struct{}
+	stopped  chan struct{}
+}
+
+func NewHistory(db *gorm.DB, config *config.Config) *History {
+	return &History{
+		db:       db,
+		config:   config,
+		pending:  make(map[historyKey]historyBytes),
+		stopChan: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (h *History) Start() {
+	go h.loop()
+}
+
+// Stop writes out whatever is still buffered
+func (h *History) Stop() {
+	close(h.stopChan)
+	<-h.stopped
+}
+
+// Record adds traffic of a tunnel to the current minute
+func (h *History) Record(tunnelID uint, rxBytes uint64, txBytes uint64) {
+	if rxBytes == 0 && txBytes == 0 {
+		return
+	}
+	key := historyKey{tunnelID: tunnelID, minute: models.TrafficMinute.Bucket(time.Now())}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	pending := h.pending[key]
+	pending.rx += rxBytes
+	pending.tx += txBytes
+	h.pending[key] = pending
+}
+
+func (h *History) loop() {
+	defer close(h.stopped)
+	flushTicker := time.NewTicker(historyFlushInterval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(historyPruneInterval)
+	defer pruneTicker.Stop()
+	h.prune(time.Now())
+	for {
+		select {
+		case <-h.stopChan:
+			h.flush()
+			return
+		case <-flushTicker.C:
+			h.flush()
+		case <-pruneTicker.C:
+			h.prune(time.Now())
+		}
+	}
+}
+
+func (h *History) flush() {
+	h.lock.Lock()
+	pending := h.pending
+	h.pending = make(map[historyKey]historyBytes)
+	h.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	buckets := make(map[models.TrafficSample]historyBytes)
+	add := func(tunnelID uint, minute time.Time, bytes historyBytes) {
+		for _, resolution := range models.TrafficResolutions {
+			key := models.TrafficSample{TunnelID: tunnelID, Resolution: resolution, BucketStart: resolution.Bucket(minute)}
+			bucket := buckets[key]
+			bucket.rx += bytes.rx
+			bucket.tx += bytes.tx
+			buckets[key] = bucket
+		}
+	}
+	for key, bytes := range pending {
+		add(key.tunnelID, key.minute, bytes)
+		add(models.NodeTrafficID, key.minute, bytes)
+	}
+
+	samples := make([]models.TrafficSample, 0, len(buckets))
+	for sample, bytes := range buckets {
+		sample.RXBytes = bytes.rx
+		sample.TXBytes = bytes.tx
+		samples = append(samples, sample)
+	}
+	err := models.AddTrafficSamples(h.db, samples)
+	if err != nil {
+		slog.Error("failed to save traffic history", "error", err)
+	}
+}
+
+func (h *History) prune(now time.Time) {
+	retention := map[models.TrafficResolution]time.Duration{
+		models.TrafficMinute: time.Duration(h.config.Traffic.MinuteRetention) * time.Hour,
+		models.TrafficHour:   time.Duration(h.config.Traffic.HourRetention) * 24 * time.Hour,
+		models.TrafficDay:    time.Duration(h.config.Traffic.DayRetention) * 24 * time.Hour,
+	}
+	for resolution, keep := range retention {
+		deleted, err := models.PruneTrafficSamples(h.db, resolution, now.Add(-keep))
+		if err != nil {
+			slog.Error("failed to prune traffic history", "resolution", resolution, "error", err)
+			continue
+		}
+		if deleted > 0 {
+			slog.Debug("pruned traffic history", "resolution", resolution, "samples", deleted)
+		}
+	}
+}
@@ -6,191 +6,344 @@ import (
 	"sync"
 	"time"
 
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
 	"github.com/USA-RedDragon/mesh-manager/internal/events"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
 	"github.com/vishvananda/netlink"
-	"golang.org/x/sync/errgroup"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gorm.io/gorm"
 )
 
+const (
+	// pollInterval is how often every counter is read and the websocket updated
+	pollInterval = 1 * time.Second
+	// flushInterval is how often the traffic counted since the last flush is written to the database
+	flushInterval = 10 * time.Second
+	bytesPerMB    = 1024 * 1024
+)
+
+// StatCounter is the traffic of a tunnel over its current connection, counted
+// from either a whole interface or a single peer of the shared interface
 type StatCounter struct {
-	iface          string
-	lastRXBytes    uint64
-	lastTXBytes    uint64
-	lastNewRXBytes uint64
-	lastNewTXBytes uint64
-	running        bool
-	db             *gorm.DB
-	RXBandwidth    uint64
-	TXBandwidth    uint64
-	statsCallback  func(rxMb float64, txMb float64)
-	eventsChannel  chan events.Event
+	key      string
+	tunnelID uint
+	iface    string
+	peer     *wgtypes.Key
+
+	// The interface index and raw counters of the last read, to tell apart
+	// traffic from counter resets and the interface being recreated
+	linkIndex   int
+	lastRXBytes uint64
+	lastTXBytes uint64
+	lastRead    time.Time
+	primed      bool
+
+	// Traffic counted since the last flush
+	pendingRXBytes uint64
+	pendingTXBytes uint64
+	// Whether the last flush already wrote out that the counter is idle
+	savedIdle bool
+
+	RXBandwidth uint64
+	TXBandwidth uint64
+	RXBytes     uint64
+	TXBytes     uint64
+	TotalRXMB   float64
+	TotalTXMB   float64
 }
 
-func newStatCounter(iface string, db *gorm.DB, events chan events.Event, statsCallback func(rxMb float64, txMb float64)) *StatCounter {
-	return &StatCounter{
-		iface: iface,
-		db:    db,
-		statsCallback: func(rxMb float64, txMb float64) {
-			if statsCallback != nil {
-				statsCallback(rxMb, txMb)
-			}
-		},
-		eventsChannel: events,
-	}
+// statReading is the raw counters of an interface or peer at one point in time
+type statReading struct {
+	linkIndex int
+	rxBytes   uint64
+	txBytes   uint64
 }
 
-func (s *StatCounter) Start() error {
-	if s.running {
-		return fmt.Errorf("stat counter already running")
-	}
-	dev, err := netlink.LinkByName(s.iface)
-	if err != nil {
-		return fmt.Errorf("error getting link %s by name: %w", s.iface, err)
+// CounterDelta returns the traffic between two reads of a counter. A counter
+// that went backwards or belongs to a recreated interface started over from
+// zero, so everything it holds is new.
+func CounterDelta(last uint64, current uint64, restarted bool) uint64 {
+	if restarted || current < last {
+		return current
 	}
-	s.running = true
-	s.lastRXBytes = dev.Attrs().Statistics.RxBytes
-	s.lastTXBytes = dev.Attrs().Statistics.TxBytes
-	go func() {
-		count := 0
-		for s.running {
-			time.Sleep(500 * time.Millisecond)
-			tunnel, err := models.FindTunnelByInterface(s.db, s.iface)
-			if err != nil {
-				slog.Error("Error finding tunnel by interface", "iface", s.iface, "error", err)
-				return
-			}
-			if !tunnel.Active {
-				return
-			}
-			dev, err = netlink.LinkByName(s.iface)
-			if err != nil {
-				slog.Error("Error getting link by name", "iface", s.iface, "error", err)
-				return
-			}
-			rxBytes := dev.Attrs().Statistics.RxBytes
-			if rxBytes < s.lastRXBytes {
-				s.lastRXBytes = rxBytes
-				continue
-			}
-			newBytes := rxBytes - s.lastRXBytes
-			tunnel.RXBytes += newBytes
-			tunnel.TotalRXMB += float64(newBytes) / 1024 / 1024
-			if count != 0 && count%2 == 0 {
-				tunnel.RXBytesPerSec = s.lastNewRXBytes + newBytes
-			}
-			s.RXBandwidth = tunnel.RXBytesPerSec
-			s.lastNewRXBytes = newBytes
-			s.lastRXBytes = rxBytes
+	return current - last
+}
 
-			txBytes := dev.Attrs().Statistics.TxBytes
-			if txBytes < s.lastTXBytes {
-				s.lastTXBytes = txBytes
-				continue
-			}
-			newBytes = txBytes - s.lastTXBytes
-			tunnel.TXBytes += newBytes
-			tunnel.TotalTXMB += float64(newBytes) / 1024 / 1024
-			if count != 0 && count%2 == 0 {
-				if count == 100 {
-					count = 2
-				}
-				tunnel.TXBytesPerSec = s.lastNewTXBytes + newBytes
-				if err = s.db.Save(tunnel).Error; err != nil {
-					slog.Error("Error saving tunnel", "error", err)
-					continue
-				}
-			}
-			s.TXBandwidth = tunnel.TXBytesPerSec
-			s.lastNewTXBytes = newBytes
-			s.lastTXBytes = txBytes
-
-			wsTunnel := apimodels.WebsocketTunnelStats{
-				ID:               tunnel.ID,
-				RXBytesPerSecond: tunnel.RXBytesPerSec,
-				TXBytesPerSecond: tunnel.TXBytesPerSec,
-				RXBytes:          tunnel.RXBytes,
-				TXBytes:          tunnel.TXBytes,
-				TotalRXMB:        tunnel.TotalRXMB,
-				TotalTXMB:        tunnel.TotalTXMB,
-			}
+// update takes in a new reading and returns the traffic since the last one
+func (s *StatCounter) update(reading statReading, now time.Time) (uint64, uint64) {
+	if !s.primed {
+		s.primed = true
+		s.linkIndex = reading.linkIndex
+		s.lastRXBytes = reading.rxBytes
+		s.lastTXBytes = reading.txBytes
+		s.lastRead = now
+		return 0, 0
+	}
 
-			s.eventsChannel <- events.Event{
-				Type: events.EventTypeTunnelStats,
-				Data: wsTunnel,
-			}
+	restarted := reading.linkIndex != s.linkIndex
+	rx := CounterDelta(s.lastRXBytes, reading.rxBytes, restarted)
+	tx := CounterDelta(s.lastTXBytes, reading.txBytes, restarted)
 
-			s.statsCallback(float64(s.lastNewRXBytes)/1024/1024, float64(s.lastNewTXBytes)/1024/1024)
+	if elapsed := now.Sub(s.lastRead).Seconds(); elapsed > 0 {
+		s.RXBandwidth = uint64(float64(rx) / elapsed)
+		s.TXBandwidth = uint64(float64(tx) / elapsed)
+	}
+	s.linkIndex = reading.linkIndex
+	s.lastRXBytes = reading.rxBytes
+	s.lastTXBytes = reading.txBytes
+	s.lastRead = now
 
-			count++
-		}
-	}()
-	return nil
+	s.RXBytes += rx
+	s.TXBytes += tx
+	s.TotalRXMB += float64(rx) / bytesPerMB
+	s.TotalTXMB += float64(tx) / bytesPerMB
+	s.pendingRXBytes += rx
+	s.pendingTXBytes += tx
+	return rx, tx
 }
 
-func (s *StatCounter) Stop() {
-	s.running = false
+func (s *StatCounter) websocketStats() apimodels.WebsocketTunnelStats {
+	return apimodels.WebsocketTunnelStats{
+		ID:               s.tunnelID,
+		RXBytesPerSecond: s.RXBandwidth,
+		TXBytesPerSecond: s.TXBandwidth,
+		RXBytes:          s.RXBytes,
+		TXBytes:          s.TXBytes,
+		TotalRXMB:        s.TotalRXMB,
+		TotalTXMB:        s.TotalTXMB,
+	}
 }
 
+// StatCounterManager reads the counters of every tracked interface and peer
+// in one pass, keeps the running totals in memory and writes the traffic to
+// the database in batches
 type StatCounterManager struct {
-	counters         sync.Map
+	lock             sync.Mutex
+	counters         map[string]*StatCounter
 	db               *gorm.DB
-	running          bool
+	stopChan         chan struct{}
+	stopped          chan struct{}
 	TotalRXMB        float64
 	TotalTXMB        float64
 	TotalRXBandwidth uint64
 	TotalTXBandwidth uint64
 	eventsChannel    chan events.Event
+	wgClient         *wgctrl.Client
+	history          *History
 }
 
-func NewStatCounterManager(db *gorm.DB, events chan events.Event) *StatCounterManager {
+func NewStatCounterManager(config *config.Config, db *gorm.DB, events chan events.Event, wgClient *wgctrl.Client) *StatCounterManager {
 	return &StatCounterManager{
+		counters:      make(map[string]*StatCounter),
 		db:            db,
+		stopChan:      make(chan struct{}),
+		stopped:       make(chan struct{}),
 		eventsChannel: events,
+		wgClient:      wgClient,
+		history:       NewHistory(db, config),
 	}
 }
 
 func (s *StatCounterManager) Start() {
-	s.running = true
-	go func() {
-		time.Sleep(2 * time.Second)
-		for s.running {
-			s.updateTotalBandwidth()
-			time.Sleep(1 * time.Second)
+	s.history.Start()
+	go s.loop()
+}
+
+// PeerKey is the key a shared interface peer's stat counter is stored under
+func PeerKey(iface string, pubkey wgtypes.Key) string {
+	return iface + "/" + pubkey.String()
+}
+
+// Add counts the traffic of a whole interface towards a tunnel
+func (s *StatCounterManager) Add(iface string, tunnelID uint) error {
+	return s.add(&StatCounter{key: iface, tunnelID: tunnelID, iface: iface})
+}
+
+// AddPeer counts the traffic of a single wireguard peer towards a tunnel
+func (s *StatCounterManager) AddPeer(iface string, pubkey wgtypes.Key, tunnelID uint) error {
+	return s.add(&StatCounter{key: PeerKey(iface, pubkey), tunnelID: tunnelID, iface: iface, peer: &pubkey})
+}
+
+func (s *StatCounterManager) add(counter *StatCounter) error {
+	tunnel, err := models.FindTunnelByID(s.db, counter.tunnelID)
+	if err != nil {
+		return fmt.Errorf("error finding tunnel for %s: %w", counter.key, err)
+	}
+	counter.TotalRXMB = tunnel.TotalRXMB
+	counter.TotalTXMB = tunnel.TotalTXMB
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.counters[counter.key]; ok {
+		return fmt.Errorf("stat counter already exists for %s", counter.key)
+	}
+	s.counters[counter.key] = counter
+	return nil
+}
+
+// Remove stops counting an interface or peer, writing out what it counted since the last flush
+func (s *StatCounterManager) Remove(key string) error {
+	s.lock.Lock()
+	counter, ok := s.counters[key]
+	if !ok {
+		s.lock.Unlock()
+		return fmt.Errorf("stat counter not found for %s", key)
+	}
+	delete(s.counters, key)
+	s.lock.Unlock()
+
+	err := s.flushCounters([]*StatCounter{counter})
+	if err != nil {
+		slog.Error("Error saving tunnel traffic", "key", key, "error", err)
+	}
+	return nil
+}
+
+func (s *StatCounterManager) Get(key string) *StatCounter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counters[key]
+}
+
+func (s *StatCounterManager) GetAll() []*StatCounter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counters := make([]*StatCounter, 0, len(s.counters))
+	for _, counter := range s.counters {
+		counters = append(counters, counter)
+	}
+	return counters
+}
+
+func (s *StatCounterManager) loop() {
+	defer close(s.stopped)
+	pollTicker := time.NewTicker(pollInterval)
+	defer pollTicker.Stop()
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			err := s.flushCounters(s.GetAll())
+			if err != nil {
+				slog.Error("Error saving tunnel traffic", "error", err)
+			}
+			return
+		case <-pollTicker.C:
+			s.poll(time.Now())
+		case <-flushTicker.C:
+			err := s.flushCounters(s.GetAll())
+			if err != nil {
+				slog.Error("Error saving tunnel traffic", "error", err)
+			}
 		}
-	}()
+	}
 }
 
-func (s *StatCounterManager) Add(iface string) error {
-	statCounter := newStatCounter(iface, s.db, s.eventsChannel, s.totalStatsUpdate)
-	_, loaded := s.counters.LoadOrStore(iface, statCounter)
-	if loaded {
-		return fmt.Errorf("stat counter already exists for interface %s", iface)
+// poll reads every counter and sends the results to the websocket
+func (s *StatCounterManager) poll(now time.Time) {
+	counters := s.GetAll()
+	if len(counters) == 0 {
+		s.publishTotals(nil, 0, 0)
+		return
+	}
+
+	readings, err := s.read(counters)
+	if err != nil {
+		slog.Error("Error reading interface statistics", "error", err)
+		return
+	}
+
+	var rxTotal, txTotal uint64
+	stats := make([]apimodels.WebsocketTunnelStats, 0, len(counters))
+	s.lock.Lock()
+	for _, counter := range counters {
+		// Removed while we were reading
+		if s.counters[counter.key] != counter {
+			continue
+		}
+		reading, ok := readings[counter.key]
+		if !ok {
+			// The interface or peer is gone, the watcher will remove it shortly
+			continue
+		}
+		rx, tx := counter.update(reading, now)
+		rxTotal += rx
+		txTotal += tx
+		s.history.Record(counter.tunnelID, rx, tx)
+		stats = append(stats, counter.websocketStats())
 	}
-	return statCounter.Start()
+	s.lock.Unlock()
+
+	s.publishTotals(stats, rxTotal, txTotal)
 }
 
-func (s *StatCounterManager) totalStatsUpdate(rxMb float64, txMb float64) {
-	s.TotalRXMB += rxMb
-	s.TotalTXMB += txMb
+// read fetches the counters of every interface in one netlink dump, and
+// the peers of each wireguard interface with one call per interface
+func (s *StatCounterManager) read(counters []*StatCounter) (map[string]statReading, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing links: %w", err)
+	}
+	byName := make(map[string]netlink.Link, len(links))
+	for _, link := range links {
+		byName[link.Attrs().Name] = link
+	}
 
-	s.eventsChannel <- events.Event{
-		Type: events.EventTypeTotalTraffic,
-		Data: apimodels.WebsocketTotalTraffic{
-			RX: s.TotalRXMB,
-			TX: s.TotalTXMB,
-		},
+	devices := make(map[string]*wgtypes.Device)
+	readings := make(map[string]statReading, len(counters))
+	for _, counter := range counters {
+		link, ok := byName[counter.iface]
+		if !ok {
+			continue
+		}
+
+		if counter.peer == nil {
+			stats := link.Attrs().Statistics
+			if stats == nil {
+				continue
+			}
+			readings[counter.key] = statReading{linkIndex: link.Attrs().Index, rxBytes: stats.RxBytes, txBytes: stats.TxBytes}
+			continue
+		}
+
+		device, ok := devices[counter.iface]
+		if !ok {
+			device, err = s.wgClient.Device(counter.iface)
+			if err != nil {
+				slog.Error("Error getting wireguard device", "interface", counter.iface, "error", err)
+			}
+			devices[counter.iface] = device
+		}
+		if device == nil {
+			continue
+		}
+		for _, peer := range device.Peers {
+			if peer.PublicKey == *counter.peer {
+				//nolint:gosec // byte counters are never negative
+				readings[counter.key] = statReading{linkIndex: link.Attrs().Index, rxBytes: uint64(peer.ReceiveBytes), txBytes: uint64(peer.TransmitBytes)}
+				break
+			}
+		}
 	}
+	return readings, nil
 }
 
-func (s *StatCounterManager) updateTotalBandwidth() {
-	s.TotalRXBandwidth = 0
-	s.TotalTXBandwidth = 0
-	for _, counter := range s.GetAll() {
-		s.TotalRXBandwidth += counter.RXBandwidth
-		s.TotalTXBandwidth += counter.TXBandwidth
+func (s *StatCounterManager) publishTotals(stats []apimodels.WebsocketTunnelStats, rxBytes uint64, txBytes uint64) {
+	var rxBandwidth, txBandwidth uint64
+	for _, stat := range stats {
+		rxBandwidth += stat.RXBytesPerSecond
+		txBandwidth += stat.TXBytesPerSecond
+		s.eventsChannel <- events.Event{
+			Type: events.EventTypeTunnelStats,
+			Data: stat,
+		}
 	}
+
+	s.TotalRXBandwidth = rxBandwidth
+	s.TotalTXBandwidth = txBandwidth
 	s.eventsChannel <- events.Event{
 		Type: events.EventTypeTotalBandwidth,
 		Data: apimodels.WebsocketTotalBandwidth{
@@ -198,60 +351,80 @@ func (s *StatCounterManager) updateTotalBandwidth() {
 			TX: s.TotalTXBandwidth,
 		},
 	}
-}
 
-func (s *StatCounterManager) Remove(iface string) error {
-	statCounter, loaded := s.counters.LoadAndDelete(iface)
-	if !loaded {
-		return fmt.Errorf("stat counter not found for interface %s", iface)
+	if rxBytes == 0 && txBytes == 0 {
+		return
 	}
-	sc, ok := statCounter.(*StatCounter)
-	if !ok {
-		return fmt.Errorf("stat counter type assertion error")
+	s.TotalRXMB += float64(rxBytes) / bytesPerMB
+	s.TotalTXMB += float64(txBytes) / bytesPerMB
+	s.eventsChannel <- events.Event{
+		Type: events.EventTypeTotalTraffic,
+		Data: apimodels.WebsocketTotalTraffic{
+			RX: s.TotalRXMB,
+			TX: s.TotalTXMB,
+		},
 	}
-	sc.Stop()
-	return nil
 }
 
-func (s *StatCounterManager) Get(iface string) *StatCounter {
-	statCounter, ok := s.counters.Load(iface)
-	if !ok {
-		return nil
+// flushCounters adds the traffic the counters saw since the last flush to
+// their tunnels. The columns are incremented in place rather than
+// overwritten, so quota resets and edits made in the meantime are kept.
+func (s *StatCounterManager) flushCounters(counters []*StatCounter) error {
+	type tunnelTraffic struct {
+		rxBytes, txBytes             uint64
+		rxBytesPerSec, txBytesPerSec uint64
 	}
-	sc, ok := statCounter.(*StatCounter)
-	if !ok {
+	traffic := make(map[uint]*tunnelTraffic)
+
+	s.lock.Lock()
+	for _, counter := range counters {
+		idle := counter.pendingRXBytes == 0 && counter.pendingTXBytes == 0 && counter.RXBandwidth == 0 && counter.TXBandwidth == 0
+		if idle && counter.savedIdle {
+			continue
+		}
+		counter.savedIdle = idle
+		t, ok := traffic[counter.tunnelID]
+		if !ok {
+			t = &tunnelTraffic{}
+			traffic[counter.tunnelID] = t
+		}
+		t.rxBytes += counter.pendingRXBytes
+		t.txBytes += counter.pendingTXBytes
+		t.rxBytesPerSec += counter.RXBandwidth
+		t.txBytesPerSec += counter.TXBandwidth
+		counter.pendingRXBytes = 0
+		counter.pendingTXBytes = 0
+	}
+	s.lock.Unlock()
+	if len(traffic) == 0 {
 		return nil
 	}
-	return sc
-}
 
-func (s *StatCounterManager) GetAll() []*StatCounter {
-	var counters []*StatCounter
-	s.counters.Range(func(_, value interface{}) bool {
-		sc, ok := value.(*StatCounter)
-		if !ok {
-			return true
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for id, t := range traffic {
+			rxMB := float64(t.rxBytes) / bytesPerMB
+			txMB := float64(t.txBytes) / bytesPerMB
+			err := tx.Model(&models.Tunnel{}).Where("id = ?", id).Updates(map[string]interface{}{
+				"rx_bytes":         gorm.Expr("rx_bytes + ?", t.rxBytes),
+				"tx_bytes":         gorm.Expr("tx_bytes + ?", t.txBytes),
+				"total_rxmb":       gorm.Expr("total_rxmb + ?", rxMB),
+				"total_txmb":       gorm.Expr("total_txmb + ?", txMB),
+				"period_rxmb":      gorm.Expr("period_rxmb + ?", rxMB),
+				"period_txmb":      gorm.Expr("period_txmb + ?", txMB),
+				"rx_bytes_per_sec": t.rxBytesPerSec,
+				"tx_bytes_per_sec": t.txBytesPerSec,
+			}).Error
+			if err != nil {
+				return fmt.Errorf("error saving traffic of tunnel %d: %w", id, err)
+			}
 		}
-		counters = append(counters, sc)
-		return true
+		return nil
 	})
-	return counters
 }
 
 func (s *StatCounterManager) Stop() error {
-	s.running = false
-	errGrp := errgroup.Group{}
-	s.counters.Range(func(_, value interface{}) bool {
-		sc, ok := value.(*StatCounter)
-		if !ok {
-			return true
-		}
-		errGrp.Go(func() error {
-			sc.Stop()
-			return nil
-		})
-		return true
-	})
-
-	return errGrp.Wait()
+	close(s.stopChan)
+	<-s.stopped
+	s.history.Stop()
+	return nil
 }
@@ -0,0 +1,35 @@
+package bandwidth_test
+
+import (
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/bandwidth"
+)
+
+func TestCounterDelta(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		last      uint64
+		current   uint64
+		restarted bool
+		want      uint64
+	}{
+		{"no traffic", 1000, 1000, false, 0},
+		{"traffic", 1000, 1500, false, 500},
+		{"counter reset", 1000, 200, false, 200},
+		{"interface recreated", 1000, 1500, true, 1500},
+		{"interface recreated with no traffic", 1000, 0, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := bandwidth.CounterDelta(tt.last, tt.current, tt.restarted)
+			if got != tt.want {
+				t.Errorf("CounterDelta() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package bulk
+
+import (
+	"fmt"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/services"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/babel"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/olsr"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+	"gorm.io/gorm"
+)
+
+// Activate brings up a batch of imported tunnels. The routing daemons are
+// regenerated and reloaded once for the whole batch rather than per tunnel.
+func Activate(config *config.Config, db *gorm.DB, wireguardManager *wireguard.Manager, serviceRegistry *services.Registry, tunnels []models.Tunnel) error {
+	if len(tunnels) == 0 {
+		return nil
+	}
+
+	for _, tunnel := range tunnels {
+		err := wireguardManager.AddPeer(tunnel)
+		if err != nil {
+			return fmt.Errorf("failed to add wireguard peer %s: %w", tunnel.Hostname, err)
+		}
+	}
+
+	if config.OLSR {
+		err := olsr.GenerateAndSave(config, db)
+		if err != nil {
+			return fmt.Errorf("failed to generate olsrd config: %w", err)
+		}
+		olsrService, ok := serviceRegistry.Get(services.OLSRServiceName)
+		if !ok {
+			return fmt.Errorf("olsrd service is not registered")
+		}
+		err = olsrService.Reload()
+		if err != nil {
+			return fmt.Errorf("failed to reload olsrd: %w", err)
+		}
+	}
+
+	if config.Babel.Enabled {
+		err := babel.GenerateAndSave(config, db)
+		if err != nil {
+			return fmt.Errorf("failed to generate babeld config: %w", err)
+		}
+		babelServiceIface, ok := serviceRegistry.Get(services.BabelServiceName)
+		if !ok {
+			return fmt.Errorf("babel service is not registered")
+		}
+		babelService, ok := babelServiceIface.(*babel.Service)
+		if !ok {
+			return fmt.Errorf("babel service has the wrong type")
+		}
+		// babeld takes new interfaces over its socket, the shared interface only once
+		added := make(map[string]bool)
+		for _, tunnel := range tunnels {
+			iface := wireguard.GenerateWireguardInterfaceName(tunnel)
+			if !tunnel.Enabled || added[iface] {
+				continue
+			}
+			added[iface] = true
+			err = babelService.AddTunnel(iface, babel.InterfaceTuning(config, tunnel))
+			if err != nil {
+				return fmt.Errorf("failed to add babel tunnel %s: %w", iface, err)
+			}
+		}
+	}
+
+	dnsmasqService, ok := serviceRegistry.Get(services.DNSMasqServiceName)
+	if !ok {
+		return fmt.Errorf("dnsmasq service is not registered")
+	}
+	err := dnsmasqService.Reload()
+	if err != nil {
+		return fmt.Errorf("failed to reload dnsmasq: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package bulk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"path"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	ErrAREDNNoTunnels = errors.New("backup has no tunnel config")
+	ErrUCISyntax      = errors.New("invalid uci syntax")
+)
+
+// AREDN nodes keep their tunnels in the vtun UCI config. config.mesh holds
+// the settings the node generates /etc/config from, so it wins when a backup has both.
+//
+//nolint:gochecknoglobals
+var arednTunnelConfigs = []string{"etc/config.mesh/vtun", "etc/config/vtun"}
+
+const tarMagicOffset = 257
+
+// uciSection is a single config block of a UCI file
+type uciSection struct {
+	Type    string
+	Name    string
+	Options map[string]string
+}
+
+// decodeAREDN reads the tunnels from an AREDN backup archive, gzipped or
+// not, or from the vtun UCI file on its own
+func decodeAREDN(r io.Reader) ([]Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+	}
+
+	if len(data) > tarMagicOffset+5 && string(data[tarMagicOffset:tarMagicOffset+5]) == "ustar" {
+		data, err = arednTunnelConfig(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sections, err := parseUCI(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return arednRecords(sections), nil
+}
+
+// arednTunnelConfig pulls the vtun config out of a backup tarball
+func arednTunnelConfig(archive []byte) ([]byte, error) {
+	files := make(map[string][]byte)
+	reader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+		name := strings.TrimPrefix(path.Clean(header.Name), "/")
+		for _, config := range arednTunnelConfigs {
+			if name == config {
+				files[name], err = io.ReadAll(reader)
+				if err != nil {
+					return nil, fmt.Errorf("invalid backup: %w", err)
+				}
+			}
+		}
+	}
+	for _, config := range arednTunnelConfigs {
+		if data, ok := files[config]; ok {
+			return data, nil
+		}
+	}
+	return nil, ErrAREDNNoTunnels
+}
+
+// parseUCI reads the config, option and list lines of a UCI file. Lists
+// are joined with spaces since tunnels don't use them.
+func parseUCI(r io.Reader) ([]uciSection, error) {
+	var sections []uciSection
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		fields, err := uciFields(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w on line %d: %w", ErrUCISyntax, lineNumber, err)
+		}
+		switch keyword {
+		case "config":
+			if len(fields) < 1 || len(fields) > 2 {
+				return nil, fmt.Errorf("%w on line %d: config needs a type and optional name", ErrUCISyntax, lineNumber)
+			}
+			section := uciSection{Type: fields[0], Options: make(map[string]string)}
+			if len(fields) == 2 {
+				section.Name = fields[1]
+			}
+			sections = append(sections, section)
+		case "option", "list":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%w on line %d: %s needs a name and value", ErrUCISyntax, lineNumber, keyword)
+			}
+			if len(sections) == 0 {
+				return nil, fmt.Errorf("%w on line %d: %s outside of a config", ErrUCISyntax, lineNumber, keyword)
+			}
+			options := sections[len(sections)-1].Options
+			if keyword == "list" && options[fields[0]] != "" {
+				options[fields[0]] += " " + fields[1]
+			} else {
+				options[fields[0]] = fields[1]
+			}
+		default:
+			return nil, fmt.Errorf("%w on line %d: unknown keyword %q", ErrUCISyntax, lineNumber, keyword)
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// uciFields splits a line into words, which may be single or double quoted
+func uciFields(s string) ([]string, error) {
+	var fields []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || strings.HasPrefix(s, "#") {
+			return fields, nil
+		}
+		quote := s[0]
+		if quote != '\'' && quote != '"' {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+		end := strings.IndexByte(s[1:], quote)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quote")
+		}
+		fields = append(fields, s[1:end+1])
+		s = s[end+2:]
+	}
+}
+
+// arednRecords maps the server and client sections of a vtun config to
+// records. AREDN tells wireguard tunnels apart from vtun ones by the port on
+// their network address.
+func arednRecords(sections []uciSection) []Record {
+	var records []Record
+	for _, section := range sections {
+		switch section.Type {
+		case "server":
+			records = append(records, arednServerRecord(section.Options))
+		case "client":
+			records = append(records, arednClientRecord(section.Options))
+		}
+	}
+	return records
+}
+
+func arednServerRecord(options map[string]string) Record {
+	enabled := options["enabled"] != "0"
+	record := Record{
+		Hostname: options["node"],
+		Enabled:  &enabled,
+	}
+	arednOwner(&record, options["node"], options["contact"])
+
+	host, port, err := utils.SplitHostPort(options["netip"])
+	if err != nil {
+		// A vtun server becomes a wireguard server on the same addresses. vtun
+		// gives the server the address after the network and the client the one after that.
+		record.IP = options["serverip"]
+		if record.IP == "" {
+			if network, err := netip.ParseAddr(options["netip"]); err == nil {
+				record.IP = network.Next().String()
+			}
+		}
+		record.notes = append(record.notes, "converted from a vtun server, the remote node needs the new wireguard password")
+		return record
+	}
+	record.IP = host
+	record.WireguardPort = port
+
+	// AREDN keeps the server's private key followed by the client's private key
+	serverKey, clientKey, ok := splitAREDNServerKeys(options["passwd"])
+	if !ok {
+		record.notes = append(record.notes, "server keys could not be read, the remote node needs the new password")
+		return record
+	}
+	record.ServerKey = serverKey.String()
+	record.Password = models.NewWireguardCredential(serverKey, clientKey, nil).String()
+	return record
+}
+
+// arednOwner fills in the owner of a server tunnel. AREDN node names start
+// with the owner's callsign, and the free-form contact is kept in the notes
+// when it isn't an email address.
+func arednOwner(record *Record, node string, contact string) {
+	prefix, _, _ := strings.Cut(node, "-")
+	if callsign, err := models.NormalizeCallsign(prefix); err == nil {
+		record.Callsign = callsign
+	}
+	if contact == "" {
+		return
+	}
+	if address, err := models.NormalizeContact(contact); err == nil {
+		record.Contact = address
+	} else {
+		record.Notes = "Contact: " + contact
+	}
+}
+
+func splitAREDNServerKeys(passwd string) (wgtypes.Key, wgtypes.Key, bool) {
+	const keyLength = models.WireguardCredentialLength / 3
+	if len(passwd) != 2*keyLength {
+		return wgtypes.Key{}, wgtypes.Key{}, false
+	}
+	serverKey, err := wgtypes.ParseKey(passwd[:keyLength])
+	if err != nil {
+		return wgtypes.Key{}, wgtypes.Key{}, false
+	}
+	clientKey, err := wgtypes.ParseKey(passwd[keyLength:])
+	if err != nil {
+		return wgtypes.Key{}, wgtypes.Key{}, false
+	}
+	return serverKey, clientKey, true
+}
+
+func arednClientRecord(options map[string]string) Record {
+	enabled := options["enabled"] != "0"
+	record := Record{
+		Hostname: options["name"],
+		Client:   true,
+		Enabled:  &enabled,
+		Password: options["passwd"],
+	}
+
+	host, port, err := utils.SplitHostPort(options["netip"])
+	if err != nil {
+		record.IP = options["netip"]
+		record.skip = "vtun client tunnels aren't supported, skipped"
+		return record
+	}
+	// Client tunnels keep the server's port on the hostname
+	record.Hostname = utils.JoinHostPort(options["name"], port)
+	record.IP = host
+	return record
+}
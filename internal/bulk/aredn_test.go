@@ -0,0 +1,136 @@
+package bulk_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/bulk"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func arednBackup(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeAREDN(t *testing.T) {
+	t.Parallel()
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	credential := models.NewWireguardCredential(serverKey, clientKey, nil).String()
+
+	vtun := `
+config options 'network'
+	option start '172.31.0.0'
+
+# wireguard server
+config server
+	option enabled '1'
+	option node 'ki5vmf-home'
+	option passwd '` + serverKey.String() + clientKey.String() + `'
+	option netip '172.31.20.4:5527'
+	option contact "someone@example.com"
+
+config server
+	option enabled '0'
+	option node 'N0CALL-OLD'
+	option passwd 'hunter2'
+	option netip '172.31.20.8'
+	option serverip '172.31.20.9'
+	option clientip '172.31.20.10'
+	option contact 'Bob, 555-0100'
+
+config client
+	option enabled '1'
+	option name 'tunnels.example.com'
+	option passwd '` + credential + `'
+	option netip '172.31.30.6:5530'
+
+config client
+	option enabled '1'
+	option name 'vtun.example.com'
+	option passwd 'hunter2'
+	option netip '172.31.40.0'
+`
+
+	backup := arednBackup(t, map[string]string{
+		"etc/config/vtun":      "config server\n\toption node 'STALE'\n",
+		"etc/config.mesh/vtun": vtun,
+	})
+
+	for name, data := range map[string][]byte{"backup": backup, "config": []byte(vtun)} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			records, err := bulk.Decode(bytes.NewReader(data), bulk.FormatAREDN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 4 {
+				t.Fatalf("got %d records, want 4", len(records))
+			}
+
+			wg := records[0]
+			if wg.Hostname != "ki5vmf-home" || wg.IP != "172.31.20.4" || wg.WireguardPort != 5527 {
+				t.Errorf("wireguard server = %+v", wg)
+			}
+			if wg.ServerKey != serverKey.String() || wg.Password != credential {
+				t.Errorf("wireguard server keys were not kept")
+			}
+			if wg.Callsign != "KI5VMF" || wg.Contact != "someone@example.com" {
+				t.Errorf("wireguard server owner = %q %q", wg.Callsign, wg.Contact)
+			}
+
+			old := records[1]
+			if old.IP != "172.31.20.9" || old.ServerKey != "" || old.Password != "" || *old.Enabled {
+				t.Errorf("vtun server = %+v", old)
+			}
+			if old.Callsign != "N0CALL" || old.Contact != "" || old.Notes != "Contact: Bob, 555-0100" {
+				t.Errorf("vtun server owner = %q %q %q", old.Callsign, old.Contact, old.Notes)
+			}
+
+			client := records[2]
+			if !client.Client || client.Hostname != "tunnels.example.com:5530" || client.IP != "172.31.30.6" || client.Password != credential {
+				t.Errorf("wireguard client = %+v", client)
+			}
+		})
+	}
+}
+
+func TestDecodeAREDNErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := bulk.Decode(bytes.NewReader(arednBackup(t, map[string]string{"etc/config/network": ""})), bulk.FormatAREDN)
+	if !errors.Is(err, bulk.ErrAREDNNoTunnels) {
+		t.Errorf("backup without tunnels = %v, want %v", err, bulk.ErrAREDNNoTunnels)
+	}
+
+	_, err = bulk.Decode(strings.NewReader("config server\n\toption node 'unterminated\n"), bulk.FormatAREDN)
+	if !errors.Is(err, bulk.ErrUCISyntax) {
+		t.Errorf("bad quoting = %v, want %v", err, bulk.ErrUCISyntax)
+	}
+}
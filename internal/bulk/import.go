@@ -0,0 +1,370 @@
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+	"github.com/USA-RedDragon/mesh-manager/internal/ipam"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// Result is what importing a single record did, or would do on a dry run
+type Result struct {
+	// Row is the record's position in the file, starting at 1
+	Row           int      `json:"row"`
+	Hostname      string   `json:"hostname"`
+	IP            string   `json:"ip,omitempty"`
+	WireguardPort uint16   `json:"wireguard_port,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	Skipped       bool     `json:"skipped,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// Report is the outcome of an import. Nothing is created unless every record is valid.
+type Report struct {
+	DryRun  bool     `json:"dry_run"`
+	Applied bool     `json:"applied"`
+	Valid   int      `json:"valid"`
+	Invalid int      `json:"invalid"`
+	Skipped int      `json:"skipped"`
+	Results []Result `json:"results"`
+}
+
+// invalidError is a problem with a record, reported back rather than failing the import
+type invalidError string
+
+func (e invalidError) Error() string {
+	return string(e)
+}
+
+var errRollback = errors.New("import rolled back")
+
+// Importer creates tunnels from exported records
+type Importer struct {
+	config    *config.Config
+	ipam      *ipam.IPAM
+	sharedKey func() (wgtypes.Key, error)
+}
+
+// NewImporter creates an importer. sharedKey returns the shared interface key
+// and is only called when the shared interface is enabled.
+func NewImporter(config *config.Config, ipam *ipam.IPAM, sharedKey func() (wgtypes.Key, error)) *Importer {
+	return &Importer{
+		config:    config,
+		ipam:      ipam,
+		sharedKey: sharedKey,
+	}
+}
+
+// Import validates the records and creates their tunnels in a single
+// transaction, allocating IPs and ports as it goes so the batch never
+// collides with itself. On a dry run, or when any record is invalid, the
+// transaction is rolled back and only the report is returned.
+func (im *Importer) Import(records []Record, dryRun bool) (Report, []models.Tunnel, error) {
+	report := Report{
+		DryRun:  dryRun,
+		Results: make([]Result, 0, len(records)),
+	}
+
+	// The shared key is stored on first use, which must not wait on our transaction
+	var sharedKey *wgtypes.Key
+	if im.config.Wireguard.SharedInterface && hasServerRecords(records) {
+		key, err := im.sharedKey()
+		if err != nil {
+			return report, nil, fmt.Errorf("failed to get shared interface key: %w", err)
+		}
+		sharedKey = &key
+	}
+
+	var created []models.Tunnel
+	err := im.ipam.Transaction(func(tx *gorm.DB, allocator *ipam.IPAM) error {
+		for i, record := range records {
+			result := Result{
+				Row:      i + 1,
+				Hostname: record.Hostname,
+				Warnings: record.notes,
+			}
+			if record.skip != "" {
+				result.Warnings = append(result.Warnings, record.skip)
+				result.Skipped = true
+				report.Skipped++
+				report.Results = append(report.Results, result)
+				continue
+			}
+			tunnel, err := im.newTunnel(tx, allocator, sharedKey, record, &result)
+			var invalid invalidError
+			if errors.As(err, &invalid) {
+				result.Error = invalid.Error()
+				report.Invalid++
+				report.Results = append(report.Results, result)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("row %d: %w", i+1, err)
+			}
+
+			err = tx.Create(&tunnel).Error
+			if err != nil {
+				return fmt.Errorf("row %d: failed to create tunnel: %w", i+1, err)
+			}
+			result.Hostname = tunnel.Hostname
+			result.IP = tunnel.IP
+			result.WireguardPort = tunnel.WireguardPort
+			report.Valid++
+			report.Results = append(report.Results, result)
+			created = append(created, tunnel)
+		}
+
+		if dryRun || report.Invalid > 0 {
+			return errRollback
+		}
+		return nil
+	})
+	if errors.Is(err, errRollback) {
+		return report, nil, nil
+	} else if err != nil {
+		return report, nil, err
+	}
+
+	report.Applied = true
+	return report, created, nil
+}
+
+func hasServerRecords(records []Record) bool {
+	for _, record := range records {
+		if !record.Client && record.skip == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newTunnel validates a record and builds its tunnel. Problems with the record are returned as an invalidError.
+func (im *Importer) newTunnel(tx *gorm.DB, allocator *ipam.IPAM, sharedKey *wgtypes.Key, record Record, result *Result) (models.Tunnel, error) {
+	err := record.Tuning.Validate(im.config.Tunnels)
+	if err != nil {
+		return models.Tunnel{}, invalidError(err.Error())
+	}
+	err = models.ValidateFirewall(record.FirewallPolicy, record.FirewallRules)
+	if err != nil {
+		return models.Tunnel{}, invalidError(err.Error())
+	}
+	err = firewall.CheckPolicy(record.FirewallPolicy)
+	if err != nil {
+		return models.Tunnel{}, invalidError(err.Error())
+	}
+	err = record.Quota.Validate()
+	if err != nil {
+		return models.Tunnel{}, invalidError(err.Error())
+	}
+
+	enabled := true
+	if record.Enabled != nil {
+		enabled = *record.Enabled
+	}
+	tunnel := models.Tunnel{
+		Enabled:        enabled,
+		Client:         record.Client,
+		Wireguard:      true,
+		Tuning:         record.Tuning,
+		RateLimit:      record.RateLimit,
+		Quota:          record.Quota,
+		FirewallPolicy: record.FirewallPolicy.Effective(),
+		FirewallRules:  record.FirewallRules,
+	}
+	err = tunnel.SetOwner(record.Callsign, record.Contact, record.Notes, record.Tags)
+	if err != nil {
+		return models.Tunnel{}, invalidError(err.Error())
+	}
+
+	if record.Client {
+		err = im.clientTunnel(tx, record, &tunnel)
+	} else {
+		err = im.serverTunnel(tx, allocator, sharedKey, record, &tunnel, result)
+	}
+	return tunnel, err
+}
+
+func (im *Importer) serverTunnel(tx *gorm.DB, allocator *ipam.IPAM, sharedKey *wgtypes.Key, record Record, tunnel *models.Tunnel, result *Result) error {
+	create := apimodels.CreateTunnel{Hostname: strings.ToUpper(record.Hostname)}
+	isValid, errString := create.IsValidHostname()
+	if !isValid {
+		return invalidError(errString)
+	}
+	tunnel.Hostname = create.Hostname
+
+	var existing models.Tunnel
+	err := tx.Find(&existing, "hostname = ? AND wireguard = ?", tunnel.Hostname, true).Error
+	if err != nil {
+		return err
+	} else if existing.ID != 0 {
+		return invalidError("Hostname is already taken")
+	}
+
+	if record.IP == "" {
+		subnet, err := allocator.NextSubnet()
+		if errors.Is(err, ipam.ErrPoolsExhausted) {
+			return invalidError(err.Error())
+		} else if err != nil {
+			return err
+		}
+		tunnel.IP = subnet.Addr().String()
+	} else {
+		addr, err := netip.ParseAddr(record.IP)
+		if err != nil || !addr.Is4() {
+			return invalidError("IP is not a valid IPv4 address")
+		}
+		free, err := allocator.SubnetFree(addr)
+		if err != nil {
+			return err
+		} else if !free {
+			return invalidError("IP address is already taken")
+		}
+		tunnel.IP = addr.String()
+	}
+
+	// Tunnels on the shared interface all use its key and port, so a tunnel
+	// moved onto it from a dedicated interface needs its credential reissued
+	var serverKey wgtypes.Key
+	keyReplaced := false
+	if sharedKey != nil {
+		serverKey = *sharedKey
+		tunnel.SharedInterface = true
+		tunnel.WireguardPort = im.config.Wireguard.SharedPort
+		if tunnel.Tuning.ValidateShared() != nil {
+			tunnel.Tuning.MTU = nil
+			result.Warnings = append(result.Warnings, "MTU tuning was dropped, the shared interface uses the default MTU")
+		}
+		if record.ServerKey != "" && record.ServerKey != serverKey.String() {
+			keyReplaced = true
+			result.Warnings = append(result.Warnings, "server key was replaced by the shared interface key, the remote end needs the new password")
+		}
+		if record.WireguardPort != 0 && record.WireguardPort != tunnel.WireguardPort {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("port changed from %d to the shared interface port %d", record.WireguardPort, tunnel.WireguardPort))
+		}
+	} else {
+		if record.ServerKey != "" {
+			serverKey, err = wgtypes.ParseKey(record.ServerKey)
+			if err != nil {
+				return invalidError("Server key is invalid")
+			}
+		} else {
+			serverKey, err = wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return err
+			}
+		}
+
+		if record.WireguardPort != 0 {
+			free, err := allocator.PortFree(record.WireguardPort)
+			if err != nil {
+				return err
+			} else if !free {
+				return invalidError("Port is already taken")
+			}
+			tunnel.WireguardPort = record.WireguardPort
+		} else {
+			tunnel.WireguardPort, err = allocator.NextPort()
+			if errors.Is(err, ipam.ErrPortsExhausted) {
+				return invalidError(err.Error())
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	tunnel.WireguardServerKey = serverKey.String()
+
+	var cred models.WireguardCredential
+	if record.Password != "" {
+		cred, err = models.ParseWireguardCredential(record.Password)
+		if err != nil {
+			return invalidError("Key is invalid")
+		}
+		if cred.ServerPubkey != serverKey.PublicKey().String() {
+			if !keyReplaced {
+				return invalidError("Key does not belong to the server key")
+			}
+			cred.ServerPubkey = serverKey.PublicKey().String()
+		}
+	} else {
+		clientKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		var psk *wgtypes.Key
+		if im.config.Wireguard.PresharedKeys {
+			key, err := wgtypes.GenerateKey()
+			if err != nil {
+				return err
+			}
+			psk = &key
+		}
+		cred = models.NewWireguardCredential(serverKey, clientKey, psk)
+	}
+	tunnel.SetWireguardCredential(cred)
+	return nil
+}
+
+func (im *Importer) clientTunnel(tx *gorm.DB, record Record, tunnel *models.Tunnel) error {
+	// Client tunnels are stored with the server's port in the hostname. IPv6
+	// addresses must be bracketed, as in [2001:db8::1]:5527
+	host, _, err := utils.SplitHostPort(record.Hostname)
+	if err != nil {
+		return invalidError("Server address must be an address and port")
+	}
+	if net.ParseIP(host) == nil {
+		_, err := url.ParseRequestURI("http://" + host)
+		if err != nil {
+			return invalidError("Server address is invalid")
+		}
+	}
+	tunnel.Hostname = record.Hostname
+
+	create := apimodels.CreateTunnel{FallbackEndpoints: record.FallbackEndpoints}
+	isValid, errString := create.IsValidFallbackEndpoints()
+	if !isValid {
+		return invalidError(errString)
+	}
+	tunnel.FallbackEndpoints = record.FallbackEndpoints
+
+	// The IP must be in the correct range: 172.16.0.0/12
+	ip := net.ParseIP(record.IP)
+	if ip == nil {
+		return invalidError("IP is not a valid IP address")
+	}
+	_, cidr, err := net.ParseCIDR("172.16.0.0/12")
+	if err != nil {
+		return err
+	}
+	if !cidr.Contains(ip) {
+		return invalidError("IP is not in the correct range")
+	}
+
+	var existing models.Tunnel
+	err = tx.Find(&existing, "ip = ?", record.IP).Error
+	if err != nil {
+		return err
+	} else if existing.ID != 0 {
+		return invalidError("IP address is already taken")
+	}
+	tunnel.IP = record.IP
+
+	if record.Password == "" {
+		return invalidError("Password cannot be empty")
+	}
+	cred, err := models.ParseWireguardCredential(record.Password)
+	if err != nil {
+		return invalidError("Key is invalid")
+	}
+	tunnel.SetWireguardCredential(cred)
+	return nil
+}
@@ -0,0 +1,326 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+// Format is a file format tunnels can be exported to and imported from
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+	// FormatAREDN is an AREDN node's backup archive or vtun config, only for importing
+	FormatAREDN Format = "aredn"
+)
+
+var (
+	ErrFormatInvalid       = errors.New("format must be json, csv or aredn")
+	ErrFormatNotExportable = errors.New("tunnels can only be exported as json or csv")
+	ErrCSVColumn           = errors.New("unknown csv column")
+)
+
+// ParseFormat returns the format with the given name, defaulting to JSON
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatCSV:
+		return FormatCSV, nil
+	case FormatAREDN:
+		return FormatAREDN, nil
+	default:
+		return "", ErrFormatInvalid
+	}
+}
+
+// Exportable reports whether tunnels can be exported in the format
+func (f Format) Exportable() bool {
+	return f != FormatAREDN
+}
+
+// ContentType is the MIME type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatAREDN:
+		return "application/octet-stream"
+	default:
+		return "application/json"
+	}
+}
+
+// Record is a wireguard tunnel with everything needed to recreate it on
+// another server, credentials included
+type Record struct {
+	// Hostname is the remote node for server tunnels, and the server's host:port for client tunnels
+	Hostname string `json:"hostname"`
+	// IP is allocated on import when left empty on server tunnels
+	IP     string `json:"ip"`
+	Client bool   `json:"client"`
+	// Enabled defaults to true when left out
+	Enabled *bool `json:"enabled,omitempty"`
+	// WireguardPort is allocated on import when left empty on server tunnels
+	WireguardPort uint16 `json:"wireguard_port,omitempty"`
+	// ServerKey is the private key of a server tunnel, generated on import when left empty
+	ServerKey string `json:"server_key,omitempty"`
+	// Password is the combined wireguard credential, generated on import
+	// when left empty on server tunnels
+	Password          string                 `json:"password"`
+	FallbackEndpoints []string               `json:"fallback_endpoints,omitempty"`
+	Tuning            models.TunnelTuning    `json:"tuning"`
+	RateLimit         models.TunnelRateLimit `json:"rate_limit"`
+	Quota             models.TunnelQuota     `json:"quota"`
+	FirewallPolicy    models.FirewallPolicy  `json:"firewall_policy,omitempty"`
+	FirewallRules     []models.FirewallRule  `json:"firewall_rules,omitempty"`
+	Callsign          string                 `json:"callsign,omitempty"`
+	Contact           string                 `json:"contact,omitempty"`
+	Notes             string                 `json:"notes,omitempty"`
+	Tags              []string               `json:"tags,omitempty"`
+
+	// notes are carried into the import report, such as how a tunnel was converted
+	notes []string
+	// skip is why the record can't be imported. Skipped records don't fail the import.
+	skip string
+}
+
+// NewRecord exports a tunnel
+func NewRecord(tunnel models.Tunnel) Record {
+	enabled := tunnel.Enabled
+	record := Record{
+		Hostname:          tunnel.Hostname,
+		IP:                tunnel.IP,
+		Client:            tunnel.Client,
+		Enabled:           &enabled,
+		Password:          tunnel.WireguardCredential().String(),
+		FallbackEndpoints: tunnel.FallbackEndpoints,
+		Tuning:            tunnel.Tuning,
+		RateLimit:         tunnel.RateLimit,
+		Quota:             tunnel.Quota,
+		FirewallPolicy:    tunnel.FirewallPolicy.Effective(),
+		FirewallRules:     tunnel.FirewallRules,
+		Callsign:          tunnel.Callsign,
+		Contact:           tunnel.Contact,
+		Notes:             tunnel.Notes,
+		Tags:              tunnel.Tags,
+	}
+	if !tunnel.Client {
+		record.WireguardPort = tunnel.WireguardPort
+		record.ServerKey = tunnel.WireguardServerKey
+	}
+	return record
+}
+
+// csvColumns are the CSV header. Structured settings are stored as JSON in their cell.
+//
+//nolint:gochecknoglobals
+var csvColumns = []string{
+	"hostname",
+	"ip",
+	"client",
+	"enabled",
+	"wireguard_port",
+	"server_key",
+	"password",
+	"fallback_endpoints",
+	"tuning",
+	"rate_limit",
+	"quota",
+	"firewall_policy",
+	"firewall_rules",
+	"callsign",
+	"contact",
+	"notes",
+	"tags",
+}
+
+// Encode writes the records in the given format
+func Encode(w io.Writer, format Format, records []Record) error {
+	switch format {
+	case FormatCSV:
+		return encodeCSV(w, records)
+	case FormatAREDN:
+		return ErrFormatNotExportable
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+// Decode reads records in the given format
+func Decode(r io.Reader, format Format) ([]Record, error) {
+	switch format {
+	case FormatCSV:
+		return decodeCSV(r)
+	case FormatAREDN:
+		return decodeAREDN(r)
+	}
+	var records []Record
+	err := json.NewDecoder(r).Decode(&records)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	return records, nil
+}
+
+func encodeCSV(w io.Writer, records []Record) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(csvColumns)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		row, err := record.csvRow()
+		if err != nil {
+			return err
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (r Record) csvRow() ([]string, error) {
+	enabled := ""
+	if r.Enabled != nil {
+		enabled = strconv.FormatBool(*r.Enabled)
+	}
+	port := ""
+	if r.WireguardPort != 0 {
+		port = strconv.FormatUint(uint64(r.WireguardPort), 10)
+	}
+	row := []string{
+		r.Hostname,
+		r.IP,
+		strconv.FormatBool(r.Client),
+		enabled,
+		port,
+		r.ServerKey,
+		r.Password,
+		strings.Join(r.FallbackEndpoints, " "),
+	}
+	for _, v := range []any{r.Tuning, r.RateLimit, r.Quota} {
+		cell, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, string(cell))
+	}
+	row = append(row, string(r.FirewallPolicy))
+	rules := ""
+	if len(r.FirewallRules) > 0 {
+		cell, err := json.Marshal(r.FirewallRules)
+		if err != nil {
+			return nil, err
+		}
+		rules = string(cell)
+	}
+	return append(row, rules, r.Callsign, r.Contact, r.Notes, strings.Join(r.Tags, " ")), nil
+}
+
+// decodeCSV reads a CSV file with a header row. Columns may be in any order
+// and any but hostname may be left out.
+func decodeCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(csvColumns, header[i]) {
+			return nil, fmt.Errorf("%w: %q", ErrCSVColumn, name)
+		}
+	}
+	reader.FieldsPerRecord = len(header)
+
+	var records []Record
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		var record Record
+		for i, cell := range row {
+			err = record.setCSVField(header[i], strings.TrimSpace(cell))
+			if err != nil {
+				line, _ := reader.FieldPos(i)
+				return nil, fmt.Errorf("invalid csv on line %d: %s: %w", line, header[i], err)
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+func (r *Record) setCSVField(column string, cell string) error {
+	if cell == "" {
+		return nil
+	}
+	switch column {
+	case "hostname":
+		r.Hostname = cell
+	case "ip":
+		r.IP = cell
+	case "client":
+		client, err := strconv.ParseBool(cell)
+		if err != nil {
+			return err
+		}
+		r.Client = client
+	case "enabled":
+		enabled, err := strconv.ParseBool(cell)
+		if err != nil {
+			return err
+		}
+		r.Enabled = &enabled
+	case "wireguard_port":
+		port, err := strconv.ParseUint(cell, 10, 16)
+		if err != nil {
+			return err
+		}
+		r.WireguardPort = uint16(port)
+	case "server_key":
+		r.ServerKey = cell
+	case "password":
+		r.Password = cell
+	case "fallback_endpoints":
+		r.FallbackEndpoints = strings.Fields(cell)
+	case "tuning":
+		return json.Unmarshal([]byte(cell), &r.Tuning)
+	case "rate_limit":
+		return json.Unmarshal([]byte(cell), &r.RateLimit)
+	case "quota":
+		return json.Unmarshal([]byte(cell), &r.Quota)
+	case "firewall_policy":
+		r.FirewallPolicy = models.FirewallPolicy(cell)
+	case "firewall_rules":
+		return json.Unmarshal([]byte(cell), &r.FirewallRules)
+	case "callsign":
+		r.Callsign = cell
+	case "contact":
+		r.Contact = cell
+	case "notes":
+		r.Notes = cell
+	case "tags":
+		r.Tags = strings.Fields(cell)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package bulk_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/bulk"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	enabled := false
+	mtu := 1380
+	records := []bulk.Record{
+		{
+			Hostname:       "KI5VMF-A",
+			IP:             "10.54.0.4",
+			Enabled:        &enabled,
+			WireguardPort:  5527,
+			ServerKey:      "server-key",
+			Password:       "credential",
+			Tuning:         models.TunnelTuning{MTU: &mtu},
+			RateLimit:      models.TunnelRateLimit{IngressKbps: 1000},
+			Quota:          models.TunnelQuota{LimitMB: 500, Action: models.QuotaActionWarn},
+			FirewallPolicy: models.FirewallPolicy("allow-all"),
+			Callsign:       "KI5VMF",
+			Contact:        "ki5vmf@example.com",
+			Notes:          "Hilltop site, \"ask\" before rebooting,\nkey is with the club",
+			Tags:           []string{"club", "backbone"},
+		},
+		{
+			Hostname:          "tunnels.example.com:5527",
+			IP:                "172.16.0.5",
+			Client:            true,
+			Password:          "credential",
+			FallbackEndpoints: []string{"[2001:db8::1]:5527", "10.0.0.1:5527"},
+		},
+	}
+
+	for _, format := range []bulk.Format{bulk.FormatJSON, bulk.FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			err := bulk.Encode(&buf, format, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := bulk.Decode(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, records) {
+				t.Errorf("round trip = %+v, want %+v", got, records)
+			}
+		})
+	}
+}
+
+func TestDecodeCSVColumns(t *testing.T) {
+	t.Parallel()
+
+	got, err := bulk.Decode(strings.NewReader("IP, hostname\n10.54.0.4,ki5vmf-a\n"), bulk.FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bulk.Record{{Hostname: "ki5vmf-a", IP: "10.54.0.4"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode = %+v, want %+v", got, want)
+	}
+
+	_, err = bulk.Decode(strings.NewReader("hostname,secret\nki5vmf-a,x\n"), bulk.FormatCSV)
+	if !errors.Is(err, bulk.ErrCSVColumn) {
+		t.Errorf("Decode with an unknown column = %v, want %v", err, bulk.ErrCSVColumn)
+	}
+}
@@ -2,7 +2,11 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 )
 
 type LogLevel string
@@ -14,6 +18,14 @@ const (
 	LogLevelError LogLevel = "error"
 )
 
+type AddressFamily string
+
+const (
+	AddressFamilyAny  AddressFamily = "any"
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
 type PProf struct {
 	Enabled bool `name:"enabled" description:"Enable pprof debugging" default:"false"`
 }
@@ -38,8 +50,61 @@ type Metrics struct {
 }
 
 type Wireguard struct {
-	StartingAddress string `name:"starting-address" description:"Starting address for Wireguard"`
-	StartingPort    uint16 `name:"starting-port" description:"Starting port for Wireguard" default:"5527"`
+	StartingAddress       string        `name:"starting-address" description:"Starting address for Wireguard"`
+	StartingPort          uint16        `name:"starting-port" description:"Starting port for Wireguard" default:"5527"`
+	ReconcileInterval     int           `name:"reconcile-interval" description:"Seconds between reconciling tunnels against the kernel state, 0 to disable" default:"60"`
+	SharedInterface       bool          `name:"shared-interface" description:"Put new server tunnels on a single multi-peer interface instead of one interface each. OLSR is not run over the shared interface" default:"false"`
+	SharedPort            uint16        `name:"shared-port" description:"Listen port for the shared server interface" default:"5526"`
+	EndpointCheckInterval int           `name:"endpoint-check-interval" description:"Seconds between checking client tunnels for stale handshakes, 0 to disable" default:"30"`
+	HandshakeTimeout      int           `name:"handshake-timeout" description:"Seconds without a handshake before a client tunnel endpoint is re-resolved or failed over" default:"180"`
+	EndpointFamily        AddressFamily `name:"endpoint-family" description:"Preferred address family when resolving client tunnel endpoints. One of any, ipv4, or ipv6" default:"any"`
+	PresharedKeys         bool          `name:"preshared-keys" description:"Generate a preshared key for new server tunnels by default. AREDN nodes do not accept credentials that include one" default:"false"`
+	PublicHostname        string        `name:"public-hostname" description:"Hostname or address clients use to reach this server in exported client configs. Defaults to the host the API was reached on"`
+	KeyRotationInterval   int           `name:"key-rotation-interval" description:"Days between automatic key rotations of server tunnels, 0 to disable" default:"0"`
+	KeyRotationWindow     int           `name:"key-rotation-window" description:"Hours the remote operator has to install rotated keys before they take effect" default:"168"`
+	Pools                 []string      `name:"pools" description:"IPv4 CIDR pools server tunnel subnets are allocated from, in order. A pool may set its own subnet prefix length, as in 10.54.0.0/16:31. Defaults to the /16 after starting-address"`
+	StrictAllowedIPs      bool          `name:"strict-allowed-ips" description:"Only accept traffic from a peer's tunnel addresses and the node and LAN prefixes it advertises over OLSR or Babel. Suits leaf nodes, as traffic a peer forwards from elsewhere in the mesh is dropped" default:"false"`
+	AllowedIPsInterval    int           `name:"allowed-ips-interval" description:"Seconds between refreshing peer prefixes from the routing daemons for shared interface peers and in strict allowed IPs mode" default:"30"`
+	BlockPrefix           int           `name:"block-prefix" description:"Prefix length of the subnet allocated to each server tunnel, between 24 and 31" default:"30"`
+}
+
+type Tunnels struct {
+	MTU                 int     `name:"mtu" description:"Default MTU of wireguard tunnel interfaces" default:"1420"`
+	PersistentKeepalive int     `name:"persistent-keepalive" description:"Default seconds between wireguard keepalives, 0 to disable" default:"25"`
+	BabelRxcost         int     `name:"babel-rxcost" description:"Default Babel rxcost of tunnel interfaces" default:"206"`
+	BabelHelloInterval  int     `name:"babel-hello-interval" description:"Default seconds between Babel hellos on tunnel interfaces" default:"10"`
+	BabelRttMin         int     `name:"babel-rtt-min" description:"Default Babel rtt-min in milliseconds of tunnel interfaces" default:"10"`
+	BabelRttMax         int     `name:"babel-rtt-max" description:"Default Babel rtt-max in milliseconds of tunnel interfaces" default:"400"`
+	BabelMaxRttPenalty  int     `name:"babel-max-rtt-penalty" description:"Default Babel max-rtt-penalty of tunnel interfaces" default:"400"`
+	OLSRHelloInterval   float64 `name:"olsr-hello-interval" description:"Default seconds between OLSR hellos on tunnel interfaces" default:"2.0"`
+	OLSRLinkQualityMult float64 `name:"olsr-link-quality-mult" description:"Default OLSR link quality multiplier of tunnel interfaces. Below 1 makes a tunnel less preferred" default:"1.0"`
+}
+
+type Quotas struct {
+	ResetDay       int   `name:"reset-day" description:"Default day of the month tunnel traffic quotas reset, between 1 and 28" default:"1"`
+	WarnThresholds []int `name:"warn-thresholds" description:"Percentages of a tunnel's traffic quota that raise a warning" default:"80,90"`
+	CheckInterval  int   `name:"check-interval" description:"Seconds between checking tunnel traffic against quotas" default:"60"`
+}
+
+type Traffic struct {
+	MinuteRetention int `name:"minute-retention" description:"Hours to keep per-minute tunnel traffic history" default:"48"`
+	HourRetention   int `name:"hour-retention" description:"Days to keep hourly tunnel traffic history" default:"31"`
+	DayRetention    int `name:"day-retention" description:"Days to keep daily tunnel traffic history" default:"730"`
+}
+
+type Flapping struct {
+	HandshakeTimeout int  `name:"handshake-timeout" description:"Seconds without a handshake before a wireguard tunnel is considered disconnected" default:"180"`
+	Dampening        bool `name:"dampening" description:"Stop reporting tunnels that keep disconnecting as connected until they settle down" default:"false"`
+	Penalty          int  `name:"penalty" description:"Penalty added each time a tunnel disconnects" default:"1000"`
+	SuppressLimit    int  `name:"suppress-limit" description:"Penalty at which a tunnel is suppressed" default:"2000"`
+	ReuseLimit       int  `name:"reuse-limit" description:"Penalty a suppressed tunnel must decay below before it is reported again" default:"750"`
+	HalfLife         int  `name:"half-life" description:"Seconds for a tunnel's penalty to decay by half" default:"900"`
+	MaxSuppressTime  int  `name:"max-suppress-time" description:"Longest a tunnel can stay suppressed in seconds" default:"3600"`
+}
+
+type Secrets struct {
+	Key     string `name:"key" description:"Base64 encoded 32 byte master key used to encrypt tunnel secrets in the database. Secrets are stored in plaintext if neither this nor key-file is set"`
+	KeyFile string `name:"key-file" description:"File containing the base64 encoded master key used to encrypt tunnel secrets in the database"`
 }
 
 type Config struct {
@@ -62,24 +127,44 @@ type Config struct {
 	Gridsquare               string    `name:"gridsquare" description:"Server gridsquare"`
 	Metrics                  Metrics   `name:"metrics" description:"Metrics settings"`
 	Wireguard                Wireguard `name:"wireguard" description:"Wireguard settings"`
+	Tunnels                  Tunnels   `name:"tunnels" description:"Default link tuning of tunnels, which each tunnel may override"`
+	Secrets                  Secrets   `name:"secrets" description:"Database secret encryption settings"`
+	Quotas                   Quotas    `name:"quotas" description:"Tunnel traffic quota settings"`
+	Traffic                  Traffic   `name:"traffic" description:"Tunnel traffic history settings"`
+	Flapping                 Flapping  `name:"flapping" description:"Tunnel flap detection and dampening settings"`
 	SessionSecret            string    `name:"session-secret" description:"Session secret"`
 }
 
 var (
-	ErrInvalidLogLevel                  = errors.New("invalid log level provided")
-	ErrBabelRouterIDRequired            = errors.New("babel router ID is required when Babel is enabled")
-	ErrNodeIPRequired                   = errors.New("node IP is required")
-	ErrNodeIPInvalid                    = errors.New("node IP is invalid")
-	ErrNodeIPNot10_8                    = errors.New("node IP is not in the 10.0.0.0/8 range")
-	ErrPasswordSaltRequired             = errors.New("password salt is required")
-	ErrServerNameRequired               = errors.New("server name is required")
-	ErrWireguardStartingAddressRequired = errors.New("wireguard starting address is required")
-	ErrWireguardStartingAddressInvalid  = errors.New("wireguard starting address is invalid")
-	ErrWireguardStartingPortRequired    = errors.New("wireguard starting port is required")
-	ErrWireguardStartingPortInvalid     = errors.New("wireguard starting port is invalid")
-	ErrMetricsPortRequired              = errors.New("metrics port is required")
-	ErrMetricsPortInvalid               = errors.New("metrics port is invalid")
-	ErrMetricsNodeExporterHostRequired  = errors.New("node exporter host is required")
+	ErrInvalidLogLevel                   = errors.New("invalid log level provided")
+	ErrBabelRouterIDRequired             = errors.New("babel router ID is required when Babel is enabled")
+	ErrNodeIPRequired                    = errors.New("node IP is required")
+	ErrNodeIPInvalid                     = errors.New("node IP is invalid")
+	ErrNodeIPNot10_8                     = errors.New("node IP is not in the 10.0.0.0/8 range")
+	ErrPasswordSaltRequired              = errors.New("password salt is required")
+	ErrServerNameRequired                = errors.New("server name is required")
+	ErrWireguardStartingAddressRequired  = errors.New("wireguard starting address is required")
+	ErrWireguardStartingAddressInvalid   = errors.New("wireguard starting address is invalid")
+	ErrWireguardStartingPortRequired     = errors.New("wireguard starting port is required")
+	ErrWireguardStartingPortInvalid      = errors.New("wireguard starting port is invalid")
+	ErrMetricsPortRequired               = errors.New("metrics port is required")
+	ErrMetricsPortInvalid                = errors.New("metrics port is invalid")
+	ErrMetricsNodeExporterHostRequired   = errors.New("node exporter host is required")
+	ErrWireguardReconcileInvalid         = errors.New("wireguard reconcile interval is invalid")
+	ErrWireguardSharedPortInvalid        = errors.New("wireguard shared port is invalid")
+	ErrWireguardEndpointCheckInvalid     = errors.New("wireguard endpoint check interval is invalid")
+	ErrWireguardHandshakeTimeoutInvalid  = errors.New("wireguard handshake timeout is invalid")
+	ErrWireguardEndpointFamilyInvalid    = errors.New("wireguard endpoint family is invalid")
+	ErrWireguardKeyRotationInvalid       = errors.New("wireguard key rotation interval is invalid")
+	ErrWireguardKeyRotationWindowInvalid = errors.New("wireguard key rotation window is invalid")
+	ErrSecretsKeyConflict                = errors.New("only one of secrets key and secrets key file may be set")
+	ErrWireguardPoolInvalid              = errors.New("wireguard pool is invalid")
+	ErrWireguardBlockPrefixInvalid       = errors.New("wireguard block prefix is invalid")
+	ErrTunnelsInvalid                    = errors.New("tunnel tuning is invalid")
+	ErrWireguardAllowedIPsInvalid        = errors.New("wireguard allowed IPs interval is invalid")
+	ErrQuotasInvalid                     = errors.New("quota settings are invalid")
+	ErrTrafficRetentionInvalid           = errors.New("traffic history retention must be positive")
+	ErrFlappingInvalid                   = errors.New("flap dampening settings are invalid")
 )
 
 func (c Config) Validate() error {
@@ -140,6 +225,74 @@ func (c Config) Validate() error {
 		return ErrWireguardStartingPortInvalid
 	}
 
+	if c.Wireguard.ReconcileInterval < 0 {
+		return ErrWireguardReconcileInvalid
+	}
+
+	if c.Wireguard.SharedInterface && c.Wireguard.SharedPort < 1024 {
+		return ErrWireguardSharedPortInvalid
+	}
+
+	if c.Wireguard.EndpointCheckInterval < 0 {
+		return ErrWireguardEndpointCheckInvalid
+	}
+
+	if c.Wireguard.EndpointCheckInterval > 0 && c.Wireguard.HandshakeTimeout <= 0 {
+		return ErrWireguardHandshakeTimeoutInvalid
+	}
+
+	if c.Wireguard.EndpointFamily != AddressFamilyAny &&
+		c.Wireguard.EndpointFamily != AddressFamilyIPv4 &&
+		c.Wireguard.EndpointFamily != AddressFamilyIPv6 {
+		return ErrWireguardEndpointFamilyInvalid
+	}
+
+	if c.Wireguard.KeyRotationInterval < 0 {
+		return ErrWireguardKeyRotationInvalid
+	}
+
+	if c.Wireguard.KeyRotationWindow <= 0 {
+		return ErrWireguardKeyRotationWindowInvalid
+	}
+
+	if (c.Wireguard.StrictAllowedIPs || c.Wireguard.SharedInterface) && c.Wireguard.AllowedIPsInterval <= 0 {
+		return ErrWireguardAllowedIPsInvalid
+	}
+
+	if c.Wireguard.BlockPrefix < MinBlockPrefix || c.Wireguard.BlockPrefix > MaxBlockPrefix {
+		return ErrWireguardBlockPrefixInvalid
+	}
+
+	for _, pool := range c.Wireguard.Pools {
+		_, _, err := ParseWireguardPool(pool, c.Wireguard.BlockPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.Tunnels.Validate()
+	if err != nil {
+		return err
+	}
+
+	if c.Secrets.Key != "" && c.Secrets.KeyFile != "" {
+		return ErrSecretsKeyConflict
+	}
+
+	err = c.Quotas.Validate()
+	if err != nil {
+		return err
+	}
+
+	if c.Traffic.MinuteRetention <= 0 || c.Traffic.HourRetention <= 0 || c.Traffic.DayRetention <= 0 {
+		return ErrTrafficRetentionInvalid
+	}
+
+	err = c.Flapping.Validate()
+	if err != nil {
+		return err
+	}
+
 	ip = net.ParseIP(c.NodeIP)
 
 	if ip == nil {
@@ -156,3 +309,102 @@ func (c Config) Validate() error {
 
 	return nil
 }
+
+// Bounds of the subnet prefix length allocated to each server tunnel. A /31
+// still leaves an address for each side of the tunnel.
+const (
+	MinBlockPrefix = 24
+	MaxBlockPrefix = 31
+)
+
+// ParseWireguardPool parses a pool in the form <cidr>[:<block prefix>], using
+// defaultBlockPrefix when the pool doesn't set its own
+func ParseWireguardPool(spec string, defaultBlockPrefix int) (netip.Prefix, int, error) {
+	cidr, block, hasBlock := strings.Cut(spec, ":")
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil || !prefix.Addr().Is4() {
+		return netip.Prefix{}, 0, fmt.Errorf("%w: %q is not an IPv4 CIDR", ErrWireguardPoolInvalid, spec)
+	}
+
+	blockPrefix := defaultBlockPrefix
+	if hasBlock {
+		blockPrefix, err = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(block), "/"))
+		if err != nil {
+			return netip.Prefix{}, 0, fmt.Errorf("%w: %q has an invalid block prefix", ErrWireguardPoolInvalid, spec)
+		}
+	}
+	if blockPrefix < MinBlockPrefix || blockPrefix > MaxBlockPrefix || blockPrefix < prefix.Bits() {
+		return netip.Prefix{}, 0, fmt.Errorf("%w: %q has an invalid block prefix", ErrWireguardPoolInvalid, spec)
+	}
+
+	return prefix.Masked(), blockPrefix, nil
+}
+
+// Bounds of the tunnel MTU. Below 1280 the kernel disables IPv6 on the
+// interface, which takes the link-local addresses Babel needs with it.
+const (
+	MinTunnelMTU = 1280
+	MaxTunnelMTU = 9000
+)
+
+// Validate checks that the tuning values make sense for a tunnel
+func (t Tunnels) Validate() error {
+	switch {
+	case t.MTU < MinTunnelMTU || t.MTU > MaxTunnelMTU:
+		return fmt.Errorf("%w: mtu must be between %d and %d", ErrTunnelsInvalid, MinTunnelMTU, MaxTunnelMTU)
+	case t.PersistentKeepalive < 0 || t.PersistentKeepalive > 65535:
+		return fmt.Errorf("%w: persistent keepalive must be between 0 and 65535", ErrTunnelsInvalid)
+	case t.BabelRxcost <= 0:
+		return fmt.Errorf("%w: babel rxcost must be positive", ErrTunnelsInvalid)
+	case t.BabelHelloInterval <= 0:
+		return fmt.Errorf("%w: babel hello interval must be positive", ErrTunnelsInvalid)
+	case t.BabelRttMin < 0 || t.BabelRttMax < t.BabelRttMin:
+		return fmt.Errorf("%w: babel rtt-min must not be negative or above rtt-max", ErrTunnelsInvalid)
+	case t.BabelMaxRttPenalty < 0:
+		return fmt.Errorf("%w: babel max rtt penalty must not be negative", ErrTunnelsInvalid)
+	case t.OLSRHelloInterval <= 0:
+		return fmt.Errorf("%w: olsr hello interval must be positive", ErrTunnelsInvalid)
+	case t.OLSRLinkQualityMult <= 0 || t.OLSRLinkQualityMult > 1:
+		return fmt.Errorf("%w: olsr link quality multiplier must be above 0 and at most 1", ErrTunnelsInvalid)
+	}
+	return nil
+}
+
+// Quota reset days stop at 28 so every month has one
+const (
+	MinQuotaResetDay = 1
+	MaxQuotaResetDay = 28
+)
+
+// Validate checks the quota settings
+func (q Quotas) Validate() error {
+	if q.ResetDay < MinQuotaResetDay || q.ResetDay > MaxQuotaResetDay {
+		return fmt.Errorf("%w: reset day must be between %d and %d", ErrQuotasInvalid, MinQuotaResetDay, MaxQuotaResetDay)
+	}
+	if q.CheckInterval <= 0 {
+		return fmt.Errorf("%w: check interval must be positive", ErrQuotasInvalid)
+	}
+	for _, threshold := range q.WarnThresholds {
+		if threshold <= 0 || threshold >= 100 {
+			return fmt.Errorf("%w: warn thresholds must be between 1 and 99", ErrQuotasInvalid)
+		}
+	}
+	return nil
+}
+
+// Validate checks the flap dampening settings
+func (f Flapping) Validate() error {
+	if f.HandshakeTimeout <= 0 {
+		return fmt.Errorf("%w: handshake timeout must be positive", ErrFlappingInvalid)
+	}
+	if !f.Dampening {
+		return nil
+	}
+	if f.Penalty <= 0 || f.HalfLife <= 0 || f.MaxSuppressTime <= 0 {
+		return fmt.Errorf("%w: penalty, half life and max suppress time must be positive", ErrFlappingInvalid)
+	}
+	if f.ReuseLimit <= 0 || f.ReuseLimit >= f.SuppressLimit {
+		return fmt.Errorf("%w: reuse limit must be positive and below the suppress limit", ErrFlappingInvalid)
+	}
+	return nil
+}
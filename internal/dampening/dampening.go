@@ -0,0 +1,119 @@
+// Package dampening suppresses tunnels that keep flapping, in the style of
+// BGP route dampening. Each flap adds a penalty that decays exponentially.
+// A tunnel whose penalty reaches the suppress limit stays suppressed until
+// the penalty decays below the reuse limit.
+package dampening
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+)
+
+// forgetPenalty is the penalty below which a tunnel's history is dropped
+const forgetPenalty = 1
+
+type state struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+// Status is the dampening state of a tunnel at a point in time
+type Status struct {
+	Penalty    float64 `json:"penalty"`
+	Suppressed bool    `json:"suppressed"`
+}
+
+type Dampener struct {
+	config config.Flapping
+	lock   sync.Mutex
+	states map[uint]*state
+}
+
+func New(config config.Flapping) *Dampener {
+	return &Dampener{
+		config: config,
+		states: make(map[uint]*state),
+	}
+}
+
+// MaxPenalty is the ceiling on a penalty, chosen so that a tunnel at it
+// decays to the reuse limit in the max suppress time
+func (d *Dampener) MaxPenalty() float64 {
+	return float64(d.config.ReuseLimit) * math.Pow(2, float64(d.config.MaxSuppressTime)/float64(d.config.HalfLife))
+}
+
+// decay brings a penalty up to date
+func (d *Dampener) decay(s *state, now time.Time) {
+	elapsed := now.Sub(s.updated)
+	if elapsed > 0 {
+		s.penalty *= math.Pow(0.5, elapsed.Seconds()/float64(d.config.HalfLife))
+	}
+	s.updated = now
+}
+
+// Flap records a tunnel disconnecting and reports whether it has just become suppressed
+func (d *Dampener) Flap(id uint, now time.Time) bool {
+	if !d.config.Dampening {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.states[id]
+	if !ok {
+		s = &state{updated: now}
+		d.states[id] = s
+	}
+	d.decay(s, now)
+	s.penalty = min(s.penalty+float64(d.config.Penalty), d.MaxPenalty())
+	if s.suppressed || s.penalty < float64(d.config.SuppressLimit) {
+		return false
+	}
+	s.suppressed = true
+	return true
+}
+
+// Suppressed reports whether a tunnel is suppressed, and whether it has just
+// been released because its penalty decayed below the reuse limit
+func (d *Dampener) Suppressed(id uint, now time.Time) (suppressed bool, released bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.states[id]
+	if !ok {
+		return false, false
+	}
+	d.decay(s, now)
+	if s.suppressed && s.penalty < float64(d.config.ReuseLimit) {
+		s.suppressed = false
+		released = true
+	}
+	if !s.suppressed && s.penalty < forgetPenalty {
+		delete(d.states, id)
+	}
+	return s.suppressed, released
+}
+
+// Status returns the current penalty of a tunnel and whether it is suppressed
+func (d *Dampener) Status(id uint, now time.Time) Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.states[id]
+	if !ok {
+		return Status{}
+	}
+	d.decay(s, now)
+	return Status{Penalty: s.penalty, Suppressed: s.suppressed}
+}
+
+// Forget drops the history of a tunnel, such as when it is deleted
+func (d *Dampener) Forget(id uint) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.states, id)
+}
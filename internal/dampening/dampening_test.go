@@ -0,0 +1,97 @@
+package dampening_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/dampening"
+)
+
+func testConfig() config.Flapping {
+	return config.Flapping{
+		HandshakeTimeout: 180,
+		Dampening:        true,
+		Penalty:          1000,
+		SuppressLimit:    2000,
+		ReuseLimit:       750,
+		HalfLife:         900,
+		MaxSuppressTime:  3600,
+	}
+}
+
+func TestFlapSuppressesAndReleases(t *testing.T) {
+	t.Parallel()
+
+	d := dampening.New(testConfig())
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+
+	// The first penalty has decayed a little by the second flap
+	if d.Flap(1, start) || d.Flap(1, start.Add(time.Second)) {
+		t.Fatal("two flaps should not suppress")
+	}
+	if !d.Flap(1, start.Add(2*time.Second)) {
+		t.Fatal("third flap in quick succession should suppress")
+	}
+	if d.Flap(1, start.Add(3*time.Second)) {
+		t.Error("a suppressed tunnel should only report crossing the limit once")
+	}
+
+	suppressed, released := d.Suppressed(1, start.Add(10*time.Minute))
+	if !suppressed || released {
+		t.Errorf("Suppressed() = %v, %v after 10 minutes, want true, false", suppressed, released)
+	}
+
+	// 4000 decays below 750 after a little over two and a half half lives
+	suppressed, released = d.Suppressed(1, start.Add(40*time.Minute))
+	if suppressed || !released {
+		t.Errorf("Suppressed() = %v, %v after 40 minutes, want false, true", suppressed, released)
+	}
+}
+
+func TestPenaltyDecays(t *testing.T) {
+	t.Parallel()
+
+	d := dampening.New(testConfig())
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+	d.Flap(1, start)
+
+	status := d.Status(1, start.Add(15*time.Minute))
+	if status.Penalty < 499 || status.Penalty > 501 {
+		t.Errorf("penalty after one half life = %f, want 500", status.Penalty)
+	}
+
+	// Flaps spread out by more than a half life never add up to the suppress limit
+	if d.Flap(1, start.Add(15*time.Minute)) {
+		t.Error("spread out flaps should not suppress")
+	}
+}
+
+func TestPenaltyIsCapped(t *testing.T) {
+	t.Parallel()
+
+	d := dampening.New(testConfig())
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+	for i := range 100 {
+		d.Flap(1, start.Add(time.Duration(i)*time.Second))
+	}
+
+	suppressed, _ := d.Suppressed(1, start.Add(100*time.Second+time.Hour))
+	if suppressed {
+		t.Error("tunnel should be released within the max suppress time")
+	}
+}
+
+func TestDampeningDisabled(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.Dampening = false
+	d := dampening.New(cfg)
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		if d.Flap(1, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatal("flaps should never suppress with dampening disabled")
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/secrets"
 	"github.com/glebarez/sqlite"
 	gorm_seeder "github.com/kachit/gorm-seeder"
 	"gorm.io/driver/postgres"
@@ -16,8 +17,17 @@ import (
 )
 
 func MakeDB(config *config.Config) (*gorm.DB, error) {
+	keyring, err := secrets.LoadKeyring(config.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("could not load secrets master key: %w", err)
+	}
+	if keyring == nil {
+		slog.Warn("No secrets master key configured, tunnel keys are stored in plaintext")
+	}
+	// The serializer has to be in place before gorm parses the models
+	secrets.Register(keyring)
+
 	var db *gorm.DB
-	var err error
 	if os.Getenv("TEST") != "" {
 		slog.Info("Using in-memory database for testing")
 		db, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
@@ -46,11 +56,24 @@ func MakeDB(config *config.Config) (*gorm.DB, error) {
 		slog.Info("Gorm database connection opened")
 	}
 
-	err = db.AutoMigrate(&models.AppSettings{}, &models.User{}, &models.Tunnel{})
+	err = db.AutoMigrate(&models.AppSettings{}, &models.User{}, &models.Tunnel{}, &models.TunnelKeyRotation{}, &models.TunnelUsagePeriod{}, &models.TrafficSample{}, &models.TunnelSession{})
 	if err != nil {
 		return nil, fmt.Errorf("could not migrate database: %w", err)
 	}
 
+	err = models.MigrateWireguardCredentials(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not migrate tunnel credentials: %w", err)
+	}
+
+	encrypted, err := models.EncryptSecrets(db, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt secrets: %w", err)
+	}
+	if encrypted > 0 {
+		slog.Info("Encrypted plaintext secrets in the database", "count", encrypted)
+	}
+
 	// Grab the first (and only) AppSettings record. If that record doesn't exist, create it.
 	var appSettings models.AppSettings
 	result := db.First(&appSettings)
@@ -9,7 +9,9 @@ import (
 type AppSettings struct {
 	ID        uint `gorm:"primaryKey"`
 	HasSeeded bool
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// WireguardSharedKey is the private key of the shared server interface
+	WireguardSharedKey string `gorm:"serializer:secret"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	DeletedAt          gorm.DeletedAt `gorm:"index"`
 }
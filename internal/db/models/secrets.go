@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/secrets"
+	"gorm.io/gorm"
+)
+
+type secretColumn struct {
+	table  string
+	column string
+}
+
+// secretColumns are the columns tagged with the secret serializer
+func secretColumns() []secretColumn {
+	return []secretColumn{
+		{"app_settings", "wireguard_shared_key"},
+		{"tunnels", "password"},
+		{"tunnels", "wireguard_server_key"},
+		{"tunnels", "wireguard_client_privkey"},
+		{"tunnels", "wireguard_preshared_key"},
+		{"tunnels", "pending_wireguard_server_key"},
+		{"tunnels", "pending_wireguard_client_privkey"},
+		{"tunnels", "pending_wireguard_preshared_key"},
+	}
+}
+
+// EncryptSecrets encrypts any secrets still stored in plaintext, such as
+// rows written before a master key was configured
+func EncryptSecrets(db *gorm.DB, keyring *secrets.Keyring) (int, error) {
+	if keyring == nil {
+		return 0, nil
+	}
+	return rewriteSecrets(db, func(value string) (string, error) {
+		if secrets.IsEncrypted(value) {
+			return value, nil
+		}
+		return keyring.Encrypt(value)
+	})
+}
+
+// RekeySecrets moves every secret from one master key to another. A nil
+// from keyring only encrypts plaintext, a nil to keyring decrypts everything.
+func RekeySecrets(db *gorm.DB, from, to *secrets.Keyring) (int, error) {
+	return rewriteSecrets(db, func(value string) (string, error) {
+		return from.Rewrap(value, to)
+	})
+}
+
+// rewriteSecrets passes the raw stored value of every secret through fn in a single
+// transaction. Soft deleted rows are included so no plaintext is left behind.
+func rewriteSecrets(db *gorm.DB, fn func(string) (string, error)) (int, error) {
+	rewritten := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, col := range secretColumns() {
+			var rows []struct {
+				ID    uint
+				Value string
+			}
+			err := tx.Table(col.table).
+				Select("id, "+col.column+" AS value").
+				Where(col.column+" <> ?", "").
+				Scan(&rows).Error
+			if err != nil {
+				return fmt.Errorf("failed to read %s.%s: %w", col.table, col.column, err)
+			}
+
+			for _, row := range rows {
+				value, err := fn(row.Value)
+				if err != nil {
+					return fmt.Errorf("failed to rewrite %s.%s of row %d: %w", col.table, col.column, row.ID, err)
+				}
+				if value == row.Value {
+					continue
+				}
+				err = tx.Table(col.table).Where("id = ?", row.ID).UpdateColumn(col.column, value).Error
+				if err != nil {
+					return fmt.Errorf("failed to update %s.%s of row %d: %w", col.table, col.column, row.ID, err)
+				}
+				rewritten++
+			}
+		}
+		return nil
+	})
+	return rewritten, err
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrafficResolution is the length of the buckets traffic history is kept in
+type TrafficResolution string
+
+const (
+	TrafficMinute TrafficResolution = "minute"
+	TrafficHour   TrafficResolution = "hour"
+	TrafficDay    TrafficResolution = "day"
+)
+
+// TrafficResolutions lists every resolution from finest to coarsest
+//
+//nolint:gochecknoglobals
+var TrafficResolutions = []TrafficResolution{TrafficMinute, TrafficHour, TrafficDay}
+
+// NodeTrafficID is the tunnel ID the node's total traffic is stored under
+const NodeTrafficID = 0
+
+// Duration is the length of a bucket
+func (r TrafficResolution) Duration() time.Duration {
+	switch r {
+	case TrafficMinute:
+		return time.Minute
+	case TrafficHour:
+		return time.Hour
+	case TrafficDay:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// Bucket returns the start of the bucket a UTC time falls in
+func (r TrafficResolution) Bucket(t time.Time) time.Time {
+	return t.UTC().Truncate(r.Duration())
+}
+
+// TrafficSample is the traffic of a tunnel, or of the whole node, over one bucket
+type TrafficSample struct {
+	TunnelID    uint              `json:"-" gorm:"primaryKey;autoIncrement:false"`
+	Resolution  TrafficResolution `json:"-" gorm:"primaryKey"`
+	BucketStart time.Time         `json:"time" gorm:"primaryKey"`
+	RXBytes     uint64            `json:"rx_bytes"`
+	TXBytes     uint64            `json:"tx_bytes"`
+}
+
+// AddTrafficSamples adds the samples to whatever is already stored in their buckets
+func AddTrafficSamples(db *gorm.DB, samples []TrafficSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "tunnel_id"}, {Name: "resolution"}, {Name: "bucket_start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"rx_bytes": gorm.Expr("traffic_samples.rx_bytes + excluded.rx_bytes"),
+			"tx_bytes": gorm.Expr("traffic_samples.tx_bytes + excluded.tx_bytes"),
+		}),
+	}).Create(&samples).Error
+}
+
+// ListTrafficSamples lists the stored buckets of a tunnel starting in [from, to)
+func ListTrafficSamples(db *gorm.DB, tunnelID uint, resolution TrafficResolution, from time.Time, to time.Time) ([]TrafficSample, error) {
+	var samples []TrafficSample
+	err := db.Where("tunnel_id = ?", tunnelID).
+		Where("resolution = ?", resolution).
+		Where("bucket_start >= ?", from.UTC()).
+		Where("bucket_start < ?", to.UTC()).
+		Order("bucket_start asc").
+		Find(&samples).Error
+	return samples, err
+}
+
+// PruneTrafficSamples deletes the buckets of a resolution that started before the given time
+func PruneTrafficSamples(db *gorm.DB, resolution TrafficResolution, before time.Time) (int64, error) {
+	result := db.Where("resolution = ?", resolution).Where("bucket_start < ?", before.UTC()).Delete(&TrafficSample{})
+	return result.RowsAffected, result.Error
+}
@@ -5,32 +5,74 @@ import (
 	"net"
 	"time"
 
-	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"gorm.io/gorm"
 )
 
 type Tunnel struct {
-	ID                 uint           `json:"id" gorm:"primaryKey"`
-	Hostname           string         `json:"hostname" binding:"required"`
-	IP                 string         `json:"ip" binding:"required"`
-	Password           string         `json:"-" binding:"required"`
-	Enabled            bool           `json:"enabled" gorm:"default:true"`
-	Active             bool           `json:"active"`
-	Client             bool           `json:"client"`
-	TunnelInterface    string         `json:"-"`
-	RXBytes            uint64         `json:"rx_bytes"`
-	TXBytes            uint64         `json:"tx_bytes"`
-	TotalRXMB          float64        `json:"total_rx_mb"`
-	TotalTXMB          float64        `json:"total_tx_mb"`
-	RXBytesPerSec      uint64         `json:"rx_bytes_per_sec"`
-	TXBytesPerSec      uint64         `json:"tx_bytes_per_sec"`
-	Wireguard          bool           `json:"wireguard" gorm:"default:false"`
-	WireguardServerKey string         `json:"wireguard_server_key"`
-	WireguardPort      uint16         `json:"wireguard_port"`
-	ConnectionTime     time.Time      `json:"connection_time"`
-	CreatedAt          time.Time      `json:"created_at"`
-	UpdatedAt          time.Time      `json:"-"`
-	DeletedAt          gorm.DeletedAt `json:"-" gorm:"index"`
+	ID                 uint    `json:"id" gorm:"primaryKey"`
+	Hostname           string  `json:"hostname" binding:"required"`
+	IP                 string  `json:"ip" binding:"required"`
+	Password           string  `json:"-" binding:"required" gorm:"serializer:secret"`
+	Enabled            bool    `json:"enabled" gorm:"default:true"`
+	Active             bool    `json:"active"`
+	Client             bool    `json:"client"`
+	TunnelInterface    string  `json:"-"`
+	RXBytes            uint64  `json:"rx_bytes"`
+	TXBytes            uint64  `json:"tx_bytes"`
+	TotalRXMB          float64 `json:"total_rx_mb"`
+	TotalTXMB          float64 `json:"total_tx_mb"`
+	RXBytesPerSec      uint64  `json:"rx_bytes_per_sec"`
+	TXBytesPerSec      uint64  `json:"tx_bytes_per_sec"`
+	Wireguard          bool    `json:"wireguard" gorm:"default:false"`
+	WireguardServerKey string  `json:"-" gorm:"serializer:secret"`
+	WireguardPort      uint16  `json:"wireguard_port"`
+	// WireguardServerKey above is our private key on server tunnels. The rest
+	// of the key material is what the remote end needs, see WireguardCredential.
+	WireguardServerPubkey  string `json:"-"`
+	WireguardClientPrivkey string `json:"-" gorm:"serializer:secret"`
+	WireguardClientPubkey  string `json:"-" gorm:"index"`
+	WireguardPresharedKey  string `json:"-" gorm:"serializer:secret"`
+	SharedInterface        bool   `json:"shared_interface" gorm:"default:false"`
+	// FallbackEndpoints are host:port endpoints a client tunnel fails over to when Hostname stops answering
+	FallbackEndpoints []string `json:"fallback_endpoints" gorm:"serializer:json"`
+	// Tuning overrides the configured MTU, keepalive and routing daemon settings
+	Tuning TunnelTuning `json:"tuning" gorm:"embedded;embeddedPrefix:tuning_"`
+	// RateLimit shapes the bandwidth of the tunnel in each direction
+	RateLimit TunnelRateLimit `json:"rate_limit" gorm:"embedded;embeddedPrefix:rate_limit_"`
+	// Quota caps the traffic of the tunnel each period
+	Quota TunnelQuota `json:"quota" gorm:"embedded;embeddedPrefix:quota_"`
+	// Traffic since PeriodStart, the start of the current quota period
+	PeriodStart time.Time `json:"period_start"`
+	PeriodRXMB  float64   `json:"period_rx_mb"`
+	PeriodTXMB  float64   `json:"period_tx_mb"`
+	// QuotaWarnedPercent is the highest warning threshold crossed this period
+	QuotaWarnedPercent int  `json:"quota_warned_percent"`
+	QuotaExceeded      bool `json:"quota_exceeded"`
+	// FirewallPolicy limits what the peer can reach through this node
+	FirewallPolicy FirewallPolicy `json:"firewall_policy" gorm:"default:allow-all"`
+	// FirewallRules are the destinations the peer may reach under the custom policy
+	FirewallRules []FirewallRule `json:"firewall_rules" gorm:"serializer:json"`
+	// Flaps counts the times the tunnel has disconnected. A tunnel that flaps
+	// too often is suppressed and not reported as connected until it settles.
+	Flaps          int  `json:"flaps"`
+	FlapSuppressed bool `json:"flap_suppressed"`
+	// The ham who owns the remote end. Contact and notes are only shown to admins.
+	Callsign string   `json:"callsign" gorm:"index"`
+	Contact  string   `json:"-"`
+	Notes    string   `json:"-"`
+	Tags     []string `json:"tags" gorm:"serializer:json"`
+	// KeysRotatedAt is when the tunnel keys were last replaced, zero if never
+	KeysRotatedAt time.Time `json:"keys_rotated_at"`
+	// A key rotation in progress. The pending keys only take effect once the
+	// remote operator confirms they have installed them or the deadline passes.
+	PendingWireguardServerKey     string         `json:"-" gorm:"serializer:secret"`
+	PendingWireguardClientPrivkey string         `json:"-" gorm:"serializer:secret"`
+	PendingWireguardPresharedKey  string         `json:"-" gorm:"serializer:secret"`
+	KeyRotationDeadline           *time.Time     `json:"key_rotation_deadline"`
+	ConnectionTime                time.Time      `json:"connection_time"`
+	CreatedAt                     time.Time      `json:"created_at"`
+	UpdatedAt                     time.Time      `json:"-"`
+	DeletedAt                     gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 func TunnelIDExists(db *gorm.DB, id uint) (bool, error) {
@@ -51,6 +93,13 @@ func FindTunnelByInterface(db *gorm.DB, iface string) (Tunnel, error) {
 	return tunnel, err
 }
 
+// FindSharedTunnelByPeerKey finds the shared interface tunnel whose client uses the given public key
+func FindSharedTunnelByPeerKey(db *gorm.DB, pubkey string) (Tunnel, error) {
+	var tunnel Tunnel
+	err := db.Where("shared_interface = ?", true).Where("wireguard_client_pubkey = ?", pubkey).First(&tunnel).Error
+	return tunnel, err
+}
+
 func FindTunnelByIP(db *gorm.DB, ip net.IP) (Tunnel, error) {
 	var tunnel Tunnel
 	err := db.Where("ip = ?", ip.String()).First(&tunnel).Error
@@ -123,9 +172,25 @@ func CountWireguardActiveServerTunnels(db *gorm.DB) (int, error) {
 	return int(count), err
 }
 
+func CountSharedInterfaceTunnels(db *gorm.DB) (int, error) {
+	var count int64
+	err := db.Model(&Tunnel{}).Where("shared_interface = ?", true).Where("enabled = ?", true).Count(&count).Error
+	return int(count), err
+}
+
 func DeleteTunnel(db *gorm.DB, id uint) error {
 	err := db.Transaction(func(tx *gorm.DB) error {
-		tx.Unscoped().Delete(&Tunnel{ID: id})
+		err := tx.Unscoped().Delete(&Tunnel{ID: id}).Error
+		if err != nil {
+			return err
+		}
+		// The tunnel is gone for good, so is its history
+		for _, history := range []any{&TunnelKeyRotation{}, &TunnelUsagePeriod{}, &TrafficSample{}, &TunnelSession{}} {
+			err = tx.Unscoped().Where("tunnel_id = ?", id).Delete(history).Error
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -134,66 +199,56 @@ func DeleteTunnel(db *gorm.DB, id uint) error {
 	return nil
 }
 
+// ListTunnelsDueForKeyRotation lists server tunnels whose keys were last replaced before the given time
+// and have no rotation in progress
+func ListTunnelsDueForKeyRotation(db *gorm.DB, before time.Time) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := db.Where("wireguard = ?", true).
+		Where("wireguard_server_key <> ?", "").
+		Where("key_rotation_deadline IS NULL").
+		Where("keys_rotated_at < ?", before).
+		Where("created_at < ?", before).
+		Order("id asc").Find(&tunnels).Error
+	return tunnels, err
+}
+
+// ListTunnelsWithExpiredKeyRotation lists tunnels whose key rotation deadline has passed
+func ListTunnelsWithExpiredKeyRotation(db *gorm.DB, now time.Time) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := db.Where("key_rotation_deadline IS NOT NULL").Where("key_rotation_deadline <= ?", now).Order("id asc").Find(&tunnels).Error
+	return tunnels, err
+}
+
 func ClearActiveFromAllTunnels(db *gorm.DB) error {
 	return db.Model(&Tunnel{}).Where("active = ?", true).Update("active", false).Error
 }
 
-func GetNextWireguardIP(db *gorm.DB, config *config.Config) (string, error) {
-	// Each tunnel is added with an ip starting from config.WireguardStartingAddress and incrementing by 4 for each tunnel
-	// We need to find the next available ip.
-	var tunnels []Tunnel
-	err := db.Where("wireguard = ?", true).Where("client = ?", false).Find(&tunnels).Error
-	if err != nil {
-		return "", err
-	}
-	// We need to find the next available ip.
-	// We can do this by finding the highest ip, and adding 4 to it.
-	var highestIP = net.ParseIP(config.Wireguard.StartingAddress).To4() // Use 12 so the +4 later starts at 16
-	for _, tunnel := range tunnels {
-		ip := net.ParseIP(tunnel.IP)
-		ip = ip.To4()
-		if ip[2] > highestIP[2] {
-			highestIP = ip
-		} else if ip[2] == highestIP[2] {
-			if ip[3] > highestIP[3] {
-				highestIP = ip
-			}
-		}
-	}
-	// If the highest ip is 252, we need to start at highestIP[2]++ and set highestIP[3] to 0.
-	if highestIP[3] == 252 {
-		highestIP[2]++
-		if highestIP[2] >= 254 {
-			return "", fmt.Errorf("no more IPs available")
-		}
-		highestIP[3] = 0
-	} else {
-		highestIP[3] += 4
-	}
+// ClearFlapSuppression lifts the suppression of every tunnel, since flap penalties are only kept in memory
+func ClearFlapSuppression(db *gorm.DB) error {
+	return db.Model(&Tunnel{}).Where("flap_suppressed = ?", true).Update("flap_suppressed", false).Error
+}
 
-	return highestIP.String(), nil
+// RecordTunnelFlap counts a disconnection of a tunnel
+func RecordTunnelFlap(db *gorm.DB, id uint) error {
+	return db.Model(&Tunnel{}).Where("id = ?", id).Update("flaps", gorm.Expr("flaps + 1")).Error
 }
 
-func GetNextWireguardPort(db *gorm.DB, config *config.Config) (uint16, error) {
-	// Each tunnel is added with a port starting from 51820 and incrementing by 1 for each tunnel
-	// We need to find the next available port.
-	var tunnels []Tunnel
-	err := db.Where("wireguard = ?", true).Find(&tunnels).Error
-	if err != nil {
-		return 0, err
-	}
-	// We need to find the next available port.
-	// We can do this by finding the highest port, and adding 1 to it.
-	highestPort := config.Wireguard.StartingPort - 1
-	for _, tunnel := range tunnels {
-		if tunnel.WireguardPort > highestPort {
-			highestPort = tunnel.WireguardPort
-		}
-	}
-	// If the highest port is 65535, we need to return an error.
-	if highestPort == 65535 {
-		return 0, fmt.Errorf("no more ports available")
-	}
+// SetTunnelFlapSuppressed records whether a tunnel is suppressed for flapping
+func SetTunnelFlapSuppressed(db *gorm.DB, id uint, suppressed bool) error {
+	return db.Model(&Tunnel{}).Where("id = ?", id).Update("flap_suppressed", suppressed).Error
+}
+
+// ListDedicatedWireguardPorts lists the listen ports of wireguard tunnels
+// with their own interface. Tunnels on the shared interface all use its port.
+func ListDedicatedWireguardPorts(db *gorm.DB) ([]uint16, error) {
+	var ports []uint16
+	err := db.Model(&Tunnel{}).Where("wireguard = ?", true).Where("shared_interface = ?", false).Pluck("wireguard_port", &ports).Error
+	return ports, err
+}
 
-	return highestPort + 1, nil
+// ListTunnelIPs lists the base address of every tunnel
+func ListTunnelIPs(db *gorm.DB) ([]string, error) {
+	var ips []string
+	err := db.Model(&Tunnel{}).Where("ip <> ?", "").Pluck("ip", &ips).Error
+	return ips, err
 }
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var ErrTunnelSortInvalid = errors.New("tunnels can't be sorted by that column")
+
+// TunnelFilter narrows down and orders a tunnel listing in the database
+type TunnelFilter struct {
+	// Search matches tunnels whose hostname or callsign contains it, ignoring case
+	Search string
+	// Callsign matches tunnels owned by the callsign, ignoring case
+	Callsign string
+	// Tags matches tunnels with every one of the normalized tags
+	Tags          []string
+	Active        *bool
+	Enabled       *bool
+	Client        *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Sort is the column to order by, either its database or JSON name. Defaults to id.
+	Sort       string
+	Descending bool
+}
+
+//nolint:gochecknoglobals
+var (
+	tunnelSortColumnsOnce sync.Once
+	tunnelSortColumns     map[string]string
+)
+
+// TunnelSortColumn returns the database column a tunnel listing can be sorted
+// by, given its database or JSON name. Secrets and columns hidden from the
+// API can't be sorted by.
+func TunnelSortColumn(name string) (string, bool) {
+	tunnelSortColumnsOnce.Do(func() {
+		tunnelSortColumns = make(map[string]string)
+		sch, err := schema.Parse(&Tunnel{}, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			slog.Error("TunnelSortColumn: Error parsing tunnel schema", "error", err)
+			return
+		}
+		for _, field := range sch.Fields {
+			if field.DBName == "" || field.Serializer != nil {
+				continue
+			}
+			jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if jsonName == "-" {
+				continue
+			}
+			tunnelSortColumns[field.DBName] = field.DBName
+			// Embedded fields share JSON names like mtu, so only their column names are accepted
+			if len(field.BindNames) == 1 && jsonName != "" {
+				tunnelSortColumns[jsonName] = field.DBName
+			}
+		}
+	})
+	column, ok := tunnelSortColumns[name]
+	return column, ok
+}
+
+// Validate checks that the sort column exists and the tags are normalized
+func (f TunnelFilter) Validate() error {
+	for _, tag := range f.Tags {
+		normalized, err := NormalizeTag(tag)
+		if err != nil || normalized != tag {
+			return ErrTagInvalid
+		}
+	}
+	if f.Sort == "" {
+		return nil
+	}
+	if _, ok := TunnelSortColumn(f.Sort); !ok {
+		return ErrTunnelSortInvalid
+	}
+	return nil
+}
+
+// where applies the conditions of the filter, without ordering
+func (f TunnelFilter) where(db *gorm.DB) *gorm.DB {
+	if f.Search != "" {
+		pattern := "%" + escapeLike(strings.ToLower(f.Search)) + "%"
+		db = db.Where(`LOWER(hostname) LIKE ? ESCAPE '\' OR LOWER(callsign) LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+	if f.Callsign != "" {
+		db = db.Where("callsign = ?", strings.ToUpper(f.Callsign))
+	}
+	for _, tag := range f.Tags {
+		db = db.Scopes(TaggedWith(tag))
+	}
+	if f.Active != nil {
+		db = db.Where("active = ?", *f.Active)
+	}
+	if f.Enabled != nil {
+		db = db.Where("enabled = ?", *f.Enabled)
+	}
+	if f.Client != nil {
+		db = db.Where("client = ?", *f.Client)
+	}
+	if f.CreatedAfter != nil {
+		db = db.Where("created_at >= ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		db = db.Where("created_at < ?", *f.CreatedBefore)
+	}
+	return db
+}
+
+// order sorts by the filter's column, falling back to the ID so pages are stable
+func (f TunnelFilter) order(db *gorm.DB) *gorm.DB {
+	column, ok := TunnelSortColumn(f.Sort)
+	if ok && column != "id" {
+		db = db.Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: f.Descending})
+		return db.Order("id asc")
+	}
+	return db.Order(clause.OrderByColumn{Column: clause.Column{Name: "id"}, Desc: f.Descending})
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// ListFilteredWireguardTunnels lists the wireguard tunnels matching the filter, in its order
+func ListFilteredWireguardTunnels(db *gorm.DB, filter TunnelFilter) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := filter.order(filter.where(db.Where("wireguard = ?", true))).Find(&tunnels).Error
+	return tunnels, err
+}
+
+// CountFilteredWireguardTunnels counts the wireguard tunnels matching the filter
+func CountFilteredWireguardTunnels(db *gorm.DB, filter TunnelFilter) (int, error) {
+	var count int64
+	err := filter.where(db.Model(&Tunnel{}).Where("wireguard = ?", true)).Count(&count).Error
+	return int(count), err
+}
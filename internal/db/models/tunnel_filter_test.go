@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestTunnelSortColumn(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		column string
+		ok     bool
+	}{
+		{"hostname", "hostname", true},
+		{"total_rx_mb", "total_rxmb", true},
+		{"total_rxmb", "total_rxmb", true},
+		{"rx_bytes_per_sec", "rx_bytes_per_sec", true},
+		{"connection_time", "connection_time", true},
+		{"tuning_mtu", "tuning_mtu", true},
+		{"callsign", "callsign", true},
+		{"mtu", "", false},
+		{"contact", "", false},
+		{"notes", "", false},
+		{"tags", "", false},
+		{"password", "", false},
+		{"wireguard_server_key", "", false},
+		{"tunnel_interface", "", false},
+		{"hostname; DROP TABLE tunnels", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			column, ok := models.TunnelSortColumn(tt.name)
+			if ok != tt.ok || column != tt.column {
+				t.Errorf("TunnelSortColumn(%q) = %q, %v; want %q, %v", tt.name, column, ok, tt.column, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// FirewallPolicy limits what a tunnel's peer can reach through this node
+type FirewallPolicy string
+
+const (
+	// FirewallAllowAll forwards everything the peer sends
+	FirewallAllowAll FirewallPolicy = "allow-all"
+	// FirewallMeshOnly only forwards traffic bound for the mesh, 10.0.0.0/8 and 44.0.0.0/8
+	FirewallMeshOnly FirewallPolicy = "mesh-only"
+	// FirewallBlockInternet only forwards traffic bound for the mesh and private ranges
+	FirewallBlockInternet FirewallPolicy = "block-internet"
+	// FirewallCustom only forwards traffic matching the tunnel's firewall rules
+	FirewallCustom FirewallPolicy = "custom"
+)
+
+const (
+	FirewallProtocolTCP = "tcp"
+	FirewallProtocolUDP = "udp"
+)
+
+var (
+	ErrFirewallPolicyInvalid   = errors.New("firewall policy must be one of allow-all, mesh-only, block-internet or custom")
+	ErrFirewallRulesNotAllowed = errors.New("firewall rules are only used by the custom policy")
+	ErrFirewallRuleInvalid     = errors.New("firewall rule is invalid")
+)
+
+// FirewallRule allows traffic from the peer to a destination. An empty CIDR
+// matches any destination and no ports match every port of the protocol.
+type FirewallRule struct {
+	CIDR     string   `json:"cidr"`
+	Protocol string   `json:"protocol"`
+	Ports    []uint16 `json:"ports"`
+}
+
+// Effective returns the policy in force, tunnels from before policies existed allow everything
+func (p FirewallPolicy) Effective() FirewallPolicy {
+	if p == "" {
+		return FirewallAllowAll
+	}
+	return p
+}
+
+// ValidateFirewall checks a policy along with the rules it is given
+func ValidateFirewall(policy FirewallPolicy, rules []FirewallRule) error {
+	if !slices.Contains([]FirewallPolicy{FirewallAllowAll, FirewallMeshOnly, FirewallBlockInternet, FirewallCustom}, policy.Effective()) {
+		return ErrFirewallPolicyInvalid
+	}
+	if policy != FirewallCustom && len(rules) > 0 {
+		return ErrFirewallRulesNotAllowed
+	}
+	for i, rule := range rules {
+		err := rule.Validate()
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r FirewallRule) Validate() error {
+	if r.CIDR != "" {
+		_, err := netip.ParsePrefix(r.CIDR)
+		if err != nil {
+			return fmt.Errorf("%w: cidr %q is not a valid prefix", ErrFirewallRuleInvalid, r.CIDR)
+		}
+	}
+	switch r.Protocol {
+	case "", FirewallProtocolTCP, FirewallProtocolUDP:
+	default:
+		return fmt.Errorf("%w: protocol must be tcp, udp or empty", ErrFirewallRuleInvalid)
+	}
+	if len(r.Ports) > 0 && r.Protocol == "" {
+		return fmt.Errorf("%w: ports need a protocol", ErrFirewallRuleInvalid)
+	}
+	if slices.Contains(r.Ports, 0) {
+		return fmt.Errorf("%w: port 0 is not valid", ErrFirewallRuleInvalid)
+	}
+	if r.CIDR == "" && r.Protocol == "" {
+		return fmt.Errorf("%w: rule must match a cidr or a protocol", ErrFirewallRuleInvalid)
+	}
+	return nil
+}
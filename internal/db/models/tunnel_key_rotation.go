@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type KeyRotationOutcome string
+
+const (
+	KeyRotationPending   KeyRotationOutcome = "pending"
+	KeyRotationConfirmed KeyRotationOutcome = "confirmed"
+	KeyRotationExpired   KeyRotationOutcome = "deadline"
+	KeyRotationCancelled KeyRotationOutcome = "cancelled"
+)
+
+// TunnelKeyRotation is one entry in the key rotation history of a tunnel
+type TunnelKeyRotation struct {
+	ID              uint               `json:"id" gorm:"primaryKey"`
+	TunnelID        uint               `json:"tunnel_id" gorm:"index"`
+	OldServerPubkey string             `json:"old_server_pubkey"`
+	NewServerPubkey string             `json:"new_server_pubkey"`
+	Deadline        time.Time          `json:"deadline"`
+	Outcome         KeyRotationOutcome `json:"outcome"`
+	CompletedAt     *time.Time         `json:"completed_at"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"-"`
+	DeletedAt       gorm.DeletedAt     `json:"-" gorm:"index"`
+}
+
+func ListTunnelKeyRotations(db *gorm.DB, tunnelID uint) ([]TunnelKeyRotation, error) {
+	var rotations []TunnelKeyRotation
+	err := db.Where("tunnel_id = ?", tunnelID).Order("id desc").Find(&rotations).Error
+	return rotations, err
+}
+
+func FindPendingTunnelKeyRotation(db *gorm.DB, tunnelID uint) (TunnelKeyRotation, error) {
+	var rotation TunnelKeyRotation
+	err := db.Where("tunnel_id = ?", tunnelID).Where("outcome = ?", KeyRotationPending).Order("id desc").First(&rotation).Error
+	return rotation, err
+}
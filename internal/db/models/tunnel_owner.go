@@ -0,0 +1,132 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	MaxTunnelNotesLength = 4096
+	MaxTunnelTags        = 32
+	maxTagLength         = 32
+)
+
+var (
+	ErrCallsignInvalid = errors.New("callsign is not a valid amateur radio callsign")
+	ErrContactInvalid  = errors.New("contact must be an email address")
+	ErrNotesTooLong    = fmt.Errorf("notes must be at most %d characters", MaxTunnelNotesLength)
+	ErrTagInvalid      = fmt.Errorf("tags must be 1 to %d lowercase letters, digits, '.', '_', ':' or '-'", maxTagLength)
+	ErrTooManyTags     = fmt.Errorf("a tunnel can have at most %d tags", MaxTunnelTags)
+)
+
+// An ITU callsign is a prefix of up to three characters, a digit and a suffix
+// ending in a letter, such as K1A, KI5VMF or 2E0ABC. Portable operation adds a
+// prefix or suffix designator, as in VE3/W1AW or W1AW/4.
+//
+//nolint:gochecknoglobals
+var (
+	callsignRegex = regexp.MustCompile(`^(?:[A-Z0-9]{1,4}/)?[A-Z0-9]{1,3}[0-9][A-Z0-9]{0,3}[A-Z](?:/[A-Z0-9]{1,4})?$`)
+	tagRegex      = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]*$`)
+)
+
+// NormalizeCallsign uppercases a callsign and checks it is a valid amateur radio callsign. Empty is allowed.
+func NormalizeCallsign(callsign string) (string, error) {
+	callsign = strings.ToUpper(strings.TrimSpace(callsign))
+	if callsign != "" && !callsignRegex.MatchString(callsign) {
+		return "", ErrCallsignInvalid
+	}
+	return callsign, nil
+}
+
+// NormalizeContact checks the contact is an email address, dropping any display name. Empty is allowed.
+func NormalizeContact(contact string) (string, error) {
+	contact = strings.TrimSpace(contact)
+	if contact == "" {
+		return "", nil
+	}
+	address, err := mail.ParseAddress(contact)
+	if err != nil {
+		return "", ErrContactInvalid
+	}
+	return address.Address, nil
+}
+
+// ValidateNotes checks the notes fit in the tunnel
+func ValidateNotes(notes string) error {
+	if len(notes) > MaxTunnelNotesLength {
+		return ErrNotesTooLong
+	}
+	return nil
+}
+
+// NormalizeTag lowercases a tag and checks its characters
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if len(tag) > maxTagLength || !tagRegex.MatchString(tag) {
+		return "", ErrTagInvalid
+	}
+	return tag, nil
+}
+
+// NormalizeTags normalizes every tag and drops duplicates, keeping their order
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxTunnelTags {
+		return nil, ErrTooManyTags
+	}
+	return normalized, nil
+}
+
+// SetOwner validates and stores the tunnel's ownership details
+func (t *Tunnel) SetOwner(callsign, contact, notes string, tags []string) error {
+	callsign, err := NormalizeCallsign(callsign)
+	if err != nil {
+		return err
+	}
+	contact, err = NormalizeContact(contact)
+	if err != nil {
+		return err
+	}
+	err = ValidateNotes(notes)
+	if err != nil {
+		return err
+	}
+	tags, err = NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	t.Callsign = callsign
+	t.Contact = contact
+	t.Notes = notes
+	t.Tags = tags
+	return nil
+}
+
+// HasTag reports whether the tunnel is tagged with the normalized tag
+func (t Tunnel) HasTag(tag string) bool {
+	return slices.Contains(t.Tags, tag)
+}
+
+// TaggedWith limits a query to tunnels with the normalized tag. Tags are
+// stored as a JSON array and can't contain quotes, so the quoted tag only
+// matches whole tags.
+func TaggedWith(tag string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(`tags LIKE ? ESCAPE '\'`, `%"`+escapeLike(tag)+`"%`)
+	}
+}
@@ -0,0 +1,88 @@
+package models_test
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestNormalizeCallsign(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		callsign string
+		want     string
+		ok       bool
+	}{
+		{"", "", true},
+		{"ki5vmf", "KI5VMF", true},
+		{" W1AW ", "W1AW", true},
+		{"K1A", "K1A", true},
+		{"2E0ABC", "2E0ABC", true},
+		{"VE3/W1AW", "VE3/W1AW", true},
+		{"W1AW/4", "W1AW/4", true},
+		{"KI5VMF-1", "", false},
+		{"W1", "", false},
+		{"KIVMF", "", false},
+		{"W1AW5", "", false},
+		{"W1ABCDE", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.callsign, func(t *testing.T) {
+			t.Parallel()
+			got, err := models.NormalizeCallsign(tt.callsign)
+			if tt.ok && (err != nil || got != tt.want) {
+				t.Errorf("NormalizeCallsign(%q) = %q, %v; want %q", tt.callsign, got, err, tt.want)
+			} else if !tt.ok && !errors.Is(err, models.ErrCallsignInvalid) {
+				t.Errorf("NormalizeCallsign(%q) = %q, %v; want %v", tt.callsign, got, err, models.ErrCallsignInvalid)
+			}
+		})
+	}
+}
+
+func TestNormalizeContact(t *testing.T) {
+	t.Parallel()
+
+	got, err := models.NormalizeContact("Jacob <ki5vmf@example.com>")
+	if err != nil || got != "ki5vmf@example.com" {
+		t.Errorf("NormalizeContact with a name = %q, %v", got, err)
+	}
+	_, err = models.NormalizeContact("555-0100")
+	if !errors.Is(err, models.ErrContactInvalid) {
+		t.Errorf("NormalizeContact with a phone number = %v, want %v", err, models.ErrContactInvalid)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	t.Parallel()
+
+	got, err := models.NormalizeTags([]string{"Club", "backbone", "club ", "site:hilltop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"club", "backbone", "site:hilltop"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeTags = %v, want %v", got, want)
+	}
+
+	for _, tag := range []string{"", "two words", `quo"te`, "-leading", "%", strings.Repeat("a", 33)} {
+		_, err := models.NormalizeTags([]string{tag})
+		if !errors.Is(err, models.ErrTagInvalid) {
+			t.Errorf("NormalizeTags(%q) = %v, want %v", tag, err, models.ErrTagInvalid)
+		}
+	}
+
+	tooMany := make([]string, models.MaxTunnelTags+1)
+	for i := range tooMany {
+		tooMany[i] = "tag" + strconv.Itoa(i)
+	}
+	_, err = models.NormalizeTags(tooMany)
+	if !errors.Is(err, models.ErrTooManyTags) {
+		t.Errorf("NormalizeTags with %d tags = %v, want %v", len(tooMany), err, models.ErrTooManyTags)
+	}
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"gorm.io/gorm"
+)
+
+// QuotaAction is what happens to a tunnel once it uses up its quota
+type QuotaAction string
+
+const (
+	// QuotaActionWarn only raises an event
+	QuotaActionWarn QuotaAction = "warn"
+	// QuotaActionThrottle caps the tunnel to the quota's throttle rate until the period resets
+	QuotaActionThrottle QuotaAction = "throttle"
+	// QuotaActionDisable disables the tunnel until the period resets
+	QuotaActionDisable QuotaAction = "disable"
+)
+
+var ErrQuotaInvalid = errors.New("quota is invalid")
+
+// TunnelQuota caps the traffic a tunnel may use each period, counting both
+// directions. A zero limit is no quota.
+type TunnelQuota struct {
+	LimitMB float64 `json:"limit_mb"`
+	// ResetDay is the day of the month the period starts, zero uses the config default
+	ResetDay     int         `json:"reset_day"`
+	Action       QuotaAction `json:"action"`
+	ThrottleKbps uint32      `json:"throttle_kbps"`
+}
+
+// Validate checks the quota settings
+func (q TunnelQuota) Validate() error {
+	if q.LimitMB < 0 {
+		return fmt.Errorf("%w: limit must not be negative", ErrQuotaInvalid)
+	}
+	if q.ResetDay != 0 && (q.ResetDay < config.MinQuotaResetDay || q.ResetDay > config.MaxQuotaResetDay) {
+		return fmt.Errorf("%w: reset day must be between %d and %d", ErrQuotaInvalid, config.MinQuotaResetDay, config.MaxQuotaResetDay)
+	}
+	switch q.Action {
+	case "", QuotaActionWarn, QuotaActionDisable:
+	case QuotaActionThrottle:
+		if q.ThrottleKbps == 0 {
+			return fmt.Errorf("%w: throttling needs a throttle rate", ErrQuotaInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: action must be one of warn, throttle or disable", ErrQuotaInvalid)
+	}
+	return nil
+}
+
+// ResolveResetDay returns the reset day, falling back to the configured default
+func (q TunnelQuota) ResolveResetDay(defaults config.Quotas) int {
+	if q.ResetDay == 0 {
+		return defaults.ResetDay
+	}
+	return q.ResetDay
+}
+
+// PeriodUsedMB is the traffic in both directions in the current quota period
+func (t Tunnel) PeriodUsedMB() float64 {
+	return t.PeriodRXMB + t.PeriodTXMB
+}
+
+// EffectiveRateLimit is the rate limit in force, which is tightened to the
+// quota's throttle rate while a throttled quota is exceeded
+func (t Tunnel) EffectiveRateLimit() TunnelRateLimit {
+	limit := t.RateLimit
+	if !t.QuotaExceeded || t.Quota.Action != QuotaActionThrottle {
+		return limit
+	}
+	throttle := func(rate uint32) uint32 {
+		if rate == 0 || rate > t.Quota.ThrottleKbps {
+			return t.Quota.ThrottleKbps
+		}
+		return rate
+	}
+	limit.IngressKbps = throttle(limit.IngressKbps)
+	limit.EgressKbps = throttle(limit.EgressKbps)
+	return limit
+}
+
+// TunnelUsagePeriod is the traffic a tunnel used over a past quota period
+type TunnelUsagePeriod struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TunnelID    uint      `json:"tunnel_id" gorm:"index"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	RXMB        float64   `json:"rx_mb"`
+	TXMB        float64   `json:"tx_mb"`
+	// LimitMB is the quota during the period, zero if there was none
+	LimitMB   float64   `json:"limit_mb"`
+	Exceeded  bool      `json:"exceeded"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListTunnelUsagePeriods lists the past quota periods of a tunnel, newest first
+func ListTunnelUsagePeriods(db *gorm.DB, tunnelID uint) ([]TunnelUsagePeriod, error) {
+	var periods []TunnelUsagePeriod
+	err := db.Where("tunnel_id = ?", tunnelID).Order("period_start desc").Find(&periods).Error
+	return periods, err
+}
+
+// StartQuotaPeriod archives the tunnel's current period, if it had one, and
+// starts a new one with the counters and quota state cleared
+func StartQuotaPeriod(db *gorm.DB, tunnel *Tunnel, start time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if !tunnel.PeriodStart.IsZero() {
+			err := tx.Create(&TunnelUsagePeriod{
+				TunnelID:    tunnel.ID,
+				PeriodStart: tunnel.PeriodStart,
+				PeriodEnd:   start,
+				RXMB:        tunnel.PeriodRXMB,
+				TXMB:        tunnel.PeriodTXMB,
+				LimitMB:     tunnel.Quota.LimitMB,
+				Exceeded:    tunnel.QuotaExceeded,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		tunnel.PeriodStart = start
+		tunnel.PeriodRXMB = 0
+		tunnel.PeriodTXMB = 0
+		tunnel.QuotaWarnedPercent = 0
+		tunnel.QuotaExceeded = false
+		return tx.Model(tunnel).
+			Select("period_start", "period_rxmb", "period_txmb", "quota_warned_percent", "quota_exceeded").
+			Updates(tunnel).Error
+	})
+}
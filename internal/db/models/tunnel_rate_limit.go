@@ -0,0 +1,13 @@
+package models
+
+// TunnelRateLimit caps the bandwidth of a tunnel in kbit/s. Ingress is what
+// the peer sends us and egress is what we send the peer. Zero is unlimited.
+type TunnelRateLimit struct {
+	IngressKbps uint32 `json:"ingress_kbps"`
+	EgressKbps  uint32 `json:"egress_kbps"`
+}
+
+// Limited reports whether either direction is capped
+func (r TunnelRateLimit) Limited() bool {
+	return r.IngressKbps > 0 || r.EgressKbps > 0
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DisconnectReason is why a tunnel session ended
+type DisconnectReason string
+
+const (
+	// DisconnectHandshakeTimeout is a peer that stopped completing handshakes
+	DisconnectHandshakeTimeout DisconnectReason = "handshake-timeout"
+	// DisconnectInterfaceDown is the tunnel interface going away, such as when the tunnel is disabled or deleted
+	DisconnectInterfaceDown DisconnectReason = "interface-down"
+	// DisconnectShutdown is the server stopping
+	DisconnectShutdown DisconnectReason = "shutdown"
+	// DisconnectUnknown is a session left open by a server that didn't stop cleanly
+	DisconnectUnknown DisconnectReason = "unknown"
+)
+
+// TunnelSession is one connection of a tunnel, from its first handshake until it dropped
+type TunnelSession struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	TunnelID  uint       `json:"tunnel_id" gorm:"index"`
+	StartedAt time.Time  `json:"started_at" gorm:"index"`
+	EndedAt   *time.Time `json:"ended_at" gorm:"index"`
+	// Endpoint is the address the peer connected from, empty if it isn't known
+	Endpoint         string           `json:"endpoint"`
+	RXBytes          uint64           `json:"rx_bytes"`
+	TXBytes          uint64           `json:"tx_bytes"`
+	DisconnectReason DisconnectReason `json:"disconnect_reason"`
+}
+
+// StartTunnelSession opens a session for a tunnel that just connected
+func StartTunnelSession(db *gorm.DB, tunnelID uint, endpoint string, start time.Time) error {
+	return db.Create(&TunnelSession{
+		TunnelID:  tunnelID,
+		StartedAt: start,
+		Endpoint:  endpoint,
+	}).Error
+}
+
+// EndTunnelSession closes the open session of a tunnel
+func EndTunnelSession(db *gorm.DB, tunnelID uint, end time.Time, rxBytes uint64, txBytes uint64, reason DisconnectReason) error {
+	return db.Model(&TunnelSession{}).
+		Where("tunnel_id = ?", tunnelID).
+		Where("ended_at IS NULL").
+		Updates(map[string]interface{}{
+			"ended_at":          end,
+			"rx_bytes":          rxBytes,
+			"tx_bytes":          txBytes,
+			"disconnect_reason": reason,
+		}).Error
+}
+
+// EndAllTunnelSessions closes every open session with the traffic its tunnel saw
+func EndAllTunnelSessions(db *gorm.DB, end time.Time, reason DisconnectReason) error {
+	var sessions []TunnelSession
+	err := db.Where("ended_at IS NULL").Find(&sessions).Error
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		var tunnel Tunnel
+		err = db.Unscoped().Where("id = ?", session.TunnelID).Limit(1).Find(&tunnel).Error
+		if err != nil {
+			return err
+		}
+
+		sessionEnd := end
+		if reason == DisconnectUnknown {
+			// The tunnel's traffic is written every few seconds while it is
+			// connected, so its last update is close to when it went away
+			sessionEnd = tunnel.UpdatedAt
+			if sessionEnd.Before(session.StartedAt) || sessionEnd.After(end) {
+				sessionEnd = session.StartedAt
+			}
+		}
+		err = EndTunnelSession(db, session.TunnelID, sessionEnd, tunnel.RXBytes, tunnel.TXBytes, reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTunnelSessions lists the sessions of a tunnel, newest first
+func ListTunnelSessions(db *gorm.DB, tunnelID uint) ([]TunnelSession, error) {
+	var sessions []TunnelSession
+	err := db.Where("tunnel_id = ?", tunnelID).Order("started_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+func CountTunnelSessions(db *gorm.DB, tunnelID uint) (int, error) {
+	var count int64
+	err := db.Model(&TunnelSession{}).Where("tunnel_id = ?", tunnelID).Count(&count).Error
+	return int(count), err
+}
+
+// ListTunnelSessionsBetween lists the sessions of a tunnel that were up at any point between from and to
+func ListTunnelSessionsBetween(db *gorm.DB, tunnelID uint, from time.Time, to time.Time) ([]TunnelSession, error) {
+	var sessions []TunnelSession
+	err := db.Where("tunnel_id = ?", tunnelID).
+		Where("started_at < ?", to).
+		Where("ended_at IS NULL OR ended_at > ?", from).
+		Order("started_at asc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// SessionUptime returns the percentage of the time between from and to that
+// any of the sessions was up. Open sessions count as up until to.
+func SessionUptime(sessions []TunnelSession, from time.Time, to time.Time) float64 {
+	window := to.Sub(from)
+	if window <= 0 {
+		return 0
+	}
+
+	type span struct{ start, end time.Time }
+	spans := make([]span, 0, len(sessions))
+	for _, session := range sessions {
+		end := to
+		if session.EndedAt != nil && session.EndedAt.Before(to) {
+			end = *session.EndedAt
+		}
+		start := session.StartedAt
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			spans = append(spans, span{start, end})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start.Before(spans[j].start)
+	})
+
+	// Merge overlapping sessions so time isn't counted twice
+	var up time.Duration
+	var current *span
+	for i := range spans {
+		if current != nil && !spans[i].start.After(current.end) {
+			if spans[i].end.After(current.end) {
+				current.end = spans[i].end
+			}
+			continue
+		}
+		if current != nil {
+			up += current.end.Sub(current.start)
+		}
+		current = &spans[i]
+	}
+	if current != nil {
+		up += current.end.Sub(current.start)
+	}
+
+	return float64(up) / float64(window) * 100
+}
@@ -0,0 +1,46 @@
+package models_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestSessionUptime(t *testing.T) {
+	t.Parallel()
+
+	from := time.Date(2025, 3, 20, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(hours float64) time.Time {
+		return from.Add(time.Duration(hours * float64(time.Hour)))
+	}
+	ended := func(hours float64) *time.Time {
+		end := at(hours)
+		return &end
+	}
+
+	tests := []struct {
+		name     string
+		sessions []models.TunnelSession
+		want     float64
+	}{
+		{"no sessions", nil, 0},
+		{"up the whole time", []models.TunnelSession{{StartedAt: at(-5)}}, 100},
+		{"one closed session", []models.TunnelSession{{StartedAt: at(1), EndedAt: ended(3)}}, 20},
+		{"clipped to the window", []models.TunnelSession{{StartedAt: at(-2), EndedAt: ended(1)}, {StartedAt: at(9)}}, 20},
+		{"overlapping sessions", []models.TunnelSession{{StartedAt: at(1), EndedAt: ended(4)}, {StartedAt: at(3), EndedAt: ended(5)}}, 40},
+		{"outside the window", []models.TunnelSession{{StartedAt: at(-3), EndedAt: ended(-1)}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := models.SessionUptime(tt.sessions, from, to)
+			if math.Abs(got-tt.want) > 0.001 {
+				t.Errorf("SessionUptime() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+)
+
+var ErrTuningSharedMTU = errors.New("the MTU of a shared interface tunnel can't be tuned, the interface uses the default MTU")
+
+// TunnelTuning overrides the configured link tuning for a single tunnel,
+// such as one riding over LTE or PPPoE. Nil fields use the config default.
+type TunnelTuning struct {
+	MTU                 *int     `json:"mtu"`
+	PersistentKeepalive *int     `json:"persistent_keepalive"`
+	BabelRxcost         *int     `json:"babel_rxcost"`
+	BabelHelloInterval  *int     `json:"babel_hello_interval"`
+	BabelRttMin         *int     `json:"babel_rtt_min"`
+	BabelRttMax         *int     `json:"babel_rtt_max"`
+	BabelMaxRttPenalty  *int     `json:"babel_max_rtt_penalty"`
+	OLSRHelloInterval   *float64 `json:"olsr_hello_interval"`
+	OLSRLinkQualityMult *float64 `json:"olsr_link_quality_mult"`
+}
+
+// Resolve fills in the config defaults for any value the tunnel doesn't override
+func (t TunnelTuning) Resolve(defaults config.Tunnels) config.Tunnels {
+	resolved := defaults
+	override(&resolved.MTU, t.MTU)
+	override(&resolved.PersistentKeepalive, t.PersistentKeepalive)
+	override(&resolved.BabelRxcost, t.BabelRxcost)
+	override(&resolved.BabelHelloInterval, t.BabelHelloInterval)
+	override(&resolved.BabelRttMin, t.BabelRttMin)
+	override(&resolved.BabelRttMax, t.BabelRttMax)
+	override(&resolved.BabelMaxRttPenalty, t.BabelMaxRttPenalty)
+	override(&resolved.OLSRHelloInterval, t.OLSRHelloInterval)
+	override(&resolved.OLSRLinkQualityMult, t.OLSRLinkQualityMult)
+	return resolved
+}
+
+// Validate checks the tuning once resolved against the defaults
+func (t TunnelTuning) Validate(defaults config.Tunnels) error {
+	return t.Resolve(defaults).Validate()
+}
+
+// ValidateShared checks the tuning of a tunnel on the shared interface, which
+// carries all its tunnels at the one MTU
+func (t TunnelTuning) ValidateShared() error {
+	if t.MTU != nil {
+		return ErrTuningSharedMTU
+	}
+	return nil
+}
+
+func override[T any](dst *T, value *T) {
+	if value != nil {
+		*dst = *value
+	}
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// Lengths of the combined credential AREDN expects: the server public key,
+// client private key and client public key, optionally followed by a preshared key
+const (
+	wireguardKeyLength               = 44
+	WireguardCredentialLength        = 3 * wireguardKeyLength
+	WireguardCredentialWithPSKLength = 4 * wireguardKeyLength
+)
+
+var (
+	ErrCredentialLength         = errors.New("credential has the wrong length")
+	ErrCredentialKey            = errors.New("credential contains an invalid key")
+	ErrCredentialKeyMismatch    = errors.New("client public key does not match the client private key")
+	ErrCredentialServerMismatch = errors.New("server public key does not match the server private key")
+)
+
+// WireguardCredential is the key material the remote end of a tunnel needs
+type WireguardCredential struct {
+	ServerPubkey  string
+	ClientPrivkey string
+	ClientPubkey  string
+	PresharedKey  string
+}
+
+// NewWireguardCredential builds a credential for a server tunnel from its keys
+func NewWireguardCredential(serverKey, clientKey wgtypes.Key, presharedKey *wgtypes.Key) WireguardCredential {
+	cred := WireguardCredential{
+		ServerPubkey:  serverKey.PublicKey().String(),
+		ClientPrivkey: clientKey.String(),
+		ClientPubkey:  clientKey.PublicKey().String(),
+	}
+	if presharedKey != nil {
+		cred.PresharedKey = presharedKey.String()
+	}
+	return cred
+}
+
+// ParseWireguardCredential splits and validates a combined credential string
+func ParseWireguardCredential(s string) (WireguardCredential, error) {
+	if len(s) != WireguardCredentialLength && len(s) != WireguardCredentialWithPSKLength {
+		return WireguardCredential{}, ErrCredentialLength
+	}
+	cred := WireguardCredential{
+		ServerPubkey:  s[:wireguardKeyLength],
+		ClientPrivkey: s[wireguardKeyLength : 2*wireguardKeyLength],
+		ClientPubkey:  s[2*wireguardKeyLength : 3*wireguardKeyLength],
+	}
+	if len(s) == WireguardCredentialWithPSKLength {
+		cred.PresharedKey = s[3*wireguardKeyLength:]
+	}
+	return cred, cred.Validate()
+}
+
+// Validate checks that every key parses and the client key pair belongs together
+func (c WireguardCredential) Validate() error {
+	keys := []string{c.ServerPubkey, c.ClientPrivkey, c.ClientPubkey}
+	if c.PresharedKey != "" {
+		keys = append(keys, c.PresharedKey)
+	}
+	for _, key := range keys {
+		_, err := wgtypes.ParseKey(key)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCredentialKey, err)
+		}
+	}
+	clientKey, _ := wgtypes.ParseKey(c.ClientPrivkey)
+	if clientKey.PublicKey().String() != c.ClientPubkey {
+		return ErrCredentialKeyMismatch
+	}
+	return nil
+}
+
+// String returns the combined credential string
+func (c WireguardCredential) String() string {
+	if c.ClientPubkey == "" {
+		return ""
+	}
+	return c.ServerPubkey + c.ClientPrivkey + c.ClientPubkey + c.PresharedKey
+}
+
+// WireguardCredential returns the tunnel's current credential
+func (t Tunnel) WireguardCredential() WireguardCredential {
+	return WireguardCredential{
+		ServerPubkey:  t.WireguardServerPubkey,
+		ClientPrivkey: t.WireguardClientPrivkey,
+		ClientPubkey:  t.WireguardClientPubkey,
+		PresharedKey:  t.WireguardPresharedKey,
+	}
+}
+
+// SetWireguardCredential stores a credential in the tunnel's key columns
+func (t *Tunnel) SetWireguardCredential(cred WireguardCredential) {
+	t.WireguardServerPubkey = cred.ServerPubkey
+	t.WireguardClientPrivkey = cred.ClientPrivkey
+	t.WireguardClientPubkey = cred.ClientPubkey
+	t.WireguardPresharedKey = cred.PresharedKey
+}
+
+// ValidateWireguardKeys checks the tunnel's credential, and for server
+// tunnels that the server public key belongs to our private key
+func (t Tunnel) ValidateWireguardKeys() error {
+	err := t.WireguardCredential().Validate()
+	if err != nil {
+		return err
+	}
+	if t.WireguardServerKey != "" {
+		serverKey, err := wgtypes.ParseKey(t.WireguardServerKey)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCredentialKey, err)
+		}
+		if serverKey.PublicKey().String() != t.WireguardServerPubkey {
+			return ErrCredentialServerMismatch
+		}
+	}
+	return nil
+}
+
+// PendingWireguardCredential returns the credential of a key rotation in progress
+func (t Tunnel) PendingWireguardCredential() (WireguardCredential, bool) {
+	if t.KeyRotationDeadline == nil || t.PendingWireguardServerKey == "" {
+		return WireguardCredential{}, false
+	}
+	serverKey, err := wgtypes.ParseKey(t.PendingWireguardServerKey)
+	if err != nil {
+		return WireguardCredential{}, false
+	}
+	clientKey, err := wgtypes.ParseKey(t.PendingWireguardClientPrivkey)
+	if err != nil {
+		return WireguardCredential{}, false
+	}
+	cred := NewWireguardCredential(serverKey, clientKey, nil)
+	cred.PresharedKey = t.PendingWireguardPresharedKey
+	return cred, true
+}
+
+// MigrateWireguardCredentials moves the keys of WireGuard tunnels out of the
+// combined Password column into their own columns. Password is left for VTun.
+func MigrateWireguardCredentials(db *gorm.DB) error {
+	var tunnels []Tunnel
+	err := db.Where("wireguard = ?", true).Where("password <> ?", "").Find(&tunnels).Error
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels to migrate: %w", err)
+	}
+
+	for _, tunnel := range tunnels {
+		cred, err := ParseWireguardCredential(tunnel.Password)
+		if err != nil {
+			slog.Error("Unable to migrate tunnel credential, leaving it in place", "tunnel", tunnel.Hostname, "error", err)
+			continue
+		}
+		tunnel.SetWireguardCredential(cred)
+		tunnel.Password = ""
+		err = db.Model(&tunnel).Select(
+			"Password", "WireguardServerPubkey", "WireguardClientPrivkey", "WireguardClientPubkey", "WireguardPresharedKey",
+		).Updates(&tunnel).Error
+		if err != nil {
+			return fmt.Errorf("failed to migrate tunnel %s: %w", tunnel.Hostname, err)
+		}
+		slog.Info("Migrated tunnel credential to key columns", "tunnel", tunnel.Hostname)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package models_test
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/glebarez/sqlite"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+func generateKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseWireguardCredential(t *testing.T) {
+	t.Parallel()
+
+	serverKey := generateKey(t)
+	clientKey := generateKey(t)
+	psk := generateKey(t)
+	cred := models.NewWireguardCredential(serverKey, clientKey, nil)
+	credWithPSK := models.NewWireguardCredential(serverKey, clientKey, &psk)
+	otherClientPubkey := generateKey(t).PublicKey().String()
+
+	tests := []struct {
+		name string
+		s    string
+		want models.WireguardCredential
+		err  error
+	}{
+		{"valid", cred.String(), cred, nil},
+		{"with preshared key", credWithPSK.String(), credWithPSK, nil},
+		{"empty", "", models.WireguardCredential{}, models.ErrCredentialLength},
+		{"too short", cred.String()[1:], models.WireguardCredential{}, models.ErrCredentialLength},
+		{"too long", cred.String() + "A", models.WireguardCredential{}, models.ErrCredentialLength},
+		{"truncated preshared key", credWithPSK.String()[:len(credWithPSK.String())-1], models.WireguardCredential{}, models.ErrCredentialLength},
+		{"bad base64", strings.Repeat("!", models.WireguardCredentialLength), models.WireguardCredential{}, models.ErrCredentialKey},
+		{"bad preshared key", cred.String() + strings.Repeat("!", 44), models.WireguardCredential{}, models.ErrCredentialKey},
+		{"mismatched client keys", cred.ServerPubkey + cred.ClientPrivkey + otherClientPubkey, models.WireguardCredential{}, models.ErrCredentialKeyMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := models.ParseWireguardCredential(tt.s)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseWireguardCredential() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && got != tt.want {
+				t.Errorf("ParseWireguardCredential() = %+v, want %+v", got, tt.want)
+			}
+			if tt.err == nil && got.String() != tt.s {
+				t.Errorf("String() = %q, want %q", got.String(), tt.s)
+			}
+		})
+	}
+}
+
+func TestValidateWireguardKeysServerMismatch(t *testing.T) {
+	t.Parallel()
+
+	tunnel := models.Tunnel{WireguardServerKey: generateKey(t).String()}
+	tunnel.SetWireguardCredential(models.NewWireguardCredential(generateKey(t), generateKey(t), nil))
+	if err := tunnel.ValidateWireguardKeys(); !errors.Is(err, models.ErrCredentialServerMismatch) {
+		t.Errorf("ValidateWireguardKeys() = %v, want %v", err, models.ErrCredentialServerMismatch)
+	}
+}
+
+// newTestDB returns a migrated sqlite database of its own for a test
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.Tunnel{}, &models.TunnelKeyRotation{}, &models.TunnelUsagePeriod{}, &models.TrafficSample{}, &models.TunnelSession{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrateWireguardCredentials(t *testing.T) {
+	t.Parallel()
+	db := newTestDB(t)
+
+	serverKey := generateKey(t)
+	psk := generateKey(t)
+	cred := models.NewWireguardCredential(serverKey, generateKey(t), &psk)
+	tunnels := []models.Tunnel{
+		{Hostname: "MIGRATED", IP: "10.54.0.0", Wireguard: true, WireguardServerKey: serverKey.String(), Password: cred.String()},
+		{Hostname: "BROKEN", IP: "10.54.0.4", Wireguard: true, Password: "not-a-credential"},
+		{Hostname: "VTUN", IP: "172.31.0.0", Password: "hunter2"},
+	}
+	for i := range tunnels {
+		err := db.Create(&tunnels[i]).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := models.MigrateWireguardCredentials(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := models.FindTunnelByID(db, tunnels[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Password != "" {
+		t.Errorf("migrated tunnel kept its password %q", migrated.Password)
+	}
+	if migrated.WireguardCredential() != cred {
+		t.Errorf("migrated credential = %+v, want %+v", migrated.WireguardCredential(), cred)
+	}
+	if err := migrated.ValidateWireguardKeys(); err != nil {
+		t.Errorf("migrated keys are invalid: %v", err)
+	}
+
+	for _, tunnel := range tunnels[1:] {
+		stored, err := models.FindTunnelByID(db, tunnel.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Password != tunnel.Password || stored.WireguardClientPubkey != "" {
+			t.Errorf("%s was changed: password %q, client pubkey %q", tunnel.Hostname, stored.Password, stored.WireguardClientPubkey)
+		}
+	}
+
+	// Running the migration again leaves everything as it is
+	err = models.MigrateWireguardCredentials(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := models.FindTunnelByID(db, tunnels[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.WireguardCredential() != cred {
+		t.Errorf("second migration changed the credential to %+v", again.WireguardCredential())
+	}
+}
+
+func TestTunnelJSONHidesKeys(t *testing.T) {
+	t.Parallel()
+
+	serverKey := generateKey(t)
+	psk := generateKey(t)
+	tunnel := models.Tunnel{Hostname: "KI5VMF-A", Wireguard: true, WireguardServerKey: serverKey.String()}
+	tunnel.SetWireguardCredential(models.NewWireguardCredential(serverKey, generateKey(t), &psk))
+
+	data, err := json.Marshal(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{serverKey.String(), tunnel.WireguardClientPrivkey, psk.String()} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("tunnel JSON %s contains a private key", data)
+		}
+	}
+}
@@ -8,6 +8,10 @@ const (
 	EventTypeTunnelStats         EventType = "tunnel_stats"
 	EventTypeTotalBandwidth      EventType = "total_bandwidth"
 	EventTypeTotalTraffic        EventType = "total_traffic"
+	EventTypeQuotaWarning        EventType = "quota_warning"
+	EventTypeQuotaExceeded       EventType = "quota_exceeded"
+	EventTypeQuotaReset          EventType = "quota_reset"
+	EventTypeTunnelFlapping      EventType = "tunnel_flapping"
 )
 
 type Event struct {
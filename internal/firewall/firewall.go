@@ -0,0 +1,225 @@
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+// Table is the nftables table holding the tunnel policies. We own all of it
+// and replace it as a whole, so it never touches rules from anything else.
+const Table = "inet mesh_manager"
+
+//nolint:gochecknoglobals
+var (
+	meshPrefixes = []string{"10.0.0.0/8", "44.0.0.0/8"}
+	// privatePrefixes are the ranges still reachable when the internet is blocked
+	privatePrefixes  = []string{"10.0.0.0/8", "44.0.0.0/8", "100.64.0.0/10", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16"}
+	privatePrefixes6 = []string{"fc00::/7", "fe80::/10"}
+)
+
+// Peer is a tunnel whose forwarded traffic is filtered
+type Peer struct {
+	ID    uint
+	Iface string
+	// Sources narrows the match to the peer's addresses when it shares its interface with others
+	Sources []net.IPNet
+	Policy  models.FirewallPolicy
+	Rules   []models.FirewallRule
+}
+
+// Render builds the nftables ruleset for the peers. Peers that allow
+// everything are left out, and if none are left it returns an empty string.
+// The ruleset deletes the table before recreating it, so applying it
+// replaces the previous one in a single transaction.
+func Render(peers []Peer) string {
+	filtered := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Policy.Effective() != models.FirewallAllowAll {
+			filtered = append(filtered, peer)
+		}
+	}
+	if len(filtered) == 0 {
+		return ""
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].ID < filtered[j].ID
+	})
+
+	var b strings.Builder
+	b.WriteString(resetTable())
+	fmt.Fprintf(&b, "table %s {\n", Table)
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	for _, peer := range filtered {
+		for _, match := range sourceMatches(peer) {
+			fmt.Fprintf(&b, "\t\tiifname %q %sjump %s\n", peer.Iface, match, chainName(peer))
+		}
+	}
+	b.WriteString("\t}\n")
+
+	for _, peer := range filtered {
+		fmt.Fprintf(&b, "\tchain %s {\n", chainName(peer))
+		// Replies to connections the mesh opened towards the peer are always let through
+		b.WriteString("\t\tct state established,related accept\n")
+		for _, rule := range policyRules(peer) {
+			fmt.Fprintf(&b, "\t\t%s accept\n", rule)
+		}
+		b.WriteString("\t\tcounter drop\n")
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Apply loads a ruleset rendered by Render into the kernel
+func Apply(ruleset string) error {
+	if ruleset == "" {
+		return Remove()
+	}
+	return nft(ruleset)
+}
+
+// Available reports whether the nft tool is installed
+func Available() bool {
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+// ErrUnavailable is returned for a policy that can't be enforced without nft
+var ErrUnavailable = errors.New("firewall policies other than allow-all need nftables installed")
+
+// CheckPolicy returns ErrUnavailable if the policy filters traffic and nft isn't installed
+func CheckPolicy(policy models.FirewallPolicy) error {
+	if policy.Effective() == models.FirewallAllowAll || Available() {
+		return nil
+	}
+	return ErrUnavailable
+}
+
+// Loaded reports whether the table is in the kernel. A ruleset flush or a
+// distro firewall reload can drop it without us knowing.
+func Loaded() (bool, error) {
+	cmd := exec.Command("nft", append([]string{"list", "table"}, strings.Fields(Table)...)...)
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.Contains(out.String(), "No such file or directory") {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to list nftables table: %w: %s", err, strings.TrimSpace(out.String()))
+}
+
+// Remove deletes the table, it is not an error if it doesn't exist
+func Remove() error {
+	return nft(resetTable())
+}
+
+// resetTable declares the table before deleting it so the delete never fails
+func resetTable() string {
+	return fmt.Sprintf("table %s\ndelete table %s\n", Table, Table)
+}
+
+func nft(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to apply nftables ruleset: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func chainName(peer Peer) string {
+	return "tunnel_" + strconv.FormatUint(uint64(peer.ID), 10)
+}
+
+// sourceMatches returns the source address matches for the forward chain jumps,
+// one per address family, or a single empty match if the interface is the peer's own
+func sourceMatches(peer Peer) []string {
+	if len(peer.Sources) == 0 {
+		return []string{""}
+	}
+	var v4, v6 []string
+	for _, source := range peer.Sources {
+		if source.IP.To4() != nil {
+			v4 = append(v4, source.String())
+		} else {
+			v6 = append(v6, source.String())
+		}
+	}
+	var matches []string
+	if len(v4) > 0 {
+		matches = append(matches, "ip saddr "+set(v4)+" ")
+	}
+	if len(v6) > 0 {
+		matches = append(matches, "ip6 saddr "+set(v6)+" ")
+	}
+	return matches
+}
+
+// policyRules returns the matches for traffic the peer's policy accepts
+func policyRules(peer Peer) []string {
+	switch peer.Policy {
+	case models.FirewallMeshOnly:
+		return []string{"ip daddr " + set(meshPrefixes)}
+	case models.FirewallBlockInternet:
+		return []string{
+			"ip daddr " + set(privatePrefixes),
+			"ip6 daddr " + set(privatePrefixes6),
+		}
+	case models.FirewallCustom:
+		rules := make([]string, 0, len(peer.Rules))
+		for _, rule := range peer.Rules {
+			rules = append(rules, customRule(rule))
+		}
+		return rules
+	default:
+		return nil
+	}
+}
+
+func customRule(rule models.FirewallRule) string {
+	var parts []string
+	if rule.CIDR != "" {
+		family := "ip"
+		if strings.Contains(rule.CIDR, ":") {
+			family = "ip6"
+		}
+		parts = append(parts, family+" daddr "+rule.CIDR)
+	}
+	if rule.Protocol != "" {
+		if len(rule.Ports) == 0 {
+			parts = append(parts, "meta l4proto "+rule.Protocol)
+		} else {
+			ports := make([]string, 0, len(rule.Ports))
+			for _, port := range rule.Ports {
+				ports = append(ports, strconv.Itoa(int(port)))
+			}
+			parts = append(parts, rule.Protocol+" dport "+set(ports))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// set formats values as an anonymous nftables set, or a single value on its own
+func set(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return "{ " + strings.Join(values, ", ") + " }"
+}
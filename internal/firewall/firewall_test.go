@@ -0,0 +1,89 @@
+package firewall_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+)
+
+func TestRenderAllowAllIsEmpty(t *testing.T) {
+	t.Parallel()
+
+	got := firewall.Render([]firewall.Peer{
+		{ID: 1, Iface: "wgs1", Policy: models.FirewallAllowAll},
+		{ID: 2, Iface: "wgs2"},
+	})
+	if got != "" {
+		t.Errorf("Render() = %q, want empty", got)
+	}
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	got := firewall.Render([]firewall.Peer{
+		{
+			ID:     7,
+			Iface:  "wg0",
+			Policy: models.FirewallCustom,
+			Sources: []net.IPNet{
+				{IP: net.ParseIP("10.54.0.9").To4(), Mask: net.CIDRMask(32, 32)},
+				{IP: net.ParseIP("fe80::a36:9"), Mask: net.CIDRMask(128, 128)},
+			},
+			Rules: []models.FirewallRule{
+				{CIDR: "10.54.1.0/24", Protocol: models.FirewallProtocolTCP, Ports: []uint16{80, 443}},
+				{Protocol: models.FirewallProtocolUDP, Ports: []uint16{53}},
+				{CIDR: "2001:db8::/32"},
+			},
+		},
+		{ID: 3, Iface: "wgs3", Policy: models.FirewallMeshOnly},
+	})
+
+	for _, want := range []string{
+		"table inet mesh_manager\ndelete table inet mesh_manager\n",
+		"\t\tiifname \"wgs3\" jump tunnel_3\n\t\tiifname \"wg0\" ip saddr 10.54.0.9/32 jump tunnel_7\n",
+		"\t\tiifname \"wg0\" ip6 saddr fe80::a36:9/128 jump tunnel_7\n",
+		"\t\tip daddr { 10.0.0.0/8, 44.0.0.0/8 } accept\n",
+		"\t\tip daddr 10.54.1.0/24 tcp dport { 80, 443 } accept\n",
+		"\t\tudp dport 53 accept\n",
+		"\t\tip6 daddr 2001:db8::/32 accept\n",
+		"\t\tcounter drop\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Render() is missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestValidateFirewall(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		policy models.FirewallPolicy
+		rules  []models.FirewallRule
+		ok     bool
+	}{
+		{"unset", "", nil, true},
+		{"mesh only", models.FirewallMeshOnly, nil, true},
+		{"unknown", "open", nil, false},
+		{"rules without custom", models.FirewallMeshOnly, []models.FirewallRule{{CIDR: "10.0.0.0/8"}}, false},
+		{"custom", models.FirewallCustom, []models.FirewallRule{{CIDR: "10.0.0.0/8"}}, true},
+		{"bad cidr", models.FirewallCustom, []models.FirewallRule{{CIDR: "10.0.0.0/33"}}, false},
+		{"ports without protocol", models.FirewallCustom, []models.FirewallRule{{CIDR: "10.0.0.0/8", Ports: []uint16{22}}}, false},
+		{"empty rule", models.FirewallCustom, []models.FirewallRule{{}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := models.ValidateFirewall(tt.policy, tt.rules)
+			if (err == nil) != tt.ok {
+				t.Errorf("ValidateFirewall() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -4,64 +4,169 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/USA-RedDragon/mesh-manager/internal/bandwidth"
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/dampening"
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
 	"github.com/USA-RedDragon/mesh-manager/internal/events"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gorm.io/gorm"
 )
 
 const WG0 = "wg0"
 
+// handshakeCheckInterval is how often wireguard handshakes are checked, since
+// a peer connecting or going quiet doesn't produce a netlink event
+const handshakeCheckInterval = 5 * time.Second
+
+// updateBuffer lets netlink queue up a burst of updates while a pass over the interfaces runs
+const updateBuffer = 64
+
 type _iface struct {
 	net.Interface
 	AssociatedTunnel *models.Tunnel
+	// Peer is set for tunnels on the shared interface, which are tracked per peer
+	Peer wgtypes.Key
+	// reason is why the tunnel is being marked inactive
+	reason models.DisconnectReason
+	// session is set once the connection has been recorded in the session history
+	session bool
 }
 
 type Watcher struct {
-	stopped                  bool
+	stopChan                 chan struct{}
+	stopped                  chan struct{}
 	db                       *gorm.DB
 	interfaces               []_iface
 	interfacesToMarkInactive []_iface
 	Stats                    *bandwidth.StatCounterManager
 	eventChannel             chan events.Event
 	wgClient                 *wgctrl.Client
+	config                   *config.Config
+	dampener                 *dampening.Dampener
+	wireguard                *wireguard.Manager
 }
 
-func NewWatcher(db *gorm.DB, events chan events.Event) (*Watcher, error) {
+func NewWatcher(config *config.Config, db *gorm.DB, wireguardManager *wireguard.Manager, events chan events.Event) (*Watcher, error) {
 	wgClient, err := wgctrl.New()
 	if err != nil {
 		return nil, err
 	}
+	// Flap penalties don't survive a restart, so neither does suppression
+	err = models.ClearFlapSuppression(db)
+	if err != nil {
+		return nil, err
+	}
 	w := &Watcher{
-		stopped:      true,
 		db:           db,
-		Stats:        bandwidth.NewStatCounterManager(db, events),
+		Stats:        bandwidth.NewStatCounterManager(config, db, events, wgClient),
 		eventChannel: events,
 		wgClient:     wgClient,
+		config:       config,
+		dampener:     dampening.New(config.Flapping),
+		wireguard:    wireguardManager,
 	}
 	w.Stats.Start()
 	return w, nil
 }
 
+// Watch reacts to interfaces and addresses coming and going as netlink
+// reports them, and checks wireguard handshakes on a timer
 func (w *Watcher) Watch() error {
-	if w.stopped {
-		w.stopped = false
-		go func() {
-			for !w.stopped {
-				w.watch()
-			}
-		}()
-	} else {
+	if w.stopChan != nil {
 		return fmt.Errorf("watcher already running")
 	}
+	w.stopChan = make(chan struct{})
+	w.stopped = make(chan struct{})
+
+	linkUpdates := make(chan netlink.LinkUpdate, updateBuffer)
+	err := netlink.LinkSubscribeWithOptions(linkUpdates, w.stopChan, netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			slog.Error("Error receiving link updates", "error", err)
+		},
+	})
+	if err != nil {
+		w.abortWatch()
+		return fmt.Errorf("failed to subscribe to link updates: %w", err)
+	}
+	addrUpdates := make(chan netlink.AddrUpdate, updateBuffer)
+	err = netlink.AddrSubscribeWithOptions(addrUpdates, w.stopChan, netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			slog.Error("Error receiving address updates", "error", err)
+		},
+	})
+	if err != nil {
+		w.abortWatch()
+		return fmt.Errorf("failed to subscribe to address updates: %w", err)
+	}
+
+	go w.loop(linkUpdates, addrUpdates)
 	return nil
 }
 
+// abortWatch closes any subscription made before Watch failed
+func (w *Watcher) abortWatch() {
+	close(w.stopChan)
+	w.stopChan = nil
+}
+
+func (w *Watcher) loop(linkUpdates chan netlink.LinkUpdate, addrUpdates chan netlink.AddrUpdate) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(handshakeCheckInterval)
+	defer ticker.Stop()
+
+	w.watch()
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case _, ok := <-linkUpdates:
+			if !ok {
+				// Fall back to the timer if the subscription dies
+				slog.Error("Link update subscription closed")
+				linkUpdates = nil
+				continue
+			}
+		case _, ok := <-addrUpdates:
+			if !ok {
+				slog.Error("Address update subscription closed")
+				addrUpdates = nil
+				continue
+			}
+		case <-ticker.C:
+		}
+		drainUpdates(linkUpdates, addrUpdates)
+		w.watch()
+	}
+}
+
+// drainUpdates discards updates that arrived together, such as a new interface
+// and its addresses, since one pass over the interfaces covers all of them
+func drainUpdates(linkUpdates chan netlink.LinkUpdate, addrUpdates chan netlink.AddrUpdate) {
+	for {
+		select {
+		case _, ok := <-linkUpdates:
+			if !ok {
+				return
+			}
+		case _, ok := <-addrUpdates:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
 func netInterfaceContainsIface(s []net.Interface, e _iface) bool {
 	for _, a := range s {
 		if a.Name == e.Name && a.Index == e.Index && a.HardwareAddr.String() == e.HardwareAddr.String() {
@@ -82,7 +187,7 @@ func ifaceContainsNetInterface(s []_iface, e net.Interface) bool {
 
 func remove(s []_iface, e _iface) []_iface {
 	for i, a := range s {
-		if a.Name == e.Name && a.Index == e.Index && a.HardwareAddr.String() == e.HardwareAddr.String() {
+		if a.Name == e.Name && a.Index == e.Index && a.HardwareAddr.String() == e.HardwareAddr.String() && a.Peer == e.Peer {
 			return append(s[:i], s[i+1:]...)
 		}
 	}
@@ -100,17 +205,91 @@ func (w *Watcher) wgInterfaceActive(iface _iface) bool {
 	if err != nil {
 		return false
 	}
-	if len(dev.Peers) > 0 {
-		for _, peer := range dev.Peers {
-			// If the last handshake time is more than 3 minutes ago, consider the interface inactive
-			if !peer.LastHandshakeTime.IsZero() && time.Since(peer.LastHandshakeTime) < 180*time.Second {
-				return true
-			}
+	for _, peer := range dev.Peers {
+		if w.peerActive(peer) {
+			return true
 		}
 	}
 	return false
 }
 
+// peerActive reports whether a wireguard peer has completed a handshake recently
+func (w *Watcher) peerActive(peer wgtypes.Peer) bool {
+	timeout := time.Duration(w.config.Flapping.HandshakeTimeout) * time.Second
+	return !peer.LastHandshakeTime.IsZero() && time.Since(peer.LastHandshakeTime) < timeout
+}
+
+// flapped counts a tunnel disconnecting and warns when it has flapped enough to be suppressed.
+// Disconnects the wireguard manager caused by removing the peer or changing its keys don't count.
+func (w *Watcher) flapped(iface _iface) {
+	if iface.reason != models.DisconnectHandshakeTimeout && iface.reason != models.DisconnectInterfaceDown {
+		return
+	}
+	tunnel := iface.AssociatedTunnel
+	if w.wireguard != nil && w.wireguard.CausedDisconnect(tunnel.ID) {
+		slog.Debug("Tunnel was disconnected by the wireguard manager, not counting a flap", "tunnel", tunnel.Hostname)
+		return
+	}
+	tunnel.Flaps++
+	err := models.RecordTunnelFlap(w.db, tunnel.ID)
+	if err != nil {
+		slog.Error("Error recording tunnel flap", "tunnel", tunnel.Hostname, "error", err)
+	}
+
+	now := time.Now()
+	if !w.dampener.Flap(tunnel.ID, now) {
+		return
+	}
+	status := w.dampener.Status(tunnel.ID, now)
+	slog.Warn("Tunnel is flapping, suppressing it", "tunnel", tunnel.Hostname, "flaps", tunnel.Flaps, "penalty", status.Penalty)
+	err = models.SetTunnelFlapSuppressed(w.db, tunnel.ID, true)
+	if err != nil {
+		slog.Error("Error suppressing tunnel", "tunnel", tunnel.Hostname, "error", err)
+	}
+	w.eventChannel <- events.Event{
+		Type: events.EventTypeTunnelFlapping,
+		Data: apimodels.WebsocketTunnelFlapping{
+			ID:       tunnel.ID,
+			Hostname: tunnel.Hostname,
+			Flaps:    tunnel.Flaps,
+			Penalty:  status.Penalty,
+		},
+	}
+}
+
+// suppressed reports whether a tunnel is being held down for flapping,
+// lifting the suppression once its penalty has decayed
+func (w *Watcher) suppressed(tunnel *models.Tunnel) bool {
+	suppressed, released := w.dampener.Suppressed(tunnel.ID, time.Now())
+	if released {
+		slog.Info("Tunnel has stopped flapping, no longer suppressing it", "tunnel", tunnel.Hostname)
+		err := models.SetTunnelFlapSuppressed(w.db, tunnel.ID, false)
+		if err != nil {
+			slog.Error("Error lifting tunnel suppression", "tunnel", tunnel.Hostname, "error", err)
+		}
+	}
+	return suppressed
+}
+
+// reportDisconnect tells the websocket clients a tunnel went down, if they were told it was up
+func (w *Watcher) reportDisconnect(tunnel *models.Tunnel) {
+	if !tunnel.Active {
+		return
+	}
+	w.eventChannel <- events.Event{
+		Type: events.EventTypeTunnelDisconnection,
+		Data: apimodels.WebsocketTunnelDisconnect{
+			ID:     tunnel.ID,
+			Client: tunnel.Client,
+		},
+	}
+}
+
+// isDedicatedWireguard reports whether an interface carries a single wireguard tunnel
+func isDedicatedWireguard(name string) bool {
+	return strings.HasPrefix(name, "wg") && name != WG0 && name != wireguard.SharedInterfaceName
+}
+
 func (w *Watcher) watch() {
 	w.interfacesToMarkInactive = []_iface{}
 	interfaces, err := net.Interfaces()
@@ -119,55 +298,50 @@ func (w *Watcher) watch() {
 	} else {
 		// Loop through w.interfaces and check if any are present but missing from net.Interfaces()
 		for _, iface := range w.interfaces {
-			if strings.HasPrefix(iface.Name, "wg") && iface.Name != WG0 && !w.wgInterfaceActive(iface) {
-				w.eventChannel <- events.Event{
-					Type: events.EventTypeTunnelDisconnection,
-					Data: apimodels.WebsocketTunnelDisconnect{
-						ID:     iface.AssociatedTunnel.ID,
-						Client: iface.AssociatedTunnel.Client,
-					},
-				}
+			if isDedicatedWireguard(iface.Name) && !w.wgInterfaceActive(iface) {
+				w.reportDisconnect(iface.AssociatedTunnel)
 				err = w.Stats.Remove(iface.Name)
 				if err != nil {
 					slog.Error("Error removing interface from stats", "error", err)
 					continue
 				}
+				iface.reason = models.DisconnectHandshakeTimeout
+				if !netInterfaceContainsIface(interfaces, iface) {
+					iface.reason = models.DisconnectInterfaceDown
+				}
 				w.interfaces = remove(w.interfaces, iface)
 				w.interfacesToMarkInactive = append(w.interfacesToMarkInactive, iface)
+				w.flapped(iface)
 			} else if strings.HasPrefix(iface.Name, "tun") && !netInterfaceContainsIface(interfaces, iface) {
-				w.eventChannel <- events.Event{
-					Type: events.EventTypeTunnelDisconnection,
-					Data: apimodels.WebsocketTunnelDisconnect{
-						ID:     iface.AssociatedTunnel.ID,
-						Client: iface.AssociatedTunnel.Client,
-					},
-				}
+				w.reportDisconnect(iface.AssociatedTunnel)
 				err = w.Stats.Remove(iface.Name)
 				if err != nil {
 					slog.Error("Error removing interface from stats", "error", err)
 					continue
 				}
+				iface.reason = models.DisconnectInterfaceDown
 				w.interfaces = remove(w.interfaces, iface)
 				w.interfacesToMarkInactive = append(w.interfacesToMarkInactive, iface)
+				w.flapped(iface)
 			}
 		}
 
 		// Loop through net.Interfaces() and check if any are missing from w.interfaces
 		for _, iface := range interfaces {
-			if strings.HasPrefix(iface.Name, "wg") && iface.Name != WG0 && w.wgInterfaceActive(_iface{iface, nil}) && !ifaceContainsNetInterface(w.interfaces, iface) {
+			if isDedicatedWireguard(iface.Name) && w.wgInterfaceActive(_iface{Interface: iface}) && !ifaceContainsNetInterface(w.interfaces, iface) {
 				tunnel := w.findTunnel(iface)
 				if tunnel == nil {
 					slog.Error("No tunnel found for interface", "interface", iface.Name)
 					continue
 				}
-				err = w.Stats.Add(iface.Name)
+				err = w.Stats.Add(iface.Name, tunnel.ID)
 				if err != nil {
 					slog.Error("Error adding interface to stats", "error", err)
 					continue
 				}
 				w.interfaces = append(w.interfaces, _iface{
-					iface,
-					tunnel,
+					Interface:        iface,
+					AssociatedTunnel: tunnel,
 				})
 			} else if strings.HasPrefix(iface.Name, "tun") && !ifaceContainsNetInterface(w.interfaces, iface) {
 				tunnel := w.findTunnel(iface)
@@ -175,20 +349,83 @@ func (w *Watcher) watch() {
 					slog.Error("No tunnel found for interface", "interface", iface.Name)
 					continue
 				}
-				err = w.Stats.Add(iface.Name)
+				err = w.Stats.Add(iface.Name, tunnel.ID)
 				if err != nil {
 					slog.Error("Error adding interface to stats", "error", err)
 					continue
 				}
 				w.interfaces = append(w.interfaces, _iface{
-					iface,
-					tunnel,
+					Interface:        iface,
+					AssociatedTunnel: tunnel,
 				})
 			}
 		}
 	}
+	w.watchSharedPeers()
 	w.reconcileDB()
-	time.Sleep(1 * time.Second)
+}
+
+// watchSharedPeers tracks the peers of the shared interface one by one, since
+// the interface itself stays up for as long as any of its tunnels exist
+func (w *Watcher) watchSharedPeers() {
+	active := make(map[wgtypes.Key]bool)
+	link, err := net.InterfaceByName(wireguard.SharedInterfaceName)
+	linkUp := err == nil
+	if linkUp {
+		dev, err := w.wgClient.Device(wireguard.SharedInterfaceName)
+		if err == nil {
+			for _, peer := range dev.Peers {
+				if w.peerActive(peer) {
+					active[peer.PublicKey] = true
+				}
+			}
+		}
+	}
+
+	tracked := make(map[wgtypes.Key]bool)
+	for _, iface := range slices.Clone(w.interfaces) {
+		if iface.Name != wireguard.SharedInterfaceName {
+			continue
+		}
+		if active[iface.Peer] {
+			tracked[iface.Peer] = true
+			continue
+		}
+		w.reportDisconnect(iface.AssociatedTunnel)
+		err = w.Stats.Remove(bandwidth.PeerKey(iface.Name, iface.Peer))
+		if err != nil {
+			slog.Error("Error removing peer from stats", "error", err)
+			continue
+		}
+		iface.reason = models.DisconnectHandshakeTimeout
+		if !linkUp {
+			iface.reason = models.DisconnectInterfaceDown
+		}
+		w.interfaces = remove(w.interfaces, iface)
+		w.interfacesToMarkInactive = append(w.interfacesToMarkInactive, iface)
+		w.flapped(iface)
+	}
+
+	for pubkey := range active {
+		if tracked[pubkey] {
+			continue
+		}
+		tunnel, err := models.FindSharedTunnelByPeerKey(w.db, pubkey.String())
+		if err != nil {
+			slog.Error("No tunnel found for shared interface peer", "peer", pubkey.String(), "error", err)
+			continue
+		}
+		err = w.Stats.AddPeer(link.Name, pubkey, tunnel.ID)
+		if err != nil {
+			slog.Error("Error adding peer to stats", "error", err)
+			continue
+		}
+		w.interfaces = append(w.interfaces, _iface{
+			Interface:        *link,
+			AssociatedTunnel: &tunnel,
+			Peer:             pubkey,
+		})
+	}
 }
 
 func (w *Watcher) findTunnel(iface net.Interface) *models.Tunnel {
@@ -244,21 +481,24 @@ func (w *Watcher) reconcileDB() {
 	for _, iface := range w.interfacesToMarkInactive {
 		if iface.AssociatedTunnel != nil {
 			slog.Info("Marking tunnel as inactive", "tunnel", iface.AssociatedTunnel.Hostname)
+			// The stat counter wrote out the tunnel's traffic when it was removed,
+			// so pick up the totals from the database rather than the stale copy
+			tunnel, err := models.FindTunnelByID(w.db, iface.AssociatedTunnel.ID)
+			if err == nil {
+				iface.AssociatedTunnel.TotalRXMB = tunnel.TotalRXMB
+				iface.AssociatedTunnel.TotalTXMB = tunnel.TotalTXMB
+				err = models.EndTunnelSession(w.db, tunnel.ID, time.Now(), tunnel.RXBytes, tunnel.TXBytes, iface.reason)
+				if err != nil {
+					slog.Error("Error ending tunnel session", "tunnel", tunnel.Hostname, "error", err)
+				}
+			}
+			w.reportDisconnect(iface.AssociatedTunnel)
 			iface.AssociatedTunnel.Active = false
 			iface.AssociatedTunnel.TunnelInterface = ""
 			iface.AssociatedTunnel.RXBytesPerSec = 0
 			iface.AssociatedTunnel.TXBytesPerSec = 0
-			iface.AssociatedTunnel.TotalRXMB += float64(iface.AssociatedTunnel.RXBytes) / 1024 / 1024
-			iface.AssociatedTunnel.TotalTXMB += float64(iface.AssociatedTunnel.TXBytes) / 1024 / 1024
 			iface.AssociatedTunnel.RXBytes = 0
 			iface.AssociatedTunnel.TXBytes = 0
-			w.eventChannel <- events.Event{
-				Type: events.EventTypeTunnelDisconnection,
-				Data: apimodels.WebsocketTunnelDisconnect{
-					ID:     iface.AssociatedTunnel.ID,
-					Client: iface.AssociatedTunnel.Client,
-				},
-			}
 
 			wsTunnel := apimodels.WebsocketTunnelStats{
 				ID:               iface.AssociatedTunnel.ID,
@@ -273,33 +513,71 @@ func (w *Watcher) reconcileDB() {
 				Type: events.EventTypeTunnelStats,
 				Data: wsTunnel,
 			}
-			w.db.Save(iface.AssociatedTunnel)
+			// The tunnel was loaded when it connected, so only write what changed
+			// rather than overwrite edits and quota state from since then
+			w.db.Model(iface.AssociatedTunnel).
+				Select("active", "tunnel_interface", "rx_bytes_per_sec", "tx_bytes_per_sec", "rx_bytes", "tx_bytes").
+				Updates(iface.AssociatedTunnel)
 		}
 	}
 
-	for _, iface := range w.interfaces {
-		if iface.AssociatedTunnel != nil {
-			if !iface.AssociatedTunnel.Active {
-				slog.Info("Marking tunnel as active", "tunnel", iface.AssociatedTunnel.Hostname)
-				iface.AssociatedTunnel.Active = true
-				iface.AssociatedTunnel.TunnelInterface = iface.Name
-				iface.AssociatedTunnel.ConnectionTime = time.Now()
-
-				w.eventChannel <- events.Event{
-					Type: events.EventTypeTunnelConnection,
-					Data: apimodels.WebsocketTunnelConnect{
-						ID:             iface.AssociatedTunnel.ID,
-						Client:         iface.AssociatedTunnel.Client,
-						ConnectionTime: iface.AssociatedTunnel.ConnectionTime,
-					},
-				}
-				w.db.Save(iface.AssociatedTunnel)
+	for i := range w.interfaces {
+		iface := &w.interfaces[i]
+		if iface.AssociatedTunnel == nil {
+			continue
+		}
+		if !iface.session {
+			iface.session = true
+			iface.AssociatedTunnel.ConnectionTime = time.Now()
+			err := models.StartTunnelSession(w.db, iface.AssociatedTunnel.ID, w.peerEndpoint(*iface), iface.AssociatedTunnel.ConnectionTime)
+			if err != nil {
+				slog.Error("Error starting tunnel session", "tunnel", iface.AssociatedTunnel.Hostname, "error", err)
 			}
 		}
+		// A suppressed tunnel's traffic is still counted, it just isn't reported as connected
+		if iface.AssociatedTunnel.Active || w.suppressed(iface.AssociatedTunnel) {
+			continue
+		}
+		slog.Info("Marking tunnel as active", "tunnel", iface.AssociatedTunnel.Hostname)
+		iface.AssociatedTunnel.Active = true
+		iface.AssociatedTunnel.TunnelInterface = iface.Name
+
+		w.eventChannel <- events.Event{
+			Type: events.EventTypeTunnelConnection,
+			Data: apimodels.WebsocketTunnelConnect{
+				ID:             iface.AssociatedTunnel.ID,
+				Client:         iface.AssociatedTunnel.Client,
+				ConnectionTime: iface.AssociatedTunnel.ConnectionTime,
+			},
+		}
+		w.db.Model(iface.AssociatedTunnel).Select("active", "tunnel_interface", "connection_time").Updates(iface.AssociatedTunnel)
 	}
 }
 
+// peerEndpoint returns the address a wireguard peer is connected from, if it is known
+func (w *Watcher) peerEndpoint(iface _iface) string {
+	if !strings.HasPrefix(iface.Name, "wg") {
+		return ""
+	}
+	dev, err := w.wgClient.Device(iface.Name)
+	if err != nil {
+		return ""
+	}
+	for _, peer := range dev.Peers {
+		if iface.Name == wireguard.SharedInterfaceName && peer.PublicKey != iface.Peer {
+			continue
+		}
+		if peer.Endpoint != nil {
+			return peer.Endpoint.String()
+		}
+	}
+	return ""
+}
+
 func (w *Watcher) Stop() error {
-	w.stopped = true
+	if w.stopChan != nil {
+		close(w.stopChan)
+		<-w.stopped
+	}
 	return w.Stats.Stop()
 }
@@ -0,0 +1,322 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPoolsExhausted = errors.New("no free tunnel subnets left in any pool")
+	ErrPortsExhausted = errors.New("no free wireguard ports left")
+)
+
+const maxPort = 65535
+
+// AddressSource reports addresses that are in use elsewhere on the mesh, such as the OLSR or Babel host tables
+type AddressSource interface {
+	Addresses() []net.IP
+}
+
+// Pool is a range of addresses that tunnel subnets of a fixed size are allocated from
+type Pool struct {
+	Prefix      netip.Prefix
+	BlockPrefix int
+	first       netip.Addr
+	last        netip.Addr
+}
+
+// PoolUsage is how much of a pool is allocated
+type PoolUsage struct {
+	Pool        string `json:"pool"`
+	BlockPrefix int    `json:"block_prefix"`
+	First       string `json:"first"`
+	Last        string `json:"last"`
+	Total       int    `json:"total"`
+	Used        int    `json:"used"`
+	Free        int    `json:"free"`
+}
+
+// NewPool creates a pool covering the whole prefix
+func NewPool(prefix netip.Prefix, blockPrefix int) Pool {
+	return Pool{
+		Prefix:      prefix,
+		BlockPrefix: blockPrefix,
+		first:       prefix.Addr(),
+		last:        lastAddr(prefix),
+	}
+}
+
+// legacyPool is the range tunnels were always allocated from before pools
+// could be configured: the /16 of the starting address, from the block after
+// it up to x.x.253.255
+func legacyPool(startingAddress string, blockPrefix int) (Pool, error) {
+	start, err := netip.ParseAddr(startingAddress)
+	if err != nil || !start.Is4() {
+		return Pool{}, fmt.Errorf("invalid starting address %q", startingAddress)
+	}
+	prefix := netip.PrefixFrom(start, 16).Masked()
+	octets := prefix.Addr().As4()
+	octets[2], octets[3] = 253, 255
+
+	pool := NewPool(prefix, blockPrefix)
+	pool.first = nextBlock(netip.PrefixFrom(start, blockPrefix).Masked())
+	pool.last = netip.AddrFrom4(octets)
+	return pool, nil
+}
+
+// Pools returns the configured pools, falling back to the legacy range when none are set
+func Pools(cfg *config.Config) ([]Pool, error) {
+	if len(cfg.Wireguard.Pools) == 0 {
+		pool, err := legacyPool(cfg.Wireguard.StartingAddress, cfg.Wireguard.BlockPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return []Pool{pool}, nil
+	}
+
+	pools := make([]Pool, 0, len(cfg.Wireguard.Pools))
+	for _, spec := range cfg.Wireguard.Pools {
+		prefix, blockPrefix, err := config.ParseWireguardPool(spec, cfg.Wireguard.BlockPrefix)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, NewPool(prefix, blockPrefix))
+	}
+	return pools, nil
+}
+
+// Allocate returns the first block in the pool that holds none of the used addresses
+func (p Pool) Allocate(used []netip.Addr) (netip.Prefix, bool) {
+	taken := p.takenBlocks(used)
+	for block := netip.PrefixFrom(p.first, p.BlockPrefix).Masked(); p.fits(block); block = netip.PrefixFrom(nextBlock(block), p.BlockPrefix) {
+		if !taken[block.Addr()] {
+			return block, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Usage counts the blocks in the pool that hold any of the used addresses
+func (p Pool) Usage(used []netip.Addr) PoolUsage {
+	total := 0
+	if p.first.Compare(p.last) <= 0 {
+		blockSize := uint64(1) << (32 - p.BlockPrefix)
+		total = int((addrToUint(p.last) - addrToUint(p.first) + 1) / blockSize)
+	}
+	usedBlocks := len(p.takenBlocks(used))
+	return PoolUsage{
+		Pool:        p.Prefix.String(),
+		BlockPrefix: p.BlockPrefix,
+		First:       p.first.String(),
+		Last:        p.last.String(),
+		Total:       total,
+		Used:        usedBlocks,
+		Free:        total - usedBlocks,
+	}
+}
+
+func (p Pool) takenBlocks(used []netip.Addr) map[netip.Addr]bool {
+	taken := make(map[netip.Addr]bool)
+	for _, addr := range used {
+		if addr.Compare(p.first) < 0 || addr.Compare(p.last) > 0 {
+			continue
+		}
+		block := netip.PrefixFrom(addr, p.BlockPrefix).Masked()
+		taken[block.Addr()] = true
+	}
+	return taken
+}
+
+// fits reports whether the whole block is inside the pool
+func (p Pool) fits(block netip.Prefix) bool {
+	return block.Addr().IsValid() &&
+		block.Addr().Compare(p.first) >= 0 &&
+		lastAddr(block).Compare(p.last) <= 0
+}
+
+// IPAM hands out tunnel subnets and wireguard ports
+type IPAM struct {
+	db      *gorm.DB
+	config  *config.Config
+	sources []AddressSource
+	// allocLock is shared with every copy from WithDB
+	allocLock *sync.Mutex
+}
+
+func New(db *gorm.DB, config *config.Config, sources ...AddressSource) *IPAM {
+	return &IPAM{
+		db:        db,
+		config:    config,
+		sources:   sources,
+		allocLock: &sync.Mutex{},
+	}
+}
+
+// WithDB returns a copy of the IPAM that allocates against db, such as a
+// transaction creating several tunnels at once
+func (i *IPAM) WithDB(db *gorm.DB) *IPAM {
+	return &IPAM{
+		db:        db,
+		config:    i.config,
+		sources:   i.sources,
+		allocLock: i.allocLock,
+	}
+}
+
+// Transaction runs fn in a database transaction with an IPAM allocating
+// against it. Transactions run one at a time, so tunnels created at the same
+// time can't be handed the same subnet or port.
+func (i *IPAM) Transaction(fn func(tx *gorm.DB, allocator *IPAM) error) error {
+	i.allocLock.Lock()
+	defer i.allocLock.Unlock()
+	return i.db.Transaction(func(tx *gorm.DB) error {
+		return fn(tx, i.WithDB(tx))
+	})
+}
+
+// NextSubnet returns the first free subnet across the configured pools.
+// The server side of a tunnel uses the first address of the subnet and
+// the client side the one after it.
+func (i *IPAM) NextSubnet() (netip.Prefix, error) {
+	pools, err := Pools(i.config)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	used, err := i.usedAddresses()
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	for _, pool := range pools {
+		block, ok := pool.Allocate(used)
+		if ok {
+			return block, nil
+		}
+	}
+	return netip.Prefix{}, ErrPoolsExhausted
+}
+
+// Usage reports the usage of every configured pool
+func (i *IPAM) Usage() ([]PoolUsage, error) {
+	pools, err := Pools(i.config)
+	if err != nil {
+		return nil, err
+	}
+	used, err := i.usedAddresses()
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]PoolUsage, 0, len(pools))
+	for _, pool := range pools {
+		usage = append(usage, pool.Usage(used))
+	}
+	return usage, nil
+}
+
+// NextPort returns the lowest port from the starting port that no tunnel
+// has been given and that nothing else on the host is listening on
+func (i *IPAM) NextPort() (uint16, error) {
+	ports, err := models.ListDedicatedWireguardPorts(i.db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list tunnel ports: %w", err)
+	}
+
+	taken := make(map[uint16]bool, len(ports)+1)
+	for _, port := range ports {
+		taken[port] = true
+	}
+	if i.config.Wireguard.SharedInterface {
+		taken[i.config.Wireguard.SharedPort] = true
+	}
+
+	for port := int(i.config.Wireguard.StartingPort); port <= maxPort; port++ {
+		//nolint:gosec
+		if taken[uint16(port)] || !utils.UDPPortFree(port) {
+			continue
+		}
+		//nolint:gosec
+		return uint16(port), nil
+	}
+	return 0, ErrPortsExhausted
+}
+
+// SubnetFree reports whether neither side of a tunnel starting at addr is in use
+func (i *IPAM) SubnetFree(addr netip.Addr) (bool, error) {
+	used, err := i.usedAddresses()
+	if err != nil {
+		return false, err
+	}
+	return !slices.Contains(used, addr) && !slices.Contains(used, addr.Next()), nil
+}
+
+// PortFree reports whether no tunnel has been given the port and nothing else on the host is listening on it
+func (i *IPAM) PortFree(port uint16) (bool, error) {
+	ports, err := models.ListDedicatedWireguardPorts(i.db)
+	if err != nil {
+		return false, fmt.Errorf("failed to list tunnel ports: %w", err)
+	}
+	if slices.Contains(ports, port) || (i.config.Wireguard.SharedInterface && port == i.config.Wireguard.SharedPort) {
+		return false, nil
+	}
+	return utils.UDPPortFree(int(port)), nil
+}
+
+// usedAddresses lists both sides of every tunnel along with every address
+// known to the routing daemons, so new subnets never shadow a mesh host
+func (i *IPAM) usedAddresses() ([]netip.Addr, error) {
+	ips, err := models.ListTunnelIPs(i.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel IPs: %w", err)
+	}
+
+	used := make([]netip.Addr, 0, 2*len(ips))
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !addr.Is4() {
+			continue
+		}
+		used = append(used, addr, addr.Next())
+	}
+
+	if addr, err := netip.ParseAddr(i.config.NodeIP); err == nil {
+		used = append(used, addr)
+	}
+
+	for _, source := range i.sources {
+		for _, ip := range source.Addresses() {
+			addr, ok := netip.AddrFromSlice(ip.To4())
+			if ok {
+				used = append(used, addr)
+			}
+		}
+	}
+
+	return used, nil
+}
+
+func nextBlock(block netip.Prefix) netip.Addr {
+	return lastAddr(block).Next()
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	n := addrToUint(prefix.Masked().Addr()) | (uint64(1)<<(32-prefix.Bits()) - 1)
+	return uintToAddr(n)
+}
+
+func addrToUint(addr netip.Addr) uint64 {
+	b := addr.As4()
+	return uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])
+}
+
+func uintToAddr(n uint64) netip.Addr {
+	//nolint:gosec
+	return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+}
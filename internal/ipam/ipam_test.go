@@ -0,0 +1,153 @@
+package ipam_test
+
+import (
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/ipam"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func addrs(t *testing.T, ss ...string) []netip.Addr {
+	t.Helper()
+	ret := make([]netip.Addr, 0, len(ss))
+	for _, s := range ss {
+		ret = append(ret, netip.MustParseAddr(s))
+	}
+	return ret
+}
+
+func TestAllocateReusesGaps(t *testing.T) {
+	t.Parallel()
+
+	pool := ipam.NewPool(netip.MustParsePrefix("10.54.0.0/24"), 30)
+
+	tests := []struct {
+		name string
+		used []netip.Addr
+		want string
+		ok   bool
+	}{
+		{"empty", nil, "10.54.0.0/30", true},
+		{"next", addrs(t, "10.54.0.0", "10.54.0.1"), "10.54.0.4/30", true},
+		{"gap", addrs(t, "10.54.0.0", "10.54.0.1", "10.54.0.8", "10.54.0.9"), "10.54.0.4/30", true},
+		{"host collision", addrs(t, "10.54.0.0", "10.54.0.6"), "10.54.0.8/30", true},
+		{"outside pool", addrs(t, "10.55.0.0"), "10.54.0.0/30", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := pool.Allocate(tt.used)
+			if ok != tt.ok {
+				t.Fatalf("Allocate() ok = %v, want %v", ok, tt.ok)
+			}
+			if got.String() != tt.want {
+				t.Errorf("Allocate() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	t.Parallel()
+
+	pool := ipam.NewPool(netip.MustParsePrefix("10.54.0.0/30"), 31)
+	_, ok := pool.Allocate(addrs(t, "10.54.0.0", "10.54.0.2"))
+	if ok {
+		t.Error("expected a full pool to fail allocation")
+	}
+
+	usage := pool.Usage(addrs(t, "10.54.0.0"))
+	if usage.Total != 2 || usage.Used != 1 || usage.Free != 1 {
+		t.Errorf("Usage() = %+v, want 2 total, 1 used, 1 free", usage)
+	}
+}
+
+func TestLegacyPool(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{}
+	cfg.Wireguard.StartingAddress = "172.31.0.12"
+	cfg.Wireguard.BlockPrefix = 30
+
+	pools, err := ipam.Pools(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("Pools() returned %d pools, want 1", len(pools))
+	}
+
+	got, ok := pools[0].Allocate(nil)
+	if !ok || got.String() != "172.31.0.16/30" {
+		t.Errorf("Allocate() = %s, want 172.31.0.16/30", got)
+	}
+
+	usage := pools[0].Usage(nil)
+	if usage.Last != "172.31.253.255" {
+		t.Errorf("Usage().Last = %s, want 172.31.253.255", usage.Last)
+	}
+}
+
+func TestTransactionConcurrentAllocations(t *testing.T) {
+	t.Parallel()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.Tunnel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Wireguard.Pools = []string{"10.54.0.0/24"}
+	cfg.Wireguard.BlockPrefix = 30
+	allocator := ipam.New(db, cfg)
+
+	const creates = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, creates)
+	for range creates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- allocator.Transaction(func(tx *gorm.DB, allocator *ipam.IPAM) error {
+				subnet, err := allocator.NextSubnet()
+				if err != nil {
+					return err
+				}
+				return tx.Create(&models.Tunnel{Hostname: "TEST", IP: subnet.Addr().String(), Wireguard: true}).Error
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ips, err := models.ListTunnelIPs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		if seen[ip] {
+			t.Errorf("%s was allocated twice", ip)
+		}
+		seen[ip] = true
+	}
+	if len(seen) != creates {
+		t.Errorf("got %d distinct tunnel IPs, want %d", len(seen), creates)
+	}
+}
@@ -0,0 +1,272 @@
+package quota
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/events"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/services"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/babel"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/olsr"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+	"gorm.io/gorm"
+)
+
+const percent = 100
+
+// Enforcer rolls tunnels over into a new quota period on their reset day and
+// acts on tunnels that cross their quota
+type Enforcer struct {
+	config          *config.Config
+	db              *gorm.DB
+	wireguard       *wireguard.Manager
+	serviceRegistry *services.Registry
+	eventsChannel   chan events.Event
+	stopChan        chan struct{}
+}
+
+func NewEnforcer(config *config.Config, db *gorm.DB, wireguardManager *wireguard.Manager, serviceRegistry *services.Registry, eventsChannel chan events.Event) *Enforcer {
+	return &Enforcer{
+		config:          config,
+		db:              db,
+		wireguard:       wireguardManager,
+		serviceRegistry: serviceRegistry,
+		eventsChannel:   eventsChannel,
+		stopChan:        make(chan struct{}),
+	}
+}
+
+func (e *Enforcer) Start() {
+	go e.loop(time.Duration(e.config.Quotas.CheckInterval) * time.Second)
+}
+
+func (e *Enforcer) Stop() {
+	close(e.stopChan)
+}
+
+func (e *Enforcer) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	e.check(time.Now())
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ticker.C:
+			e.check(time.Now())
+		}
+	}
+}
+
+// PeriodStart returns the start of the quota period that now falls in
+func PeriodStart(now time.Time, resetDay int) time.Time {
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// CrossedThreshold returns the highest warning threshold the usage has reached
+// beyond the one already warned about, or 0 if there is none
+func CrossedThreshold(usedPercent int, warnedPercent int, thresholds []int) int {
+	crossed := 0
+	for _, threshold := range thresholds {
+		if threshold > warnedPercent && threshold <= usedPercent && threshold > crossed {
+			crossed = threshold
+		}
+	}
+	return crossed
+}
+
+func (e *Enforcer) check(now time.Time) {
+	tunnels, err := models.ListAllTunnels(e.db)
+	if err != nil {
+		slog.Error("failed to list tunnels for quota check", "error", err)
+		return
+	}
+
+	for i := range tunnels {
+		tunnel := &tunnels[i]
+
+		start := PeriodStart(now, tunnel.Quota.ResolveResetDay(e.config.Quotas))
+		if tunnel.PeriodStart.Before(start) {
+			err = e.startPeriod(tunnel, start)
+			if err != nil {
+				slog.Error("failed to start quota period", "tunnel", tunnel.Hostname, "error", err)
+				continue
+			}
+		}
+
+		if tunnel.Quota.LimitMB <= 0 {
+			continue
+		}
+		err = e.enforce(tunnel)
+		if err != nil {
+			slog.Error("failed to enforce tunnel quota", "tunnel", tunnel.Hostname, "error", err)
+		}
+	}
+}
+
+// startPeriod archives the finished period and lifts any action taken against the tunnel during it
+func (e *Enforcer) startPeriod(tunnel *models.Tunnel, start time.Time) error {
+	first := tunnel.PeriodStart.IsZero()
+	wasExceeded := tunnel.QuotaExceeded
+
+	err := models.StartQuotaPeriod(e.db, tunnel, start)
+	if err != nil {
+		return err
+	}
+	if first {
+		return nil
+	}
+
+	slog.Info("tunnel quota period reset", "tunnel", tunnel.Hostname)
+	e.emit(events.EventTypeQuotaReset, tunnel)
+
+	if !wasExceeded {
+		return nil
+	}
+	switch tunnel.Quota.Action {
+	case models.QuotaActionThrottle:
+		// The quota is no longer exceeded, so the effective rate limit is back to normal
+		return e.wireguard.UpdateRateLimit(*tunnel)
+	case models.QuotaActionDisable:
+		if !tunnel.Enabled {
+			return e.setEnabled(tunnel, true)
+		}
+	case models.QuotaActionWarn:
+	}
+	return nil
+}
+
+func (e *Enforcer) enforce(tunnel *models.Tunnel) error {
+	used := tunnel.PeriodUsedMB()
+	usedPercent := int(used / tunnel.Quota.LimitMB * percent)
+
+	if usedPercent >= percent {
+		if tunnel.QuotaExceeded {
+			return nil
+		}
+		tunnel.QuotaExceeded = true
+		tunnel.QuotaWarnedPercent = percent
+		err := e.db.Model(tunnel).Select("quota_exceeded", "quota_warned_percent").Updates(tunnel).Error
+		if err != nil {
+			return err
+		}
+
+		slog.Warn("tunnel exceeded its traffic quota", "tunnel", tunnel.Hostname, "used_mb", used, "limit_mb", tunnel.Quota.LimitMB, "action", tunnel.Quota.Action)
+		e.emit(events.EventTypeQuotaExceeded, tunnel)
+
+		switch tunnel.Quota.Action {
+		case models.QuotaActionThrottle:
+			return e.wireguard.UpdateRateLimit(*tunnel)
+		case models.QuotaActionDisable:
+			if tunnel.Enabled {
+				return e.setEnabled(tunnel, false)
+			}
+		case models.QuotaActionWarn:
+		}
+		return nil
+	}
+
+	threshold := CrossedThreshold(usedPercent, tunnel.QuotaWarnedPercent, e.config.Quotas.WarnThresholds)
+	if threshold == 0 {
+		return nil
+	}
+	tunnel.QuotaWarnedPercent = threshold
+	err := e.db.Model(tunnel).Select("quota_warned_percent").Updates(tunnel).Error
+	if err != nil {
+		return err
+	}
+	slog.Warn("tunnel is nearing its traffic quota", "tunnel", tunnel.Hostname, "percent", threshold, "used_mb", used, "limit_mb", tunnel.Quota.LimitMB)
+	e.emit(events.EventTypeQuotaWarning, tunnel)
+	return nil
+}
+
+// setEnabled takes a tunnel down or brings it back up and updates the routing daemons to match
+func (e *Enforcer) setEnabled(tunnel *models.Tunnel, enabled bool) error {
+	tunnel.Enabled = enabled
+	err := e.db.Model(tunnel).Select("enabled").Updates(tunnel).Error
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		err = e.wireguard.AddPeer(*tunnel)
+	} else {
+		err = e.wireguard.RemovePeer(*tunnel)
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.config.OLSR {
+		err = olsr.GenerateAndSave(e.config, e.db)
+		if err != nil {
+			return fmt.Errorf("failed to generate olsrd config: %w", err)
+		}
+		olsrService, ok := e.serviceRegistry.Get(services.OLSRServiceName)
+		if ok {
+			err = olsrService.Reload()
+			if err != nil {
+				return fmt.Errorf("failed to reload olsrd: %w", err)
+			}
+		}
+	}
+
+	if e.config.Babel.Enabled {
+		return e.updateBabel(tunnel)
+	}
+	return nil
+}
+
+func (e *Enforcer) updateBabel(tunnel *models.Tunnel) error {
+	babelServiceIface, ok := e.serviceRegistry.Get(services.BabelServiceName)
+	if !ok {
+		return nil
+	}
+	babelService, ok := babelServiceIface.(*babel.Service)
+	if !ok {
+		return fmt.Errorf("babel service has the wrong type")
+	}
+
+	iface := wireguard.GenerateWireguardInterfaceName(*tunnel)
+	if tunnel.Enabled {
+		return babelService.AddTunnel(iface, babel.InterfaceTuning(e.config, *tunnel))
+	}
+
+	// The shared interface stays up while it has other peers
+	if tunnel.SharedInterface {
+		remaining, err := models.CountSharedInterfaceTunnels(e.db)
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return nil
+		}
+	}
+	return babelService.RemoveTunnel(iface)
+}
+
+func (e *Enforcer) emit(eventType events.EventType, tunnel *models.Tunnel) {
+	usedPercent := 0
+	if tunnel.Quota.LimitMB > 0 {
+		usedPercent = int(tunnel.PeriodUsedMB() / tunnel.Quota.LimitMB * percent)
+	}
+	e.eventsChannel <- events.Event{
+		Type: eventType,
+		Data: apimodels.WebsocketTunnelQuota{
+			ID:       tunnel.ID,
+			Hostname: tunnel.Hostname,
+			UsedMB:   tunnel.PeriodUsedMB(),
+			LimitMB:  tunnel.Quota.LimitMB,
+			Percent:  usedPercent,
+			Action:   string(tunnel.Quota.Action),
+		},
+	}
+}
@@ -0,0 +1,62 @@
+package quota_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/quota"
+)
+
+func TestPeriodStart(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{"after reset day", time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC), 15, time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"on reset day", time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC), 15, time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"before reset day", time.Date(2025, 3, 14, 23, 59, 0, 0, time.UTC), 15, time.Date(2025, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"across the year", time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), 28, time.Date(2024, 12, 28, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := quota.PeriodStart(tt.now, tt.resetDay)
+			if !got.Equal(tt.want) {
+				t.Errorf("PeriodStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrossedThreshold(t *testing.T) {
+	t.Parallel()
+
+	thresholds := []int{80, 90}
+	tests := []struct {
+		name   string
+		used   int
+		warned int
+		want   int
+	}{
+		{"below", 50, 0, 0},
+		{"first", 85, 0, 80},
+		{"already warned", 85, 80, 0},
+		{"skips to highest", 95, 0, 90},
+		{"next", 91, 80, 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := quota.CrossedThreshold(tt.used, tt.warned, thresholds)
+			if got != tt.want {
+				t.Errorf("CrossedThreshold() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
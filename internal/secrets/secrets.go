@@ -0,0 +1,254 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+)
+
+// KeyLength is the length in bytes of a master key and of the per-value data keys
+const KeyLength = 32
+
+// Encrypted values look like enc:v1:<key id>:<wrapped data key>:<ciphertext>
+const (
+	prefix     = "enc:v1:"
+	partsCount = 3
+)
+
+var (
+	ErrKeyLength   = errors.New("master key must be 32 bytes")
+	ErrNoKey       = errors.New("value is encrypted but no master key is configured")
+	ErrWrongKey    = errors.New("value was encrypted under a different master key")
+	ErrMalformed   = errors.New("encrypted value is malformed")
+	ErrKeyConflict = errors.New("only one of the master key and master key file may be set")
+)
+
+// Keyring holds the master key used to wrap the data key of each encrypted value
+type Keyring struct {
+	key []byte
+	id  string
+}
+
+// NewKeyring creates a keyring from a raw master key
+func NewKeyring(key []byte) (*Keyring, error) {
+	if len(key) != KeyLength {
+		return nil, ErrKeyLength
+	}
+	sum := sha256.Sum256(key)
+	return &Keyring{
+		key: key,
+		id:  hex.EncodeToString(sum[:4]),
+	}, nil
+}
+
+// ParseKeyring creates a keyring from a base64 encoded master key
+func ParseKeyring(encoded string) (*Keyring, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode master key: %w", err)
+	}
+	return NewKeyring(key)
+}
+
+// ReadKeyring creates a keyring from a file containing a base64 encoded master key
+func ReadKeyring(path string) (*Keyring, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	return ParseKeyring(string(encoded))
+}
+
+// LoadKeyring returns the keyring configured in the secrets settings, or nil
+// if no master key is configured and secrets are stored in plaintext
+func LoadKeyring(cfg config.Secrets) (*Keyring, error) {
+	switch {
+	case cfg.Key != "" && cfg.KeyFile != "":
+		return nil, ErrKeyConflict
+	case cfg.Key != "":
+		return ParseKeyring(cfg.Key)
+	case cfg.KeyFile != "":
+		return ReadKeyring(cfg.KeyFile)
+	default:
+		return nil, nil
+	}
+}
+
+// GenerateKey returns a new random base64 encoded master key
+func GenerateKey() (string, error) {
+	key := make([]byte, KeyLength)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate master key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ID identifies the master key without revealing it
+func (k *Keyring) ID() string {
+	return k.id
+}
+
+// IsEncrypted reports whether a stored value is encrypted
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt seals a value under a fresh data key, which is in turn sealed under
+// the master key. Empty values and a nil keyring leave the value untouched.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if k == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, KeyLength)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return k.wrap(dataKey, ciphertext)
+}
+
+// Decrypt opens an encrypted value. Plaintext values are returned as they are,
+// so rows written before encryption was enabled still read correctly.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap moves a value from this keyring to another. Only the data key is
+// re-encrypted, the value itself is untouched. Plaintext values are encrypted.
+func (k *Keyring) Rewrap(value string, to *Keyring) (string, error) {
+	if !IsEncrypted(value) {
+		return to.Encrypt(value)
+	}
+	// Already moved, as when a rekey is run twice
+	if to != nil && strings.HasPrefix(value, prefix+to.id+":") {
+		return value, nil
+	}
+
+	dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	if to == nil {
+		plaintext, err := open(dataKey, ciphertext)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	}
+
+	return to.wrap(dataKey, ciphertext)
+}
+
+func (k *Keyring) wrap(dataKey, ciphertext []byte) (string, error) {
+	wrappedKey, err := seal(k.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + k.id + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (k *Keyring) unwrap(value string) (dataKey []byte, ciphertext []byte, err error) {
+	if k == nil {
+		return nil, nil, ErrNoKey
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != partsCount {
+		return nil, nil, ErrMalformed
+	}
+	if parts[0] != k.id {
+		return nil, nil, ErrWrongKey
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	ciphertext, err = base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+
+	dataKey, err = open(k.key, wrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, ciphertext, nil
+}
+
+// seal encrypts with AES-256-GCM, prepending the nonce to the ciphertext
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return gcm, nil
+}
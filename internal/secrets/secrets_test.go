@@ -0,0 +1,99 @@
+package secrets_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/secrets"
+)
+
+func newKeyring(t *testing.T) *secrets.Keyring {
+	t.Helper()
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := secrets.ParseKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+	keyring := newKeyring(t)
+
+	encrypted, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.IsEncrypted(encrypted) {
+		t.Fatalf("expected %q to be encrypted", encrypted)
+	}
+
+	decrypted, err := keyring.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret" {
+		t.Errorf("got %q, want %q", decrypted, "secret")
+	}
+
+	plaintext, err := keyring.Decrypt("plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "plaintext" {
+		t.Errorf("got %q, want %q", plaintext, "plaintext")
+	}
+
+	_, err = newKeyring(t).Decrypt(encrypted)
+	if !errors.Is(err, secrets.ErrWrongKey) {
+		t.Errorf("got %v, want %v", err, secrets.ErrWrongKey)
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	t.Parallel()
+	from := newKeyring(t)
+	to := newKeyring(t)
+
+	encrypted, err := from.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := from.Rewrap(encrypted, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := to.Decrypt(rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret" {
+		t.Errorf("got %q, want %q", decrypted, "secret")
+	}
+
+	again, err := from.Rewrap(rewrapped, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != rewrapped {
+		t.Error("expected an already rewrapped value to be left alone")
+	}
+
+	var none *secrets.Keyring
+	encrypted, err = none.Rewrap("plaintext", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err = to.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "plaintext" {
+		t.Errorf("got %q, want %q", decrypted, "plaintext")
+	}
+}
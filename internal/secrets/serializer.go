@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+// SerializerName is the gorm serializer tag for encrypted columns, as in gorm:"serializer:secret"
+const SerializerName = "secret"
+
+// Serializer encrypts string fields on the way into the database and decrypts them on the way out
+type Serializer struct {
+	keyring *Keyring
+}
+
+// Models with secret fields can be parsed before the database is opened, as
+// they are to find the tunnel sort columns, so the serializer is installed
+// without a keyring until Register is called with one.
+//
+//nolint:gochecknoinits
+func init() {
+	Register(nil)
+}
+
+// Register installs the serializer for the given keyring. It must be called
+// before any model with a secret field is used. A nil keyring stores new
+// values in plaintext but still refuses to silently drop encrypted ones.
+func Register(keyring *Keyring) {
+	schema.RegisterSerializer(SerializerName, Serializer{keyring: keyring})
+}
+
+// Scan implements the gorm serializer interface
+func (s Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("unsupported type %T for secret field %s", dbValue, field.Name)
+	}
+
+	plaintext, err := s.keyring.Decrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", field.Name, err)
+	}
+
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+// Value implements the gorm serializer interface
+func (s Serializer) Value(_ context.Context, field *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("unsupported type %T for secret field %s", fieldValue, field.Name)
+	}
+	return s.keyring.Encrypt(value)
+}
@@ -33,3 +33,28 @@ type OlsrdLinkinfo struct {
 	RemoteIP            string  `json:"remoteIP"`
 	InterfaceName       string  `json:"ifName"`
 }
+
+type OlsrdHNA struct {
+	HNA []OlsrdHNAEntry `json:"hna"`
+}
+
+type OlsrdHNAEntry struct {
+	Gateway      string `json:"gateway"`
+	Destination  string `json:"destination"`
+	Genmask      int    `json:"genmask"`
+	ValidityTime uint64 `json:"validityTime"`
+}
+
+type OlsrdMID struct {
+	MID []OlsrdMIDEntry `json:"mid"`
+}
+
+type OlsrdMIDEntry struct {
+	Main    OlsrdMIDAddress   `json:"main"`
+	Aliases []OlsrdMIDAddress `json:"aliases"`
+}
+
+type OlsrdMIDAddress struct {
+	IPAddress    string `json:"ipAddress"`
+	ValidityTime uint64 `json:"validityTime"`
+}
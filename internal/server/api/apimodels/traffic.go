@@ -0,0 +1,79 @@
+package apimodels
+
+import (
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+// MaxTrafficPoints caps how many buckets a traffic history request can return
+const MaxTrafficPoints = 2000
+
+const (
+	maxMinuteStepRange = 6 * time.Hour
+	maxHourStepRange   = 7 * 24 * time.Hour
+)
+
+type TrafficPoint struct {
+	Time          time.Time `json:"time"`
+	RXBytes       uint64    `json:"rx_bytes"`
+	TXBytes       uint64    `json:"tx_bytes"`
+	RXBytesPerSec uint64    `json:"rx_bytes_per_sec"`
+	TXBytesPerSec uint64    `json:"tx_bytes_per_sec"`
+}
+
+type TrafficHistory struct {
+	Step    models.TrafficResolution `json:"step"`
+	From    time.Time                `json:"from"`
+	To      time.Time                `json:"to"`
+	Samples []TrafficPoint           `json:"samples"`
+}
+
+// TrafficStep picks the finest resolution that keeps a range readable
+func TrafficStep(from time.Time, to time.Time) models.TrafficResolution {
+	switch span := to.Sub(from); {
+	case span <= maxMinuteStepRange:
+		return models.TrafficMinute
+	case span <= maxHourStepRange:
+		return models.TrafficHour
+	default:
+		return models.TrafficDay
+	}
+}
+
+// TrafficPointCount is the number of buckets of a step between two times
+func TrafficPointCount(from time.Time, to time.Time, step models.TrafficResolution) int {
+	if !to.After(from) {
+		return 0
+	}
+	return int(step.Bucket(to.Add(-time.Nanosecond)).Sub(step.Bucket(from))/step.Duration()) + 1
+}
+
+// NewTrafficHistory lays the stored samples out over every bucket between
+// from and to, filling buckets with no traffic with zeros
+func NewTrafficHistory(samples []models.TrafficSample, from time.Time, to time.Time, step models.TrafficResolution) TrafficHistory {
+	stored := make(map[time.Time]models.TrafficSample, len(samples))
+	for _, sample := range samples {
+		stored[sample.BucketStart.UTC()] = sample
+	}
+
+	seconds := uint64(step.Duration() / time.Second)
+	points := make([]TrafficPoint, 0, TrafficPointCount(from, to, step))
+	for bucket := step.Bucket(from); bucket.Before(to); bucket = bucket.Add(step.Duration()) {
+		sample := stored[bucket]
+		points = append(points, TrafficPoint{
+			Time:          bucket,
+			RXBytes:       sample.RXBytes,
+			TXBytes:       sample.TXBytes,
+			RXBytesPerSec: sample.RXBytes / seconds,
+			TXBytesPerSec: sample.TXBytes / seconds,
+		})
+	}
+
+	return TrafficHistory{
+		Step:    step,
+		From:    from.UTC(),
+		To:      to.UTC(),
+		Samples: points,
+	}
+}
@@ -0,0 +1,68 @@
+package apimodels_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+)
+
+func TestTrafficStep(t *testing.T) {
+	t.Parallel()
+
+	to := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		span time.Duration
+		want models.TrafficResolution
+	}{
+		{"an hour", time.Hour, models.TrafficMinute},
+		{"six hours", 6 * time.Hour, models.TrafficMinute},
+		{"a day", 24 * time.Hour, models.TrafficHour},
+		{"a week", 7 * 24 * time.Hour, models.TrafficHour},
+		{"a month", 30 * 24 * time.Hour, models.TrafficDay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := apimodels.TrafficStep(to.Add(-tt.span), to)
+			if got != tt.want {
+				t.Errorf("TrafficStep() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTrafficHistory(t *testing.T) {
+	t.Parallel()
+
+	from := time.Date(2025, 3, 20, 12, 0, 30, 0, time.UTC)
+	to := time.Date(2025, 3, 20, 12, 3, 0, 0, time.UTC)
+	samples := []models.TrafficSample{{
+		TunnelID:    1,
+		Resolution:  models.TrafficMinute,
+		BucketStart: time.Date(2025, 3, 20, 12, 1, 0, 0, time.UTC),
+		RXBytes:     600,
+		TXBytes:     120,
+	}}
+
+	history := apimodels.NewTrafficHistory(samples, from, to, models.TrafficMinute)
+	if len(history.Samples) != 3 {
+		t.Fatalf("got %d samples, want 3", len(history.Samples))
+	}
+	if count := apimodels.TrafficPointCount(from, to, models.TrafficMinute); count != len(history.Samples) {
+		t.Errorf("TrafficPointCount() = %d, want %d", count, len(history.Samples))
+	}
+	if !history.Samples[0].Time.Equal(time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("first bucket starts at %s", history.Samples[0].Time)
+	}
+	if history.Samples[0].RXBytes != 0 || history.Samples[2].TXBytes != 0 {
+		t.Errorf("empty buckets were not zero filled")
+	}
+	got := history.Samples[1]
+	if got.RXBytes != 600 || got.TXBytes != 120 || got.RXBytesPerSec != 10 || got.TXBytesPerSec != 2 {
+		t.Errorf("stored bucket = %+v", got)
+	}
+}
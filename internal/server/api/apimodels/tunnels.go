@@ -1,8 +1,13 @@
 package apimodels
 
 import (
+	"net"
+	"net/url"
 	"regexp"
 	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
 )
 
 const minHostnameLength = 3
@@ -14,6 +19,24 @@ type CreateTunnel struct {
 	Password  string `json:"password"`
 	IP        string `json:"ip"`
 	Client    bool   `json:"client"`
+	// FallbackEndpoints are extra host:port endpoints for client tunnels
+	FallbackEndpoints []string `json:"fallback_endpoints"`
+	// PresharedKey overrides whether a server tunnel is created with a preshared key
+	PresharedKey *bool `json:"preshared_key"`
+	// Tuning overrides the configured link tuning
+	Tuning *models.TunnelTuning `json:"tuning"`
+	// RateLimit caps the tunnel bandwidth, unlimited if unset
+	RateLimit models.TunnelRateLimit `json:"rate_limit"`
+	// Quota caps the tunnel traffic each period, unlimited if unset
+	Quota models.TunnelQuota `json:"quota"`
+	// FirewallPolicy limits what the peer can reach, allow-all if unset
+	FirewallPolicy models.FirewallPolicy `json:"firewall_policy"`
+	FirewallRules  []models.FirewallRule `json:"firewall_rules"`
+	// Callsign, Contact, Notes and Tags record who owns the tunnel
+	Callsign string   `json:"callsign"`
+	Contact  string   `json:"contact"`
+	Notes    string   `json:"notes"`
+	Tags     []string `json:"tags"`
 }
 
 func (r *CreateTunnel) IsValidHostname() (bool, string) {
@@ -29,18 +52,114 @@ func (r *CreateTunnel) IsValidHostname() (bool, string) {
 	return true, ""
 }
 
+func (r *CreateTunnel) IsValidFallbackEndpoints() (bool, string) {
+	return isValidFallbackEndpoints(r.FallbackEndpoints)
+}
+
+func isValidFallbackEndpoints(endpoints []string) (bool, string) {
+	for _, endpoint := range endpoints {
+		// IPv6 addresses must be bracketed, as in [2001:db8::1]:5527
+		host, _, err := utils.SplitHostPort(endpoint)
+		if err != nil {
+			return false, "Fallback endpoint must be an address and port"
+		}
+		if net.ParseIP(host) == nil {
+			_, err := url.ParseRequestURI("http://" + host)
+			if err != nil {
+				return false, "Fallback endpoint address is invalid"
+			}
+		}
+	}
+	return true, ""
+}
+
+type RotateTunnelKeys struct {
+	// WindowHours is how long the remote operator has to install the new keys
+	WindowHours *int `json:"window_hours"`
+	// Tags limits a rotation of every tunnel to those with all of the tags
+	Tags []string `json:"tags"`
+}
+
 type TunnelWithPass struct {
-	ID             uint      `json:"id"`
-	Enabled        bool      `json:"enabled"`
-	Wireguard      bool      `json:"wireguard"`
-	WireguardPort  uint16    `json:"wireguard_port"`
-	Client         bool      `json:"client"`
-	Hostname       string    `json:"hostname"`
-	IP             string    `json:"ip"`
-	Password       string    `json:"password"`
-	Active         bool      `json:"active"`
-	ConnectionTime time.Time `json:"connection_time"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID                uint      `json:"id"`
+	Enabled           bool      `json:"enabled"`
+	Wireguard         bool      `json:"wireguard"`
+	WireguardPort     uint16    `json:"wireguard_port"`
+	Client            bool      `json:"client"`
+	Hostname          string    `json:"hostname"`
+	IP                string    `json:"ip"`
+	Password          string    `json:"password"`
+	Active            bool      `json:"active"`
+	ConnectionTime    time.Time `json:"connection_time"`
+	CreatedAt         time.Time `json:"created_at"`
+	FallbackEndpoints []string  `json:"fallback_endpoints"`
+	// PendingPassword is the rotated credential waiting to be installed by the remote operator
+	PendingPassword     string                 `json:"pending_password,omitempty"`
+	KeyRotationDeadline *time.Time             `json:"key_rotation_deadline"`
+	KeysRotatedAt       time.Time              `json:"keys_rotated_at"`
+	Tuning              models.TunnelTuning    `json:"tuning"`
+	RateLimit           models.TunnelRateLimit `json:"rate_limit"`
+	Quota               models.TunnelQuota     `json:"quota"`
+	PeriodStart         time.Time              `json:"period_start"`
+	PeriodRXMB          float64                `json:"period_rx_mb"`
+	PeriodTXMB          float64                `json:"period_tx_mb"`
+	QuotaExceeded       bool                   `json:"quota_exceeded"`
+	FirewallPolicy      models.FirewallPolicy  `json:"firewall_policy"`
+	FirewallRules       []models.FirewallRule  `json:"firewall_rules"`
+	Flaps               int                    `json:"flaps"`
+	FlapSuppressed      bool                   `json:"flap_suppressed"`
+	Callsign            string                 `json:"callsign"`
+	Contact             string                 `json:"contact"`
+	Notes               string                 `json:"notes"`
+	Tags                []string               `json:"tags"`
+}
+
+// NewTunnelWithPass returns the admin view of a tunnel. The credentials are
+// only included for server tunnels, where we hand them to the remote operator.
+func NewTunnelWithPass(tunnel models.Tunnel) TunnelWithPass {
+	password := ""
+	pendingPassword := ""
+	if !tunnel.Client {
+		password = tunnel.Password
+		if tunnel.Wireguard {
+			password = tunnel.WireguardCredential().String()
+		}
+		if pending, ok := tunnel.PendingWireguardCredential(); ok {
+			pendingPassword = pending.String()
+		}
+	}
+	return TunnelWithPass{
+		Enabled:             tunnel.Enabled,
+		Wireguard:           tunnel.Wireguard,
+		WireguardPort:       tunnel.WireguardPort,
+		ID:                  tunnel.ID,
+		Hostname:            tunnel.Hostname,
+		IP:                  tunnel.IP,
+		Password:            password,
+		Client:              tunnel.Client,
+		Active:              tunnel.Active,
+		ConnectionTime:      tunnel.ConnectionTime,
+		CreatedAt:           tunnel.CreatedAt,
+		FallbackEndpoints:   tunnel.FallbackEndpoints,
+		PendingPassword:     pendingPassword,
+		KeyRotationDeadline: tunnel.KeyRotationDeadline,
+		KeysRotatedAt:       tunnel.KeysRotatedAt,
+		Tuning:              tunnel.Tuning,
+		RateLimit:           tunnel.RateLimit,
+		Quota:               tunnel.Quota,
+		PeriodStart:         tunnel.PeriodStart,
+		PeriodRXMB:          tunnel.PeriodRXMB,
+		PeriodTXMB:          tunnel.PeriodTXMB,
+		QuotaExceeded:       tunnel.QuotaExceeded,
+		FirewallPolicy:      tunnel.FirewallPolicy.Effective(),
+		FirewallRules:       tunnel.FirewallRules,
+		Flaps:               tunnel.Flaps,
+		FlapSuppressed:      tunnel.FlapSuppressed,
+		Callsign:            tunnel.Callsign,
+		Contact:             tunnel.Contact,
+		Notes:               tunnel.Notes,
+		Tags:                tunnel.Tags,
+	}
 }
 
 type EditTunnel struct {
@@ -50,4 +169,48 @@ type EditTunnel struct {
 	Hostname  string `json:"hostname" binding:"required"`
 	Password  string `json:"password"`
 	IP        string `json:"ip" binding:"required"`
+	// FallbackEndpoints are extra host:port endpoints for client tunnels
+	FallbackEndpoints []string `json:"fallback_endpoints"`
+	// Tuning replaces the tunnel's link tuning when set
+	Tuning *models.TunnelTuning `json:"tuning"`
+	// RateLimit replaces the tunnel's rate limits when set
+	RateLimit *models.TunnelRateLimit `json:"rate_limit"`
+	// Quota replaces the tunnel's quota when set
+	Quota *models.TunnelQuota `json:"quota"`
+	// FirewallPolicy replaces the tunnel's firewall policy and rules when set
+	FirewallPolicy *models.FirewallPolicy `json:"firewall_policy"`
+	FirewallRules  []models.FirewallRule  `json:"firewall_rules"`
+	// Callsign, Contact and Notes replace the tunnel's when set
+	Callsign *string `json:"callsign"`
+	Contact  *string `json:"contact"`
+	Notes    *string `json:"notes"`
+	// Tags replaces the tunnel's tags when set, an empty list clears them
+	Tags []string `json:"tags"`
+}
+
+func (r *EditTunnel) IsValidFallbackEndpoints() (bool, string) {
+	return isValidFallbackEndpoints(r.FallbackEndpoints)
+}
+
+// TunnelUsage is the traffic of a tunnel in the current quota period
+type TunnelUsage struct {
+	ID          uint      `json:"id"`
+	Hostname    string    `json:"hostname"`
+	PeriodStart time.Time `json:"period_start"`
+	RXMB        float64   `json:"rx_mb"`
+	TXMB        float64   `json:"tx_mb"`
+	LimitMB     float64   `json:"limit_mb"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
+func NewTunnelUsage(tunnel models.Tunnel) TunnelUsage {
+	return TunnelUsage{
+		ID:          tunnel.ID,
+		Hostname:    tunnel.Hostname,
+		PeriodStart: tunnel.PeriodStart,
+		RXMB:        tunnel.PeriodRXMB,
+		TXMB:        tunnel.PeriodTXMB,
+		LimitMB:     tunnel.Quota.LimitMB,
+		Exceeded:    tunnel.QuotaExceeded,
+	}
 }
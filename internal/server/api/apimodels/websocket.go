@@ -32,3 +32,19 @@ type WebsocketTotalTraffic struct {
 	RX float64 `json:"RX"`
 	TX float64 `json:"TX"`
 }
+
+type WebsocketTunnelQuota struct {
+	ID       uint    `json:"id"`
+	Hostname string  `json:"hostname"`
+	UsedMB   float64 `json:"used_mb"`
+	LimitMB  float64 `json:"limit_mb"`
+	Percent  int     `json:"percent"`
+	Action   string  `json:"action"`
+}
+
+type WebsocketTunnelFlapping struct {
+	ID       uint    `json:"id"`
+	Hostname string  `json:"hostname"`
+	Flaps    int     `json:"flaps"`
+	Penalty  float64 `json:"penalty"`
+}
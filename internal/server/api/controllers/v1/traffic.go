@@ -0,0 +1,125 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultTimeRange = 24 * time.Hour
+
+var errTimeRangeInvalid = errors.New("from must be before to")
+
+// GETTunnelTraffic returns a tunnel's traffic history
+func GETTunnelTraffic(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+
+	exists, err := models.TunnelIDExists(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnelTraffic: Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return
+	}
+
+	serveTraffic(c, di, uint(idUint64))
+}
+
+// GETTrafficTotal returns the traffic history of every tunnel together
+func GETTrafficTotal(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	serveTraffic(c, di, models.NodeTrafficID)
+}
+
+func serveTraffic(c *gin.Context, di *middleware.DepInjection, tunnelID uint) {
+	from, to, err := parseTimeRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	step := apimodels.TrafficStep(from, to)
+	if c.Query("step") != "" {
+		step = models.TrafficResolution(c.Query("step"))
+		if step.Duration() == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "step must be minute, hour or day"})
+			return
+		}
+	}
+	if apimodels.TrafficPointCount(from, to, step) > apimodels.MaxTrafficPoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("range is more than %d %ss, use a larger step", apimodels.MaxTrafficPoints, step)})
+		return
+	}
+
+	samples, err := models.ListTrafficSamples(di.DB, tunnelID, step, step.Bucket(from), to)
+	if err != nil {
+		slog.Error("serveTraffic: Error getting traffic history", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting traffic history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, apimodels.NewTrafficHistory(samples, from, to, step))
+}
+
+// parseTimeRange reads from and to as RFC 3339 times or unix seconds,
+// defaulting to the day up to now
+func parseTimeRange(fromQuery string, toQuery string, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toQuery != "" {
+		parsed, err := parseQueryTime(toQuery)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultTimeRange)
+	if fromQuery != "" {
+		parsed, err := parseQueryTime(fromQuery)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errTimeRangeInvalid
+	}
+	return from, to, nil
+}
+
+func parseQueryTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,127 @@
+package v1
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/bulk"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// GETTunnelsExport downloads the wireguard tunnels, credentials included, as
+// JSON or CSV. Repeated tag parameters limit it to tunnels with all of the tags.
+func GETTunnelsExport(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	format, err := bulk.ParseFormat(c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if !format.Exportable() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": bulk.ErrFormatNotExportable.Error()})
+		return
+	}
+
+	tags, err := models.NormalizeTags(c.QueryArray("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tunnels, err := models.ListFilteredWireguardTunnels(di.DB, models.TunnelFilter{Tags: tags})
+	if err != nil {
+		slog.Error("GETTunnelsExport: Error getting tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnels"})
+		return
+	}
+
+	records := make([]bulk.Record, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		records = append(records, bulk.NewRecord(tunnel))
+	}
+
+	var buf bytes.Buffer
+	err = bulk.Encode(&buf, format, records)
+	if err != nil {
+		slog.Error("GETTunnelsExport: Error encoding tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error exporting tunnels"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "tunnels."+string(format)))
+	c.Data(http.StatusOK, format.ContentType(), buf.Bytes())
+}
+
+// POSTTunnelsImport creates tunnels from an export or an AREDN node's backup.
+// The whole file is validated first and nothing is created unless every
+// tunnel in it is valid. With dry_run set, only the report of what would be
+// created is returned.
+func POSTTunnelsImport(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	formatName := c.Query("format")
+	if formatName == "" && strings.HasPrefix(c.ContentType(), bulk.FormatCSV.ContentType()) {
+		formatName = string(bulk.FormatCSV)
+	}
+	format, err := bulk.ParseFormat(formatName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dryRun := false
+	if dryRunStr, exists := c.GetQuery("dry_run"); exists {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+			return
+		}
+	}
+
+	records, err := bulk.Decode(c.Request.Body, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No tunnels to import"})
+		return
+	}
+
+	importer := bulk.NewImporter(di.Config, di.IPAM, di.WireguardManager.SharedKey)
+	report, created, err := importer.Import(records, dryRun)
+	if err != nil {
+		slog.Error("POSTTunnelsImport: Error importing tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error importing tunnels"})
+		return
+	}
+	if report.Invalid > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some tunnels are invalid, nothing was imported", "report": report})
+		return
+	}
+
+	err = bulk.Activate(di.Config, di.DB, di.WireguardManager, di.ServiceRegistry, created)
+	if err != nil {
+		slog.Error("POSTTunnelsImport: Error activating imported tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Tunnels were imported but bringing them up failed", "report": report})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
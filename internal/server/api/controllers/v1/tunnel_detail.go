@@ -0,0 +1,110 @@
+package v1
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/babel"
+	"github.com/USA-RedDragon/mesh-manager/internal/services/olsr"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+	"github.com/gin-gonic/gin"
+)
+
+// GETTunnel returns a tunnel along with the live state of its wireguard
+// device and what the routing daemons see over it. Live state that can't
+// be read is reported in errors rather than failing the request.
+func GETTunnel(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+
+	exists, err := models.TunnelIDExists(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnel: Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return
+	}
+
+	tunnel, err := models.FindTunnelByID(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnel: Error getting tunnel", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel"})
+		return
+	}
+
+	problems := []string{}
+	var device *wireguard.DeviceState
+	if tunnel.Wireguard {
+		state, err := di.WireguardManager.DeviceState(tunnel)
+		if err != nil {
+			problems = append(problems, "wireguard: "+err.Error())
+		}
+		device = &state
+	}
+
+	iface := wireguard.GenerateWireguardInterfaceName(tunnel)
+	var olsrLinks []apimodels.OlsrdLinkinfo
+	// OLSR doesn't run over the shared interface
+	if di.Config.OLSR && !tunnel.SharedInterface {
+		olsrLinks, err = olsr.InterfaceLinks(iface)
+		if err != nil {
+			problems = append(problems, "olsr: "+err.Error())
+		}
+	}
+	var babelNeighbours []babel.Neighbour
+	if di.Config.Babel.Enabled {
+		babelNeighbours, err = babel.Neighbours(iface)
+		if err != nil {
+			problems = append(problems, "babel: "+err.Error())
+		}
+		// Every peer on the shared interface is a neighbour there, pick out this one by its link-local address
+		if tunnel.SharedInterface {
+			babelNeighbours = peerNeighbours(tunnel, babelNeighbours)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tunnel":           apimodels.NewTunnelWithPass(tunnel),
+		"device":           device,
+		"olsr_links":       olsrLinks,
+		"babel_neighbours": babelNeighbours,
+		"errors":           problems,
+	})
+}
+
+func peerNeighbours(tunnel models.Tunnel, neighbours []babel.Neighbour) []babel.Neighbour {
+	remoteIP, err := wireguard.RemoteTunnelIP(tunnel)
+	if err != nil {
+		return nil
+	}
+	remoteIP6, err := utils.GenerateIPv6LinkLocalAddress(remoteIP)
+	if err != nil {
+		return nil
+	}
+	ret := []babel.Neighbour{}
+	for _, neighbour := range neighbours {
+		if net.ParseIP(neighbour.Address).Equal(net.ParseIP(remoteIP6)) {
+			ret = append(ret, neighbour)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,240 @@
+package v1
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+	"github.com/gin-gonic/gin"
+)
+
+// findServerTunnel loads the tunnel named by the :id parameter, writing an error response if it can't
+func findServerTunnel(c *gin.Context, di *middleware.DepInjection) (models.Tunnel, bool) {
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return models.Tunnel{}, false
+	}
+
+	exists, err := models.TunnelIDExists(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return models.Tunnel{}, false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return models.Tunnel{}, false
+	}
+
+	tunnel, err := models.FindTunnelByID(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("Error getting tunnel", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel"})
+		return models.Tunnel{}, false
+	}
+
+	if !tunnel.Wireguard || tunnel.WireguardServerKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only Wireguard server tunnels have keys to rotate"})
+		return models.Tunnel{}, false
+	}
+
+	return tunnel, true
+}
+
+// bindRotateTunnelKeys reads the optional rotation request body
+func bindRotateTunnelKeys(c *gin.Context) (apimodels.RotateTunnelKeys, bool) {
+	var json apimodels.RotateTunnelKeys
+	if c.Request.ContentLength > 0 {
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			slog.Error("JSON data is invalid", "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "JSON data is invalid"})
+			return json, false
+		}
+	}
+	return json, true
+}
+
+// rotationDeadline returns the deadline requested in the body, or the configured default
+func rotationDeadline(c *gin.Context, di *middleware.DepInjection, json apimodels.RotateTunnelKeys) (time.Time, bool) {
+	if json.WindowHours == nil {
+		return di.WireguardManager.KeyRotationDeadline(), true
+	}
+	if *json.WindowHours < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Window must not be negative"})
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(*json.WindowHours) * time.Hour), true
+}
+
+func POSTTunnelKeyRotation(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	tunnel, ok := findServerTunnel(c, di)
+	if !ok {
+		return
+	}
+
+	json, ok := bindRotateTunnelKeys(c)
+	if !ok {
+		return
+	}
+	deadline, ok := rotationDeadline(c, di, json)
+	if !ok {
+		return
+	}
+
+	tunnel, err := di.WireguardManager.StartKeyRotation(tunnel, deadline)
+	if errors.Is(err, wireguard.ErrKeyRotationInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A key rotation is already in progress"})
+		return
+	} else if err != nil {
+		slog.Error("POSTTunnelKeyRotation: Error starting key rotation", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting key rotation"})
+		return
+	}
+
+	pending, _ := tunnel.PendingWireguardCredential()
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Key rotation started",
+		"password": pending.String(),
+		"deadline": tunnel.KeyRotationDeadline,
+	})
+}
+
+func POSTTunnelsKeyRotation(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	json, ok := bindRotateTunnelKeys(c)
+	if !ok {
+		return
+	}
+	deadline, ok := rotationDeadline(c, di, json)
+	if !ok {
+		return
+	}
+	tags, err := models.NormalizeTags(json.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tunnels, err := models.ListFilteredWireguardTunnels(di.DB, models.TunnelFilter{Tags: tags})
+	if err != nil {
+		slog.Error("POSTTunnelsKeyRotation: Error getting tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnels"})
+		return
+	}
+
+	started := 0
+	for _, tunnel := range tunnels {
+		if tunnel.WireguardServerKey == "" || tunnel.KeyRotationDeadline != nil {
+			continue
+		}
+		_, err := di.WireguardManager.StartKeyRotation(tunnel, deadline)
+		if err != nil {
+			slog.Error("POSTTunnelsKeyRotation: Error starting key rotation", "tunnel", tunnel.Hostname, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting key rotation", "started": started})
+			return
+		}
+		started++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key rotations started", "started": started, "deadline": deadline})
+}
+
+func POSTTunnelKeyRotationConfirm(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	tunnel, ok := findServerTunnel(c, di)
+	if !ok {
+		return
+	}
+
+	_, err := di.WireguardManager.CompleteKeyRotation(tunnel, models.KeyRotationConfirmed)
+	if errors.Is(err, wireguard.ErrNoKeyRotation) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No key rotation is in progress"})
+		return
+	} else if err != nil {
+		slog.Error("POSTTunnelKeyRotationConfirm: Error completing key rotation", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error completing key rotation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key rotation completed"})
+}
+
+func DELETETunnelKeyRotation(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	tunnel, ok := findServerTunnel(c, di)
+	if !ok {
+		return
+	}
+
+	_, err := di.WireguardManager.CancelKeyRotation(tunnel)
+	if errors.Is(err, wireguard.ErrNoKeyRotation) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No key rotation is in progress"})
+		return
+	} else if err != nil {
+		slog.Error("DELETETunnelKeyRotation: Error cancelling key rotation", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error cancelling key rotation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key rotation cancelled"})
+}
+
+func GETTunnelKeyRotations(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	tunnel, ok := findServerTunnel(c, di)
+	if !ok {
+		return
+	}
+
+	rotations, err := models.ListTunnelKeyRotations(di.DB, tunnel.ID)
+	if err != nil {
+		slog.Error("GETTunnelKeyRotations: Error getting key rotations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting key rotations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys_rotated_at":       tunnel.KeysRotatedAt,
+		"key_rotation_deadline": tunnel.KeyRotationDeadline,
+		"rotations":             rotations,
+	})
+}
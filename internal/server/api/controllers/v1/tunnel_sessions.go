@@ -0,0 +1,77 @@
+package v1
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// GETTunnelSessions lists a tunnel's sessions, newest first, along with its
+// uptime between from and to, which default to the last day
+func GETTunnelSessions(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+	id := uint(idUint64)
+
+	exists, err := models.TunnelIDExists(di.DB, id)
+	if err != nil {
+		slog.Error("GETTunnelSessions: Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return
+	}
+
+	from, to, err := parseTimeRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessions, err := models.ListTunnelSessions(di.PaginatedDB, id)
+	if err != nil {
+		slog.Error("GETTunnelSessions: Error getting sessions", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting sessions"})
+		return
+	}
+	total, err := models.CountTunnelSessions(di.DB, id)
+	if err != nil {
+		slog.Error("GETTunnelSessions: Error getting session count", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting session count"})
+		return
+	}
+
+	window, err := models.ListTunnelSessionsBetween(di.DB, id, from, to)
+	if err != nil {
+		slog.Error("GETTunnelSessions: Error getting sessions in window", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":    total,
+		"sessions": sessions,
+		"uptime": gin.H{
+			"from":    from.UTC(),
+			"to":      to.UTC(),
+			"percent": models.SessionUptime(window, from, to),
+		},
+	})
+}
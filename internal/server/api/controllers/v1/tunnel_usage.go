@@ -0,0 +1,83 @@
+package v1
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// GETTunnelsUsage lists the traffic of every tunnel in its current quota period, heaviest first
+func GETTunnelsUsage(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	tunnels, err := models.ListAllTunnels(di.DB)
+	if err != nil {
+		slog.Error("GETTunnelsUsage: Error getting tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnels"})
+		return
+	}
+
+	usage := make([]apimodels.TunnelUsage, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		usage = append(usage, apimodels.NewTunnelUsage(tunnel))
+	}
+	sort.SliceStable(usage, func(i, j int) bool {
+		return usage[i].RXMB+usage[i].TXMB > usage[j].RXMB+usage[j].TXMB
+	})
+
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
+
+// GETTunnelUsage returns a tunnel's traffic in its current quota period and the periods before it
+func GETTunnelUsage(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+
+	exists, err := models.TunnelIDExists(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnelUsage: Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return
+	}
+
+	tunnel, err := models.FindTunnelByID(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnelUsage: Error getting tunnel", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel"})
+		return
+	}
+
+	history, err := models.ListTunnelUsagePeriods(di.DB, tunnel.ID)
+	if err != nil {
+		slog.Error("GETTunnelUsage: Error getting usage history", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting usage history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"current": apimodels.NewTunnelUsage(tunnel), "history": history})
+}
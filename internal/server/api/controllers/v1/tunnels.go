@@ -1,25 +1,47 @@
 package v1
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+	"github.com/USA-RedDragon/mesh-manager/internal/ipam"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
 	"github.com/USA-RedDragon/mesh-manager/internal/services"
 	"github.com/USA-RedDragon/mesh-manager/internal/services/babel"
 	"github.com/USA-RedDragon/mesh-manager/internal/services/olsr"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
 	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
 )
 
+var (
+	errTunnelOrderInvalid  = errors.New("order must be asc or desc")
+	errTunnelHostnameTaken = errors.New("hostname is already taken")
+)
+
+// peerErrorMessage returns the message for a failed wireguard change. A
+// firewall that couldn't be loaded is reported as is, so it isn't mistaken
+// for the tunnel being up and filtered.
+func peerErrorMessage(err error, msg string) string {
+	if errors.Is(err, wireguard.ErrFirewall) {
+		return err.Error()
+	}
+	return msg
+}
+
 func GETTunnels(c *gin.Context) {
 	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
 	if !ok {
@@ -33,23 +55,23 @@ func GETTunnels(c *gin.Context) {
 		typeStr = "wireguard"
 	}
 
-	filter, exists := c.GetQuery("filter")
-	if !exists {
-		filter = ""
+	filter, err := parseTunnelFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	var unfilteredTunnels []models.Tunnel
+	var tunnels []models.Tunnel
 	var total int
 	switch typeStr {
 	case "wireguard":
-		var err error
-		unfilteredTunnels, err = models.ListWireguardTunnels(di.PaginatedDB)
+		tunnels, err = models.ListFilteredWireguardTunnels(di.PaginatedDB, filter)
 		if err != nil {
 			slog.Error("GETTunnels: Error getting tunnels", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnels"})
 			return
 		}
-		total, err = models.CountWireguardTunnels(di.DB)
+		total, err = models.CountFilteredWireguardTunnels(di.DB, filter)
 		if err != nil {
 			slog.Error("GETTunnels: Error getting tunnel count", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel count"})
@@ -71,16 +93,6 @@ func GETTunnels(c *gin.Context) {
 		return
 	}
 
-	tunnels := unfilteredTunnels
-	if filter != "" {
-		tunnels = []models.Tunnel{}
-		for _, tunnel := range unfilteredTunnels {
-			if strings.Contains(strings.ToUpper(tunnel.Hostname), strings.ToUpper(filter)) {
-				tunnels = append(tunnels, tunnel)
-			}
-		}
-	}
-
 	if admin {
 		// Check for an active session
 		session := sessions.Default(c)
@@ -94,23 +106,7 @@ func GETTunnels(c *gin.Context) {
 		var tunnelsWithPass []apimodels.TunnelWithPass
 
 		for _, tunnel := range tunnels {
-			maybePassword := ""
-			if !tunnel.Client {
-				maybePassword = tunnel.Password
-			}
-			tunnelsWithPass = append(tunnelsWithPass, apimodels.TunnelWithPass{
-				Enabled:        tunnel.Enabled,
-				Wireguard:      tunnel.Wireguard,
-				WireguardPort:  tunnel.WireguardPort,
-				ID:             tunnel.ID,
-				Hostname:       tunnel.Hostname,
-				IP:             tunnel.IP,
-				Password:       maybePassword,
-				Client:         tunnel.Client,
-				Active:         tunnel.Active,
-				ConnectionTime: tunnel.ConnectionTime,
-				CreatedAt:      tunnel.CreatedAt,
-			})
+			tunnelsWithPass = append(tunnelsWithPass, apimodels.NewTunnelWithPass(tunnel))
 		}
 		c.JSON(http.StatusOK, gin.H{"total": total, "tunnels": tunnelsWithPass})
 	} else {
@@ -247,6 +243,38 @@ func POSTTunnel(c *gin.Context) {
 			return
 		}
 
+		if json.Tuning != nil {
+			err = json.Tuning.Validate(di.Config.Tunnels)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if !json.Client && di.Config.Wireguard.SharedInterface {
+				err = json.Tuning.ValidateShared()
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+
+		err = models.ValidateFirewall(json.FirewallPolicy, json.FirewallRules)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err = firewall.CheckPolicy(json.FirewallPolicy)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = json.Quota.Validate()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		if !json.Wireguard {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "VTun is disabled"})
 			return
@@ -260,58 +288,109 @@ func POSTTunnel(c *gin.Context) {
 				return
 			}
 
-			// Check if the hostname is already taken
-			err := di.DB.Find(&tunnel, "hostname = ? AND wireguard = ?", json.Hostname, json.Wireguard).Error
-			if err != nil {
-				slog.Error("POSTTunnel: Error getting tunnel", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel"})
-				return
-			} else if tunnel.ID != 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Hostname is already taken"})
-				return
-			}
-
 			tunnel = models.Tunnel{
 				Enabled:   true,
 				Hostname:  json.Hostname,
-				Password:  json.Password,
 				Client:    json.Client,
 				Wireguard: json.Wireguard,
 			}
 
-			tunnel.IP, err = models.GetNextWireguardIP(di.DB, di.Config)
+			// Generate a server and client key pair. Tunnels on the shared
+			// interface all use its key and port.
+			var serverKey wgtypes.Key
+			if di.Config.Wireguard.SharedInterface {
+				tunnel.SharedInterface = true
+				tunnel.WireguardPort = di.Config.Wireguard.SharedPort
+				serverKey, err = di.WireguardManager.SharedKey()
+				if err != nil {
+					slog.Error("POSTTunnel: Error getting shared interface key", "error", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating server key"})
+					return
+				}
+			} else {
+				serverKey, err = wgtypes.GeneratePrivateKey()
+				if err != nil {
+					slog.Error("POSTTunnel: Error generating server key", "error", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating server key"})
+					return
+				}
+			}
+			clientKey, err := wgtypes.GeneratePrivateKey()
 			if err != nil {
-				slog.Error("POSTTunnel: Error getting next IP", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting next IP"})
+				slog.Error("POSTTunnel: Error generating client key", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating client key"})
 				return
 			}
 
-			tunnel.WireguardPort, err = models.GetNextWireguardPort(di.DB, di.Config)
-			if err != nil {
-				slog.Error("POSTTunnel: Error getting next port", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting next port"})
-				return
+			withPSK := di.Config.Wireguard.PresharedKeys
+			if json.PresharedKey != nil {
+				withPSK = *json.PresharedKey
+			}
+			var psk *wgtypes.Key
+			if withPSK {
+				key, err := wgtypes.GenerateKey()
+				if err != nil {
+					slog.Error("POSTTunnel: Error generating preshared key", "error", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating preshared key"})
+					return
+				}
+				psk = &key
 			}
 
-			// Generate a server and client key pair
-			serverKey, err := wgtypes.GeneratePrivateKey()
-			if err != nil {
-				slog.Error("POSTTunnel: Error generating server key", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating server key"})
-				return
+			tunnel.WireguardServerKey = serverKey.String()
+			tunnel.SetWireguardCredential(models.NewWireguardCredential(serverKey, clientKey, psk))
+			if json.Tuning != nil {
+				tunnel.Tuning = *json.Tuning
 			}
-			clientKey, err := wgtypes.GeneratePrivateKey()
+			tunnel.RateLimit = json.RateLimit
+			tunnel.Quota = json.Quota
+			tunnel.FirewallPolicy = json.FirewallPolicy.Effective()
+			tunnel.FirewallRules = json.FirewallRules
+			err = tunnel.SetOwner(json.Callsign, json.Contact, json.Notes, json.Tags)
 			if err != nil {
-				slog.Error("POSTTunnel: Error generating client key", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating client key"})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			tunnel.Password = serverKey.PublicKey().String() + clientKey.String() + clientKey.PublicKey().String()
-			tunnel.WireguardServerKey = serverKey.String()
+			// Allocate and insert together, so concurrent creates can't be
+			// handed the same subnet or port
+			err = di.IPAM.Transaction(func(tx *gorm.DB, allocator *ipam.IPAM) error {
+				var existing models.Tunnel
+				err := tx.Find(&existing, "hostname = ? AND wireguard = ?", tunnel.Hostname, tunnel.Wireguard).Error
+				if err != nil {
+					return fmt.Errorf("failed to get tunnel: %w", err)
+				} else if existing.ID != 0 {
+					return errTunnelHostnameTaken
+				}
 
-			err = di.DB.Create(&tunnel).Error
-			if err != nil {
+				subnet, err := allocator.NextSubnet()
+				if err != nil {
+					return fmt.Errorf("failed to get next IP: %w", err)
+				}
+				tunnel.IP = subnet.Addr().String()
+
+				if !tunnel.SharedInterface {
+					tunnel.WireguardPort, err = allocator.NextPort()
+					if err != nil {
+						return fmt.Errorf("failed to get next port: %w", err)
+					}
+				}
+
+				return tx.Create(&tunnel).Error
+			})
+			switch {
+			case errors.Is(err, errTunnelHostnameTaken):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Hostname is already taken"})
+				return
+			case errors.Is(err, ipam.ErrPoolsExhausted):
+				slog.Error("POSTTunnel: Error getting next IP", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": ipam.ErrPoolsExhausted.Error()})
+				return
+			case errors.Is(err, ipam.ErrPortsExhausted):
+				slog.Error("POSTTunnel: Error getting next port", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": ipam.ErrPortsExhausted.Error()})
+				return
+			case err != nil:
 				slog.Error("POSTTunnel: Error creating tunnel", "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating tunnel"})
 				return
@@ -320,7 +399,7 @@ func POSTTunnel(c *gin.Context) {
 			err = di.WireguardManager.AddPeer(tunnel)
 			if err != nil {
 				slog.Error("POSTTunnel: Error adding wireguard peer", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding wireguard peer"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": peerErrorMessage(err, "Error adding wireguard peer")})
 				return
 			}
 		} else {
@@ -330,20 +409,27 @@ func POSTTunnel(c *gin.Context) {
 			}
 
 			if json.Wireguard {
-				// json.Hostname must not contain a port
-				if strings.Contains(json.Hostname, ":") {
+				// json.Hostname must not contain a port, but may be a bare or bracketed IPv6 address
+				host, port, err := utils.SplitHostOptionalPort(json.Hostname)
+				if err != nil || port != 0 {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is invalid"})
 					return
 				}
 
 				// json.IP must contain a port that needs to be appended to the hostname instead
-				ipParts := strings.Split(json.IP, ":")
-				if len(ipParts) != 2 {
+				ip, port, err := utils.SplitHostPort(json.IP)
+				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Net is invalid"})
 					return
 				}
-				json.Hostname = json.Hostname + ":" + ipParts[1]
-				json.IP = ipParts[0]
+				json.Hostname = utils.JoinHostPort(host, port)
+				json.IP = ip
+
+				isValid, errString := json.IsValidFallbackEndpoints()
+				if !isValid {
+					c.JSON(http.StatusBadRequest, gin.H{"error": errString})
+					return
+				}
 			}
 
 			// Check to ensure the IP is in the correct range: 172.16.0.0/12
@@ -363,47 +449,22 @@ func POSTTunnel(c *gin.Context) {
 				return
 			}
 
-			// Check to ensure the hostname is either a valid IP or a valid address (without protocol) with an optional port
-
-			// split the hostname by :
-			// if len(split) == 1, then it's just an IP address
-			// if len(split) == 2, then it's an address with an optional port
-			// if len(split) > 2, then it's invalid
-
-			split := strings.Split(json.Hostname, ":")
-			if len(split) > 2 {
+			// Check to ensure the hostname is either a valid IP or a valid address (without protocol) with an optional port.
+			// IPv6 addresses with a port must be bracketed, as in [2001:db8::1]:5527
+			host, _, err := utils.SplitHostOptionalPort(json.Hostname)
+			if err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is invalid"})
 				return
 			}
 
 			// Check if the hostname is an IP address
-			if net.ParseIP(split[0]) == nil {
+			if net.ParseIP(host) == nil {
 				// Check if the hostname is a valid address
-				_, err := url.ParseRequestURI("http://" + split[0])
+				_, err := url.ParseRequestURI("http://" + host)
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is invalid"})
 					return
 				}
-
-				// Check that the hostname is resolvable
-				// _, err = net.LookupIP(split[0])
-				// if err != nil {
-				// 	c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is not resolvable"})
-				// 	return
-				// }
-			}
-
-			// Check if the port is valid
-			if len(split) == 2 {
-				port, err := strconv.ParseUint(split[1], 10, 16)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Server port is invalid"})
-					return
-				}
-				if port < 1 || port > 65535 {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Server port is invalid"})
-					return
-				}
 			}
 
 			// Check if the IP is already taken
@@ -418,38 +479,37 @@ func POSTTunnel(c *gin.Context) {
 			}
 
 			tunnel = models.Tunnel{
-				Hostname:  json.Hostname,
-				Password:  json.Password,
-				IP:        json.IP,
-				Client:    json.Client,
-				Wireguard: json.Wireguard,
+				Hostname:          json.Hostname,
+				IP:                json.IP,
+				Client:            json.Client,
+				Wireguard:         json.Wireguard,
+				FallbackEndpoints: json.FallbackEndpoints,
 			}
 
 			if tunnel.Wireguard {
-				// The password will be 3 wireguard keys concatenated together
-				// <server_pubkey><client_privkey><client_pubkey>
-				if len(json.Password) != 132 {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Key is invalid"})
-					return
-				}
-				serverPubkey := json.Password[:44]
-				_, err := wgtypes.ParseKey(serverPubkey)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Key is invalid"})
-					return
-				}
-				clientPrivkey := json.Password[44:88]
-				_, err = wgtypes.ParseKey(clientPrivkey)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Key is invalid"})
-					return
-				}
-				clientPubkey := json.Password[88:]
-				_, err = wgtypes.ParseKey(clientPubkey)
+				// The password is the credential from the server, 3 wireguard keys
+				// concatenated together, optionally followed by a preshared key
+				// <server_pubkey><client_privkey><client_pubkey>[<preshared_key>]
+				cred, err := models.ParseWireguardCredential(json.Password)
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Key is invalid"})
 					return
 				}
+				tunnel.SetWireguardCredential(cred)
+			} else {
+				tunnel.Password = json.Password
+			}
+			if json.Tuning != nil {
+				tunnel.Tuning = *json.Tuning
+			}
+			tunnel.RateLimit = json.RateLimit
+			tunnel.Quota = json.Quota
+			tunnel.FirewallPolicy = json.FirewallPolicy.Effective()
+			tunnel.FirewallRules = json.FirewallRules
+			err = tunnel.SetOwner(json.Callsign, json.Contact, json.Notes, json.Tags)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
 
 			err = di.DB.Create(&tunnel).Error
@@ -462,7 +522,7 @@ func POSTTunnel(c *gin.Context) {
 			err = di.WireguardManager.AddPeer(tunnel)
 			if err != nil {
 				slog.Error("POSTTunnel: Error adding wireguard peer", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding wireguard peer"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": peerErrorMessage(err, "Error adding wireguard peer")})
 				return
 			}
 		}
@@ -505,7 +565,7 @@ func POSTTunnel(c *gin.Context) {
 				return
 			}
 
-			err = babelService.AddTunnel(wireguard.GenerateWireguardInterfaceName(tunnel))
+			err = babelService.AddTunnel(wireguard.GenerateWireguardInterfaceName(tunnel), babel.InterfaceTuning(di.Config, tunnel))
 			if err != nil {
 				slog.Error("POSTTunnel: Error adding Babel tunnel", "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding Babel tunnel"})
@@ -580,49 +640,24 @@ func PATCHTunnel(c *gin.Context) {
 			return
 		}
 
-		// Check to ensure the hostname is either a valid IP or a valid address (without protocol) with an optional port
-
-		// split the hostname by :
-		// if len(split) == 1, then it's just an IP address
-		// if len(split) == 2, then it's an address with an optional port
-		// if len(split) > 2, then it's invalid
-
 		json.Hostname = strings.ToUpper(json.Hostname)
 
-		split := strings.Split(json.Hostname, ":")
-		if len(split) > 2 {
+		// Check to ensure the hostname is either a valid IP or a valid address (without protocol) with an optional port.
+		// IPv6 addresses with a port must be bracketed, as in [2001:db8::1]:5527
+		host, _, err := utils.SplitHostOptionalPort(json.Hostname)
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is invalid"})
 			return
 		}
 
 		// Check if the hostname is an IP address
-		if net.ParseIP(split[0]) == nil {
+		if net.ParseIP(host) == nil {
 			// Check if the hostname is a valid address
-			_, err := url.ParseRequestURI("http://" + split[0])
+			_, err := url.ParseRequestURI("http://" + host)
 			if err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is invalid"})
 				return
 			}
-
-			// Check that the hostname is resolvable
-			// _, err = net.LookupIP(split[0])
-			// if err != nil {
-			// 	c.JSON(http.StatusBadRequest, gin.H{"error": "Server address is not resolvable"})
-			// 	return
-			// }
-		}
-
-		// Check if the port is valid
-		if len(split) == 2 {
-			port, err := strconv.ParseUint(split[1], 10, 16)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Server port is invalid"})
-				return
-			}
-			if port < 1 || port > 65535 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Server port is invalid"})
-				return
-			}
 		}
 
 		// Check if the IP is already taken
@@ -640,8 +675,96 @@ func PATCHTunnel(c *gin.Context) {
 		origTunnel := tunnel
 
 		tunnel.Hostname = json.Hostname
-		tunnel.Password = json.Password
 		tunnel.IP = json.IP
+		if !tunnel.Wireguard {
+			tunnel.Password = json.Password
+		} else if json.Password != "" {
+			cred, err := models.ParseWireguardCredential(json.Password)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Key is invalid"})
+				return
+			}
+			tunnel.SetWireguardCredential(cred)
+			err = tunnel.ValidateWireguardKeys()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Key does not match this tunnel"})
+				return
+			}
+		}
+		if tunnel.Client {
+			isValid, errString := json.IsValidFallbackEndpoints()
+			if !isValid {
+				c.JSON(http.StatusBadRequest, gin.H{"error": errString})
+				return
+			}
+			tunnel.FallbackEndpoints = json.FallbackEndpoints
+		}
+		// The tuning is replaced as a whole, null values go back to the config default
+		if json.Tuning != nil {
+			err = json.Tuning.Validate(di.Config.Tunnels)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if tunnel.SharedInterface {
+				err = json.Tuning.ValidateShared()
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			tunnel.Tuning = *json.Tuning
+		}
+		if json.RateLimit != nil {
+			tunnel.RateLimit = *json.RateLimit
+		}
+		if json.Quota != nil {
+			err = json.Quota.Validate()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			tunnel.Quota = *json.Quota
+			// A raised or removed quota lifts a throttle right away. A tunnel the
+			// quota disabled stays disabled until it is re-enabled.
+			if tunnel.QuotaExceeded && (tunnel.Quota.LimitMB == 0 || tunnel.PeriodUsedMB() < tunnel.Quota.LimitMB) {
+				tunnel.QuotaExceeded = false
+				tunnel.QuotaWarnedPercent = 0
+			}
+		}
+		if json.FirewallPolicy != nil {
+			err = models.ValidateFirewall(*json.FirewallPolicy, json.FirewallRules)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			err = firewall.CheckPolicy(*json.FirewallPolicy)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			tunnel.FirewallPolicy = json.FirewallPolicy.Effective()
+			tunnel.FirewallRules = json.FirewallRules
+		}
+		// Ownership fields left out of the request keep their current values
+		callsign, contact, notes, tags := tunnel.Callsign, tunnel.Contact, tunnel.Notes, tunnel.Tags
+		if json.Callsign != nil {
+			callsign = *json.Callsign
+		}
+		if json.Contact != nil {
+			contact = *json.Contact
+		}
+		if json.Notes != nil {
+			notes = *json.Notes
+		}
+		if json.Tags != nil {
+			tags = json.Tags
+		}
+		err = tunnel.SetOwner(callsign, contact, notes, tags)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		if tunnel.Enabled != *json.Enabled {
 			tunnel.Enabled = *json.Enabled
@@ -665,17 +788,10 @@ func PATCHTunnel(c *gin.Context) {
 			return
 		}
 
-		err = di.WireguardManager.RemovePeer(origTunnel)
-		if err != nil {
-			slog.Error("Error removing wireguard peer", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding wireguard peer"})
-			return
-		}
-
-		err = di.WireguardManager.AddPeer(tunnel)
+		err = di.WireguardManager.UpdatePeer(origTunnel, tunnel)
 		if err != nil {
-			slog.Error("Error adding wireguard peer", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding wireguard peer"})
+			slog.Error("Error updating wireguard peer", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": peerErrorMessage(err, "Error updating wireguard peer")})
 			return
 		}
 
@@ -702,6 +818,30 @@ func PATCHTunnel(c *gin.Context) {
 			}
 		}
 
+		if di.Config.Babel.Enabled && tunnel.Wireguard && tunnel.Enabled {
+			babelServiceIface, ok := di.ServiceRegistry.Get(services.BabelServiceName)
+			if !ok {
+				slog.Error("Error getting Babel service")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+				return
+			}
+
+			babelService, ok := babelServiceIface.(*babel.Service)
+			if !ok {
+				slog.Error("Error asserting Babel service")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+				return
+			}
+
+			// Push the tunnel's current tuning to babeld
+			err = babelService.AddTunnel(wireguard.GenerateWireguardInterfaceName(tunnel), babel.InterfaceTuning(di.Config, tunnel))
+			if err != nil {
+				slog.Error("Error updating Babel tunnel", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating Babel tunnel"})
+				return
+			}
+		}
+
 		dnsmasqService, ok := di.ServiceRegistry.Get(services.DNSMasqServiceName)
 		if !ok {
 			slog.Error("Error getting DNSMasq service")
@@ -804,11 +944,24 @@ func DELETETunnel(c *gin.Context) {
 			return
 		}
 
-		err = babelService.RemoveTunnel(wireguard.GenerateWireguardInterfaceName(tunnel))
-		if err != nil {
-			slog.Error("DELETETunnel: Error removing Babel tunnel", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error removing Babel tunnel"})
-			return
+		// The shared interface stays up while it has other peers
+		remaining := 0
+		if tunnel.SharedInterface {
+			remaining, err = models.CountSharedInterfaceTunnels(di.DB)
+			if err != nil {
+				slog.Error("DELETETunnel: Error counting shared interface tunnels", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error removing Babel tunnel"})
+				return
+			}
+		}
+
+		if remaining == 0 {
+			err = babelService.RemoveTunnel(wireguard.GenerateWireguardInterfaceName(tunnel))
+			if err != nil {
+				slog.Error("DELETETunnel: Error removing Babel tunnel", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error removing Babel tunnel"})
+				return
+			}
 		}
 	}
 
@@ -828,3 +981,118 @@ func DELETETunnel(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Tunnel deleted"})
 }
+
+func GETTunnelClientConfig(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	idUint64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+
+	exists, err := models.TunnelIDExists(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnelClientConfig: Error checking if tunnel exists", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking if tunnel exists"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel does not exist"})
+		return
+	}
+
+	tunnel, err := models.FindTunnelByID(di.DB, uint(idUint64))
+	if err != nil {
+		slog.Error("GETTunnelClientConfig: Error getting tunnel", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tunnel"})
+		return
+	}
+
+	if !tunnel.Wireguard || tunnel.Client {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only Wireguard server tunnels have a client config"})
+		return
+	}
+
+	endpointHost := di.Config.Wireguard.PublicHostname
+	if endpointHost == "" {
+		endpointHost, _, err = utils.SplitHostOptionalPort(c.Request.Host)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to determine the server address, set a public hostname"})
+			return
+		}
+	}
+
+	conf, err := wireguard.ClientConfig(tunnel, endpointHost, di.Config.Tunnels)
+	if err != nil {
+		slog.Error("GETTunnelClientConfig: Error generating client config", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating client config"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ToLower(tunnel.Hostname)+".conf"))
+	c.String(http.StatusOK, conf)
+}
+
+// parseTunnelFilter reads the tunnel listing's search and sort query parameters
+func parseTunnelFilter(c *gin.Context) (models.TunnelFilter, error) {
+	filter := models.TunnelFilter{
+		Search:   c.Query("filter"),
+		Callsign: c.Query("callsign"),
+		Sort:     c.Query("sort"),
+	}
+
+	for _, tag := range c.QueryArray("tag") {
+		normalized, err := models.NormalizeTag(tag)
+		if err != nil {
+			return filter, err
+		}
+		filter.Tags = append(filter.Tags, normalized)
+	}
+
+	for name, dest := range map[string]**bool{
+		"active":  &filter.Active,
+		"enabled": &filter.Enabled,
+		"client":  &filter.Client,
+	} {
+		value, exists := c.GetQuery(name)
+		if !exists || value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dest = &parsed
+	}
+
+	for name, dest := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		value, exists := c.GetQuery(name)
+		if !exists || value == "" {
+			continue
+		}
+		parsed, err := parseQueryTime(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dest = &parsed
+	}
+
+	switch strings.ToLower(c.Query("order")) {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, errTunnelOrderInvalid
+	}
+
+	return filter, filter.Validate()
+}
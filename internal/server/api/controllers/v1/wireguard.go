@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
 	"github.com/gin-gonic/gin"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -37,3 +38,50 @@ func POSTWireguardPubkey(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"key": private.PublicKey().String()})
 }
+
+func GETWireguardReconcile(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": di.WireguardManager.LastReconcileReport()})
+}
+
+func POSTWireguardReconcile(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	report, err := di.WireguardManager.Reconcile()
+	if err != nil {
+		slog.Error("POSTWireguardReconcile: Error reconciling tunnels", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reconciling tunnels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+func GETWireguardPools(c *gin.Context) {
+	di, ok := c.MustGet(middleware.DepInjectionKey).(*middleware.DepInjection)
+	if !ok {
+		slog.Error("Unable to get dependencies from context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Try again later"})
+		return
+	}
+
+	pools, err := di.IPAM.Usage()
+	if err != nil {
+		slog.Error("GETWireguardPools: Error getting pool usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting pool usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pools": pools})
+}
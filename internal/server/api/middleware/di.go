@@ -3,6 +3,7 @@ package middleware
 import (
 	"github.com/USA-RedDragon/mesh-manager/internal/bandwidth"
 	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/ipam"
 	"github.com/USA-RedDragon/mesh-manager/internal/services"
 	"github.com/USA-RedDragon/mesh-manager/internal/services/meshlink"
 	"github.com/USA-RedDragon/mesh-manager/internal/services/olsr"
@@ -15,6 +16,7 @@ type DepInjection struct {
 	MeshLinkParser     *meshlink.Parser
 	Config             *config.Config
 	DB                 *gorm.DB
+	IPAM               *ipam.IPAM
 	PaginatedDB        *gorm.DB
 	NetworkStats       *bandwidth.StatCounterManager
 	OLSRHostsParser    *olsr.HostsParser
@@ -57,6 +57,7 @@ func v1(group *gin.RouterGroup, config *config.Config) {
 	group.GET("/ping", v1Controllers.GETPing)
 
 	group.GET("/stats", v1Controllers.GETStats)
+	group.GET("/stats/traffic", v1Controllers.GETTrafficTotal)
 	group.GET("/loadavg", v1Controllers.GETLoadAvg)
 	group.GET("/uptime", v1Controllers.GETUptime)
 	group.GET("/node-ip", v1Controllers.GETNodeIP)
@@ -91,6 +92,9 @@ func v1(group *gin.RouterGroup, config *config.Config) {
 	v1Wireguard := group.Group("/wireguard")
 	v1Wireguard.GET("/genkey", v1Controllers.GETWireguardGenkey)
 	v1Wireguard.POST("/pubkey", v1Controllers.POSTWireguardPubkey)
+	v1Wireguard.GET("/reconcile", middleware.RequireLogin(), v1Controllers.GETWireguardReconcile)
+	v1Wireguard.POST("/reconcile", middleware.RequireLogin(), v1Controllers.POSTWireguardReconcile)
+	v1Wireguard.GET("/pools", middleware.RequireLogin(), v1Controllers.GETWireguardPools)
 
 	v1DNS := group.Group("/dns")
 	v1DNS.GET("/running", v1Controllers.GETDNSRunning)
@@ -108,7 +112,19 @@ func v1(group *gin.RouterGroup, config *config.Config) {
 	v1Tunnels.GET("/wireguard/server/count", v1Controllers.GETWireguardServerTunnelsCount)
 	v1Tunnels.GET("/wireguard/client/count/connected", v1Controllers.GETWireguardClientTunnelsCountConnected)
 	v1Tunnels.GET("/wireguard/server/count/connected", v1Controllers.GETWireguardServerTunnelsCountConnected)
-	// v1Tunnels.GET("/:id", v1Controllers.GETTunnel)
+	v1Tunnels.GET("/usage", middleware.RequireLogin(), v1Controllers.GETTunnelsUsage)
+	v1Tunnels.GET("/export", middleware.RequireLogin(), v1Controllers.GETTunnelsExport)
+	v1Tunnels.POST("/import", middleware.RequireLogin(), v1Controllers.POSTTunnelsImport)
+	v1Tunnels.GET("/:id", middleware.RequireLogin(), v1Controllers.GETTunnel)
+	v1Tunnels.GET("/:id/usage", middleware.RequireLogin(), v1Controllers.GETTunnelUsage)
+	v1Tunnels.GET("/:id/traffic", v1Controllers.GETTunnelTraffic)
+	v1Tunnels.GET("/:id/sessions", middleware.RequireLogin(), v1Controllers.GETTunnelSessions)
+	v1Tunnels.GET("/:id/client-config", middleware.RequireLogin(), v1Controllers.GETTunnelClientConfig)
+	v1Tunnels.POST("/keys/rotate", middleware.RequireLogin(), v1Controllers.POSTTunnelsKeyRotation)
+	v1Tunnels.GET("/:id/keys/rotations", middleware.RequireLogin(), v1Controllers.GETTunnelKeyRotations)
+	v1Tunnels.POST("/:id/keys/rotate", middleware.RequireLogin(), v1Controllers.POSTTunnelKeyRotation)
+	v1Tunnels.POST("/:id/keys/confirm", middleware.RequireLogin(), v1Controllers.POSTTunnelKeyRotationConfirm)
+	v1Tunnels.DELETE("/:id/keys/rotate", middleware.RequireLogin(), v1Controllers.DELETETunnelKeyRotation)
 	v1Tunnels.PATCH("", middleware.RequireLogin(), v1Controllers.PATCHTunnel)
 	v1Tunnels.DELETE("/:id", middleware.RequireLogin(), v1Controllers.DELETETunnel)
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/USA-RedDragon/mesh-manager/internal/bandwidth"
 	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"github.com/USA-RedDragon/mesh-manager/internal/events"
+	"github.com/USA-RedDragon/mesh-manager/internal/ipam"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api"
 	"github.com/USA-RedDragon/mesh-manager/internal/server/api/middleware"
 	"github.com/USA-RedDragon/mesh-manager/internal/services"
@@ -134,6 +135,16 @@ func (s *Server) addMiddleware(r *gin.Engine, version string, registry *services
 		di.OLSRServicesParser = olsr.NewServicesParser()
 	}
 
+	// New tunnel subnets must not collide with any host the routing daemons know about
+	var addressSources []ipam.AddressSource
+	if di.MeshLinkParser != nil {
+		addressSources = append(addressSources, di.MeshLinkParser)
+	}
+	if di.OLSRHostsParser != nil {
+		addressSources = append(addressSources, di.OLSRHostsParser)
+	}
+	di.IPAM = ipam.New(s.db, s.config, addressSources...)
+
 	r.Use(middleware.Inject(di))
 
 	// CORS
@@ -30,23 +30,24 @@ func Generate(config *config.Config, db *gorm.DB) string {
 	ret += "interface br-dtdlink rxcost 96\n"
 	ret += "interface br-dtdlink split-horizon true\n"
 
-	tunnelInterfaces := make([]string, 0)
 	tunnels, err := models.ListWireguardTunnels(db)
 	if err != nil {
 		panic(err)
 	}
 
-	if len(tunnels) > 0 {
-		for _, tunnel := range tunnels {
-			if !tunnel.Enabled {
+	hasShared := false
+	for _, tunnel := range tunnels {
+		if !tunnel.Enabled {
+			continue
+		}
+		// All shared interface tunnels are one babel interface
+		if tunnel.SharedInterface {
+			if hasShared {
 				continue
 			}
-			tunnelInterfaces = append(tunnelInterfaces, wireguard.GenerateWireguardInterfaceName(tunnel))
+			hasShared = true
 		}
-	}
-
-	for _, iface := range tunnelInterfaces {
-		ret += GenerateTunnelLine(iface)
+		ret += GenerateTunnelLine(wireguard.GenerateWireguardInterfaceName(tunnel), InterfaceTuning(config, tunnel))
 	}
 
 	if config.Supernode {
@@ -81,13 +82,26 @@ func Generate(config *config.Config, db *gorm.DB) string {
 	return ret
 }
 
-func GenerateTunnelLine(iface string) string {
+// InterfaceTuning returns the tuning of the babel interface a tunnel is on.
+// The shared interface carries many tunnels, so it uses the config defaults.
+func InterfaceTuning(config *config.Config, tunnel models.Tunnel) config.Tunnels {
+	if tunnel.SharedInterface {
+		return config.Tunnels
+	}
+	return tunnel.Tuning.Resolve(config.Tunnels)
+}
+
+func GenerateTunnelLine(iface string, tuning config.Tunnels) string {
 	ret := fmt.Sprintf("interface %s type tunnel\n", iface)
-	ret += fmt.Sprintf("interface %s rxcost 206\n", iface)
-	ret += fmt.Sprintf("interface %s hello-interval 10\n", iface)
-	ret += fmt.Sprintf("interface %s rtt-min 10\n", iface)
-	ret += fmt.Sprintf("interface %s rtt-max 400\n", iface)
-	ret += fmt.Sprintf("interface %s max-rtt-penalty 400\n", iface)
+	ret += fmt.Sprintf("interface %s rxcost %d\n", iface, tuning.BabelRxcost)
+	ret += fmt.Sprintf("interface %s hello-interval %d\n", iface, tuning.BabelHelloInterval)
+	ret += fmt.Sprintf("interface %s rtt-min %d\n", iface, tuning.BabelRttMin)
+	ret += fmt.Sprintf("interface %s rtt-max %d\n", iface, tuning.BabelRttMax)
+	ret += fmt.Sprintf("interface %s max-rtt-penalty %d\n", iface, tuning.BabelMaxRttPenalty)
+	if iface == wireguard.SharedInterfaceName {
+		// Multicast hellos only reach one peer on a multi-peer wireguard interface
+		ret += fmt.Sprintf("interface %s unicast true\n", iface)
+	}
 	ret += fmt.Sprintf("redistribute anyproto if %s deny\n", iface)
 	return ret
 }
@@ -0,0 +1,53 @@
+package babel
+
+import (
+	"strconv"
+)
+
+// Neighbour is a babel neighbour and the cost of the link to it
+type Neighbour struct {
+	Address   string  `json:"address"`
+	Interface string  `json:"interface"`
+	Reach     string  `json:"reach"`
+	RXCost    int     `json:"rxcost"`
+	TXCost    int     `json:"txcost"`
+	RTT       float64 `json:"rtt"`
+	RTTCost   int     `json:"rttcost"`
+	Cost      int     `json:"cost"`
+}
+
+// Neighbours lists the babel neighbours heard on an interface
+func Neighbours(iface string) ([]Neighbour, error) {
+	_, neighbours, err := dump()
+	if err != nil {
+		return nil, err
+	}
+	ret := []Neighbour{}
+	for _, neighbour := range neighbours {
+		if neighbour.Interface == iface {
+			ret = append(ret, neighbour)
+		}
+	}
+	return ret, nil
+}
+
+// parseNeighbour parses a line such as
+// add neighbour 5621a0 address fe80::1 if wgs1 reach ffff ureach 0000 rxcost 96 txcost 96 rtt 12.500 rttcost 0 cost 96
+func parseNeighbour(line string) (Neighbour, bool) {
+	values := dumpFields(line)
+	if values["address"] == "" || values["if"] == "" {
+		return Neighbour{}, false
+	}
+	neighbour := Neighbour{
+		Address:   values["address"],
+		Interface: values["if"],
+		Reach:     values["reach"],
+	}
+	// Costs are missing or "infinity" on a neighbour that has gone quiet, leave those at zero
+	neighbour.RXCost, _ = strconv.Atoi(values["rxcost"])
+	neighbour.TXCost, _ = strconv.Atoi(values["txcost"])
+	neighbour.RTT, _ = strconv.ParseFloat(values["rtt"], 64)
+	neighbour.RTTCost, _ = strconv.Atoi(values["rttcost"])
+	neighbour.Cost, _ = strconv.Atoi(values["cost"])
+	return neighbour, true
+}
@@ -0,0 +1,157 @@
+package babel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+)
+
+const dumpTimeout = 5 * time.Second
+
+// babelRoute is a route babeld has learned from a neighbour
+type babelRoute struct {
+	prefix    *net.IPNet
+	refmetric int
+	via       net.IP
+	iface     string
+}
+
+// PrefixSource learns the prefixes each tunnel peer originates from babeld's route table
+type PrefixSource struct{}
+
+func NewPrefixSource() *PrefixSource {
+	return &PrefixSource{}
+}
+
+func (s *PrefixSource) PeerPrefixes(tunnels []models.Tunnel) (map[uint][]net.IPNet, error) {
+	routes, _, err := dump()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[uint][]net.IPNet)
+	for _, tunnel := range tunnels {
+		iface := wireguard.GenerateWireguardInterfaceName(tunnel)
+
+		// Peers on the shared interface are told apart by their link-local address
+		var via net.IP
+		if tunnel.SharedInterface {
+			remoteIP, err := wireguard.RemoteTunnelIP(tunnel)
+			if err != nil {
+				continue
+			}
+			remoteIP6, err := utils.GenerateIPv6LinkLocalAddress(remoteIP)
+			if err != nil {
+				continue
+			}
+			via = net.ParseIP(remoteIP6)
+		}
+
+		for _, route := range routes {
+			// A refmetric of 0 means the neighbour originates the route itself,
+			// rather than passing on one it learned from further away
+			if route.iface != iface || route.refmetric != 0 {
+				continue
+			}
+			if via != nil && !via.Equal(route.via) {
+				continue
+			}
+			// A default route is an internet gateway, not the peer's own network
+			if ones, _ := route.prefix.Mask.Size(); ones == 0 {
+				continue
+			}
+			ret[tunnel.ID] = append(ret[tunnel.ID], *route.prefix)
+		}
+	}
+	return ret, nil
+}
+
+// dump reads the route and neighbour tables from babeld's local control socket
+func dump() ([]babelRoute, []Neighbour, error) {
+	conn, err := net.DialTimeout("unix", socketPath, dumpTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to socket: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(dumpTimeout))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set socket deadline: %w", err)
+	}
+
+	_, err = conn.Write([]byte("dump\n"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write to socket: %w", err)
+	}
+
+	// babeld greets us with a header ending in "ok", then answers the dump the same way
+	var routes []babelRoute
+	var neighbours []Neighbour
+	oks := 0
+	scanner := bufio.NewScanner(conn)
+	for oks < 2 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "ok":
+			oks++
+		case line == "no" || line == "bad" || strings.HasPrefix(line, "no "):
+			return nil, nil, fmt.Errorf("babeld refused dump: %s", line)
+		case strings.HasPrefix(line, "add route "):
+			route, ok := parseRoute(line)
+			if ok {
+				routes = append(routes, route)
+			}
+		case strings.HasPrefix(line, "add neighbour "):
+			neighbour, ok := parseNeighbour(line)
+			if ok {
+				neighbours = append(neighbours, neighbour)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read from socket: %w", err)
+	}
+	if oks < 2 {
+		return nil, nil, fmt.Errorf("babeld closed the socket before finishing the dump")
+	}
+	return routes, neighbours, nil
+}
+
+// dumpFields reads the key value pairs following "add <kind> <id>" in a dump line
+func dumpFields(line string) map[string]string {
+	fields := strings.Fields(line)
+	const skip = 3
+	values := make(map[string]string)
+	for i := skip; i+1 < len(fields); i += 2 {
+		values[fields[i]] = fields[i+1]
+	}
+	return values
+}
+
+// parseRoute parses a line such as
+// add route 5632d0 prefix 10.1.2.0/24 from ::/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 96 refmetric 0 via fe80::1 if wgs1
+func parseRoute(line string) (babelRoute, bool) {
+	values := dumpFields(line)
+
+	_, prefix, err := net.ParseCIDR(values["prefix"])
+	if err != nil {
+		return babelRoute{}, false
+	}
+	refmetric, err := strconv.Atoi(values["refmetric"])
+	if err != nil {
+		return babelRoute{}, false
+	}
+	return babelRoute{
+		prefix:    prefix,
+		refmetric: refmetric,
+		via:       net.ParseIP(values["via"]),
+		iface:     values["if"],
+	}, true
+}
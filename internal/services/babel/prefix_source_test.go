@@ -0,0 +1,49 @@
+package babel
+
+import (
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	t.Parallel()
+
+	route, ok := parseRoute("add route 5632d0 prefix 10.1.2.0/24 from ::/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 96 refmetric 0 via fe80::1 if wgs1")
+	if !ok {
+		t.Fatal("parseRoute() failed on a valid route")
+	}
+	if route.prefix.String() != "10.1.2.0/24" {
+		t.Errorf("prefix = %s, want 10.1.2.0/24", route.prefix)
+	}
+	if route.refmetric != 0 {
+		t.Errorf("refmetric = %d, want 0", route.refmetric)
+	}
+	if route.via.String() != "fe80::1" {
+		t.Errorf("via = %s, want fe80::1", route.via)
+	}
+	if route.iface != "wgs1" {
+		t.Errorf("iface = %s, want wgs1", route.iface)
+	}
+
+	_, ok = parseRoute("add route 5632d0 prefix bogus")
+	if ok {
+		t.Error("parseRoute() accepted a route without a valid prefix")
+	}
+}
+
+func TestParseNeighbour(t *testing.T) {
+	t.Parallel()
+
+	neighbour, ok := parseNeighbour("add neighbour 5621a0 address fe80::1 if wgs1 reach ffff ureach 0000 rxcost 96 txcost 128 rtt 12.500 rttcost 20 cost 116")
+	if !ok {
+		t.Fatal("parseNeighbour() failed on a valid neighbour")
+	}
+	want := Neighbour{Address: "fe80::1", Interface: "wgs1", Reach: "ffff", RXCost: 96, TXCost: 128, RTT: 12.5, RTTCost: 20, Cost: 116}
+	if neighbour != want {
+		t.Errorf("parseNeighbour() = %+v, want %+v", neighbour, want)
+	}
+
+	_, ok = parseNeighbour("add neighbour 5621a0 reach ffff")
+	if ok {
+		t.Error("parseNeighbour() accepted a neighbour without an address")
+	}
+}
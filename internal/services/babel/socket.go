@@ -3,20 +3,22 @@ package babel
 import (
 	"fmt"
 	"net"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
 )
 
 const (
 	socketPath = "/var/run/babel.sock"
 )
 
-func (s *Service) AddTunnel(iface string) error {
+func (s *Service) AddTunnel(iface string, tuning config.Tunnels) error {
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
 		return fmt.Errorf("failed to connect to socket: %w", err)
 	}
 	defer conn.Close()
 
-	tun := []byte(GenerateTunnelLine(iface))
+	tun := []byte(GenerateTunnelLine(iface, tuning))
 	n, err := conn.Write(tun)
 	if err != nil {
 		return fmt.Errorf("failed to write to socket: %w", err)
@@ -33,6 +33,19 @@ func (p *Parser) GetHosts() []*Host {
 	return p.currentHosts
 }
 
+// Addresses returns the address of every host and its children
+func (p *Parser) Addresses() []net.IP {
+	hosts := p.currentHosts
+	addrs := make([]net.IP, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, host.IP)
+		for _, child := range host.Children {
+			addrs = append(addrs, child.IP)
+		}
+	}
+	return addrs
+}
+
 func (p *Parser) GetHostsCount() int {
 	return len(p.currentHosts)
 }
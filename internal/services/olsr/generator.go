@@ -3,6 +3,8 @@ package olsr
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
@@ -118,6 +120,9 @@ LoadPlugin "olsrd_watchdog.so.0.1"
 {
     Ip4Broadcast 255.255.255.255
     Mode "ether"
+    HelloInterval ${HELLO_INTERVAL}
+    HelloValidityTime ${HELLO_VALIDITY}
+    LinkQualityMult default ${LINK_QUALITY_MULT}
 }`
 )
 
@@ -186,25 +191,37 @@ func Generate(config *config.Config, db *gorm.DB) string {
 		panic(err)
 	}
 
-	if len(tunnels) > 0 {
-		tunnelString := ""
-		for _, tunnel := range tunnels {
-			if !tunnel.Enabled {
-				continue
-			}
-			iface := wireguard.GenerateWireguardInterfaceName(tunnel)
-			tunnelString += "\"" + iface + "\""
-			if tunnel != tunnels[len(tunnels)-1] {
-				tunnelString += " "
-			}
+	// Tunnels with the same tuning share an Interface block
+	type olsrTuning struct {
+		helloInterval   float64
+		linkQualityMult float64
+	}
+	var groups []olsrTuning
+	ifaces := make(map[olsrTuning][]string)
+	for _, tunnel := range tunnels {
+		// OLSR relies on broadcast, which the shared interface can't
+		// deliver to its peers, so those tunnels are left to Babel
+		if !tunnel.Enabled || tunnel.SharedInterface {
+			continue
+		}
+		tuning := tunnel.Tuning.Resolve(config.Tunnels)
+		key := olsrTuning{tuning.OLSRHelloInterval, tuning.OLSRLinkQualityMult}
+		if _, ok := ifaces[key]; !ok {
+			groups = append(groups, key)
 		}
+		ifaces[key] = append(ifaces[key], "\""+wireguard.GenerateWireguardInterfaceName(tunnel)+"\"")
+	}
 
+	for _, group := range groups {
 		ret += "\n\n"
 		cpSnippetOlsrdConfTunnel := snippetOlsrdConfTunnel
 		utils.ShellReplace(
 			&cpSnippetOlsrdConfTunnel,
 			map[string]string{
-				"IFACES": tunnelString,
+				"IFACES":            strings.Join(ifaces[group], " "),
+				"HELLO_INTERVAL":    formatFloat(group.helloInterval),
+				"HELLO_VALIDITY":    formatFloat(group.helloInterval * helloValidityMultiplier),
+				"LINK_QUALITY_MULT": formatFloat(group.linkQualityMult),
 			},
 		)
 		ret += cpSnippetOlsrdConfTunnel
@@ -212,3 +229,10 @@ func Generate(config *config.Config, db *gorm.DB) string {
 
 	return ret
 }
+
+// olsrd's own default hello validity is ten hello intervals
+const helloValidityMultiplier = 10
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -28,6 +28,19 @@ func (p *HostsParser) GetHosts() []*Host {
 	return p.currentHosts
 }
 
+// Addresses returns the address of every host and its children
+func (p *HostsParser) Addresses() []net.IP {
+	hosts := p.currentHosts
+	addrs := make([]net.IP, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, host.IP)
+		for _, child := range host.Children {
+			addrs = append(addrs, child.IP)
+		}
+	}
+	return addrs
+}
+
 func (p *HostsParser) GetHostsCount() int {
 	return len(p.currentHosts)
 }
@@ -0,0 +1,27 @@
+package olsr
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+)
+
+// InterfaceLinks lists the OLSR links on an interface along with their link quality
+func InterfaceLinks(iface string) ([]apimodels.OlsrdLinkinfo, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	var links apimodels.OlsrdLinks
+	err := getJSONInfo(client, "/links", &links)
+	if err != nil {
+		return nil, err
+	}
+	ret := []apimodels.OlsrdLinkinfo{}
+	for _, link := range links.Links {
+		if link.InterfaceName == iface {
+			ret = append(ret, link)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,118 @@
+package olsr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/server/api/apimodels"
+	"github.com/USA-RedDragon/mesh-manager/internal/wireguard"
+)
+
+const jsoninfoURL = "http://localhost:9090"
+
+// PrefixSource learns the node address, interface aliases and HNA networks of
+// each tunnel peer from olsrd's jsoninfo plugin
+type PrefixSource struct {
+	client http.Client
+}
+
+func NewPrefixSource() *PrefixSource {
+	return &PrefixSource{
+		client: http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (s *PrefixSource) PeerPrefixes(tunnels []models.Tunnel) (map[uint][]net.IPNet, error) {
+	var mid apimodels.OlsrdMID
+	err := s.get("/mid", &mid)
+	if err != nil {
+		return nil, err
+	}
+	var hna apimodels.OlsrdHNA
+	err = s.get("/hna", &hna)
+	if err != nil {
+		return nil, err
+	}
+
+	// A node's main address and its aliases, keyed by every one of them
+	nodes := make(map[string]apimodels.OlsrdMIDEntry)
+	for _, entry := range mid.MID {
+		nodes[entry.Main.IPAddress] = entry
+		for _, alias := range entry.Aliases {
+			nodes[alias.IPAddress] = entry
+		}
+	}
+
+	ret := make(map[uint][]net.IPNet)
+	for _, tunnel := range tunnels {
+		// OLSR doesn't run over the shared interface
+		if tunnel.SharedInterface {
+			continue
+		}
+		remoteIP, err := wireguard.RemoteTunnelIP(tunnel)
+		if err != nil {
+			continue
+		}
+		// Nodes with a single interface have no MID entry, so the
+		// tunnel address is their main address
+		node, ok := nodes[remoteIP.String()]
+		if !ok {
+			node = apimodels.OlsrdMIDEntry{Main: apimodels.OlsrdMIDAddress{IPAddress: remoteIP.String()}}
+		}
+
+		prefixes := appendHost(nil, node.Main.IPAddress)
+		for _, alias := range node.Aliases {
+			prefixes = appendHost(prefixes, alias.IPAddress)
+		}
+		for _, entry := range hna.HNA {
+			if entry.Gateway != node.Main.IPAddress {
+				continue
+			}
+			ip := net.ParseIP(entry.Destination).To4()
+			// A default route announcement is an internet gateway, not the peer's own network
+			if ip == nil || entry.Genmask == 0 {
+				continue
+			}
+			prefixes = append(prefixes, net.IPNet{IP: ip, Mask: net.CIDRMask(entry.Genmask, 32)})
+		}
+		ret[tunnel.ID] = prefixes
+	}
+	return ret, nil
+}
+
+func (s *PrefixSource) get(path string, v any) error {
+	return getJSONInfo(&s.client, path, v)
+}
+
+// getJSONInfo fetches and decodes a table from olsrd's jsoninfo plugin
+func getJSONInfo(client *http.Client, path string, v any) error {
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, jsoninfoURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s from olsrd: %w", path, err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s from olsrd: %w", path, err)
+	}
+	return nil
+}
+
+func appendHost(prefixes []net.IPNet, addr string) []net.IPNet {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return prefixes
+	}
+	return append(prefixes, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+}
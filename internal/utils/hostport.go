@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrPortMissing = errors.New("port is missing")
+
+// SplitHostPort splits an endpoint of the form host:port or [ipv6]:port
+func SplitHostPort(endpoint string) (string, uint16, error) {
+	host, port, err := SplitHostOptionalPort(endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	if port == 0 {
+		return "", 0, fmt.Errorf("%q: %w", endpoint, ErrPortMissing)
+	}
+	return host, port, nil
+}
+
+// SplitHostOptionalPort splits an endpoint like SplitHostPort, but also accepts
+// a bare hostname, IPv4 address or IPv6 address with no port, returning a port of 0
+func SplitHostOptionalPort(endpoint string) (string, uint16, error) {
+	if endpoint == "" {
+		return "", 0, fmt.Errorf("endpoint is empty")
+	}
+
+	// A bare IPv6 literal has colons but no port
+	if ip := net.ParseIP(endpoint); ip != nil {
+		return ip.String(), 0, nil
+	}
+	if strings.HasPrefix(endpoint, "[") && strings.HasSuffix(endpoint, "]") {
+		ip := net.ParseIP(endpoint[1 : len(endpoint)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", 0, fmt.Errorf("invalid IPv6 address in %q", endpoint)
+		}
+		return ip.String(), 0, nil
+	}
+	if !strings.Contains(endpoint, ":") {
+		return endpoint, 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("host is missing from %q", endpoint)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port in %q", endpoint)
+	}
+	if strings.HasPrefix(endpoint, "[") {
+		ip := net.ParseIP(host)
+		if ip == nil || ip.To4() != nil {
+			return "", 0, fmt.Errorf("invalid IPv6 address in %q", endpoint)
+		}
+		host = ip.String()
+	}
+	return host, uint16(port), nil
+}
+
+// JoinHostPort is the inverse of SplitHostPort, bracketing IPv6 addresses
+func JoinHostPort(host string, port uint16) string {
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
@@ -0,0 +1,71 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+)
+
+func TestSplitHostOptionalPort(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		endpoint string
+		host     string
+		port     uint16
+		valid    bool
+	}{
+		{"example.com:5527", "example.com", 5527, true},
+		{"example.com", "example.com", 0, true},
+		{"192.0.2.1:5527", "192.0.2.1", 5527, true},
+		{"192.0.2.1", "192.0.2.1", 0, true},
+		{"[2001:db8::1]:5527", "2001:db8::1", 5527, true},
+		{"[2001:db8::1]", "2001:db8::1", 0, true},
+		{"2001:db8::1", "2001:db8::1", 0, true},
+		{"[2001:DB8:0::1]:5527", "2001:db8::1", 5527, true},
+		{"", "", 0, false},
+		{"example.com:", "", 0, false},
+		{"example.com:0", "", 0, false},
+		{"example.com:65536", "", 0, false},
+		{"example.com:5527:1", "", 0, false},
+		{":5527", "", 0, false},
+		{"[example.com]:5527", "", 0, false},
+		{"[192.0.2.1]:5527", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			t.Parallel()
+			host, port, err := utils.SplitHostOptionalPort(tt.endpoint)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("expected an error for %q, got %q %d", tt.endpoint, host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %v", tt.endpoint, err)
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("got %q %d, expected %q %d", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestSplitHostPortRequiresPort(t *testing.T) {
+	t.Parallel()
+
+	_, _, err := utils.SplitHostPort("[2001:db8::1]")
+	if err == nil {
+		t.Error("expected an error for an endpoint without a port")
+	}
+
+	host, port, err := utils.SplitHostPort("[2001:db8::1]:5527")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if utils.JoinHostPort(host, port) != "[2001:db8::1]:5527" {
+		t.Errorf("round trip gave %q", utils.JoinHostPort(host, port))
+	}
+}
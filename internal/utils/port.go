@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const freePortAttempts = 10
+
+// UDPPortFree reports whether a UDP port can be bound on both IPv4 and IPv6.
+// Wireguard listens dual-stack, so a port taken on either family is unusable.
+func UDPPortFree(port int) bool {
+	for _, network := range []string{"udp4", "udp6"} {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err != nil {
+			// A host without IPv6 only needs the port free on IPv4
+			if network == "udp6" && errors.Is(err, syscall.EAFNOSUPPORT) {
+				continue
+			}
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// FreeUDPPort returns a UDP port that is free on both IPv4 and IPv6
+func FreeUDPPort() (int, error) {
+	for range freePortAttempts {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to find a free port: %w", err)
+		}
+		addr, ok := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		if !ok {
+			return 0, fmt.Errorf("failed to find a free port")
+		}
+		if UDPPortFree(addr.Port) {
+			return addr.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("no port free on both IPv4 and IPv6 after %d attempts", freePortAttempts)
+}
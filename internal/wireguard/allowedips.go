@@ -0,0 +1,226 @@
+package wireguard
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PrefixSource learns the prefixes the peer of each tunnel originates, such as
+// its node address and LAN, from a routing daemon. The result is keyed by tunnel ID.
+type PrefixSource interface {
+	PeerPrefixes(tunnels []models.Tunnel) (map[uint][]net.IPNet, error)
+}
+
+// AddPrefixSource adds a routing daemon to learn peer prefixes from, for
+// shared interface peers and in strict AllowedIPs mode. It must be called before Run.
+func (m *Manager) AddPrefixSource(source PrefixSource) {
+	m.prefixSources = append(m.prefixSources, source)
+}
+
+// RemoteTunnelIP returns the address of the far side of a tunnel. The server
+// side of a tunnel has the first address of its subnet and the client the next.
+func RemoteTunnelIP(peer models.Tunnel) (net.IP, error) {
+	ip := net.ParseIP(peer.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid tunnel IP %q", peer.IP)
+	}
+	if peer.WireguardServerKey == "" {
+		return ip, nil
+	}
+	return nextIP(ip), nil
+}
+
+// learnsPrefixes reports whether a peer's AllowedIPs are limited to its
+// tunnel addresses and the prefixes it advertises to the mesh. Peers on the
+// shared interface always are, since wireguard routes between them by their AllowedIPs.
+func (m *Manager) learnsPrefixes(peer models.Tunnel) bool {
+	return peer.SharedInterface || m.config.Wireguard.StrictAllowedIPs
+}
+
+// peerAllowedIPs returns the addresses a peer may send from and receive.
+// A dedicated interface only has one peer, so it can route anything. Peers
+// on the shared interface, and every peer in strict mode, are limited to
+// their tunnel addresses and the prefixes they advertise to the mesh.
+func (m *Manager) peerAllowedIPs(peer models.Tunnel) ([]net.IPNet, error) {
+	if !m.learnsPrefixes(peer) {
+		return []net.IPNet{
+			{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}, nil
+	}
+
+	remoteIP, err := RemoteTunnelIP(peer)
+	if err != nil {
+		return nil, err
+	}
+	remoteIP6, err := utils.GenerateIPv6LinkLocalAddress(remoteIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate IPv6 link-local address: %w", err)
+	}
+
+	// Only the far side address, the subnet size depends on the pool it came from
+	allowed := []net.IPNet{
+		{IP: remoteIP, Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP(remoteIP6), Mask: net.CIDRMask(128, 128)},
+	}
+
+	if value, ok := m.learnedPrefixes.Load(peer.ID); ok {
+		if prefixes, ok := value.([]net.IPNet); ok {
+			allowed = append(allowed, prefixes...)
+		}
+	}
+
+	return allowed, nil
+}
+
+func (m *Manager) allowedIPsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.loopStopChan:
+			return
+		case <-ticker.C:
+			m.updateAllowedIPs()
+		}
+	}
+}
+
+// updateAllowedIPs asks the routing daemons what each peer advertises and
+// updates the AllowedIPs of any peer whose prefixes changed
+func (m *Manager) updateAllowedIPs() {
+	var tunnels []models.Tunnel
+	m.activePeers.Range(func(_, value interface{}) bool {
+		if tunnel, ok := value.(models.Tunnel); ok && m.learnsPrefixes(tunnel) {
+			tunnels = append(tunnels, tunnel)
+		}
+		return true
+	})
+	if len(tunnels) == 0 {
+		return
+	}
+
+	changed, err := m.learnPrefixes(tunnels)
+	if err != nil {
+		// Keep what we had rather than cut peers off while a daemon restarts
+		slog.Error("failed to learn peer prefixes", "error", err)
+		return
+	}
+
+	for _, tunnel := range changed {
+		err := m.applyAllowedIPs(tunnel)
+		if err != nil {
+			slog.Error("failed to update wireguard allowed IPs", "peer", tunnel.Hostname, "error", err)
+			continue
+		}
+		slog.Info("updated wireguard allowed IPs", "peer", tunnel.Hostname)
+	}
+
+	// Shared interface peers are matched in the firewall by their allowed IPs
+	if len(changed) > 0 {
+		err := m.applyFirewall()
+		if err != nil {
+			slog.Error("failed to update tunnel firewall", "error", err)
+		}
+	}
+}
+
+// learnPrefixes stores the prefixes the routing daemons say each tunnel's
+// peer advertises, returning the tunnels whose prefixes changed
+func (m *Manager) learnPrefixes(tunnels []models.Tunnel) ([]models.Tunnel, error) {
+	learned := make(map[uint][]net.IPNet)
+	for _, source := range m.prefixSources {
+		prefixes, err := source.PeerPrefixes(tunnels)
+		if err != nil {
+			return nil, err
+		}
+		for id, p := range prefixes {
+			learned[id] = append(learned[id], p...)
+		}
+	}
+
+	var changed []models.Tunnel
+	for _, tunnel := range tunnels {
+		prefixes := normalizePrefixes(learned[tunnel.ID])
+
+		var current []net.IPNet
+		if value, ok := m.learnedPrefixes.Load(tunnel.ID); ok {
+			current, _ = value.([]net.IPNet)
+		}
+		if prefixesEqual(current, prefixes) {
+			continue
+		}
+		m.learnedPrefixes.Store(tunnel.ID, prefixes)
+		changed = append(changed, tunnel)
+	}
+	return changed, nil
+}
+
+func (m *Manager) applyAllowedIPs(tunnel models.Tunnel) error {
+	_, remotePubkey, err := peerKeys(tunnel)
+	if err != nil {
+		return err
+	}
+	allowedIPs, err := m.peerAllowedIPs(tunnel)
+	if err != nil {
+		return err
+	}
+
+	m.configureLock.Lock()
+	defer m.configureLock.Unlock()
+	// The peer may have been removed while we were asking the routing daemons
+	if _, ok := m.activePeers.Load(tunnel.ID); !ok {
+		return nil
+	}
+	iface := GenerateWireguardInterfaceName(tunnel)
+	err = m.wgClient.ConfigureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         remotePubkey,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowedIPs,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rate limits on the shared interface match the peer's allowed IPs
+	if !tunnel.SharedInterface || !tunnel.EffectiveRateLimit().Limited() {
+		return nil
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get wireguard device: %w", err)
+	}
+	return applySharedShaping(link, tunnel, allowedIPs)
+}
+
+// normalizePrefixes masks, sorts and deduplicates prefixes so they can be compared
+func normalizePrefixes(prefixes []net.IPNet) []net.IPNet {
+	ret := make([]net.IPNet, 0, len(prefixes))
+	for _, p := range prefixes {
+		ret = append(ret, net.IPNet{IP: p.IP.Mask(p.Mask), Mask: p.Mask})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].String() < ret[j].String()
+	})
+	return slices.CompactFunc(ret, func(a, b net.IPNet) bool {
+		return a.String() == b.String()
+	})
+}
+
+func prefixesEqual(a, b []net.IPNet) bool {
+	return slices.EqualFunc(a, b, func(x, y net.IPNet) bool {
+		return x.String() == y.String()
+	})
+}
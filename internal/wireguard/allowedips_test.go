@@ -0,0 +1,82 @@
+package wireguard
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+type staticPrefixSource map[uint][]net.IPNet
+
+func (s staticPrefixSource) PeerPrefixes(_ []models.Tunnel) (map[uint][]net.IPNet, error) {
+	return s, nil
+}
+
+func TestSharedPeerLearnsPrefixes(t *testing.T) {
+	t.Parallel()
+
+	_, lan, _ := net.ParseCIDR("10.1.2.0/24")
+	first := models.Tunnel{ID: 1, IP: "172.31.0.0", WireguardServerKey: "key", SharedInterface: true}
+	second := models.Tunnel{ID: 2, IP: "172.31.0.4", WireguardServerKey: "key", SharedInterface: true}
+
+	// Strict mode is off, shared interface peers still need their LAN routed to them
+	m := &Manager{config: &config.Config{}}
+	m.AddPrefixSource(staticPrefixSource{second.ID: {*lan}})
+
+	changed, err := m.learnPrefixes([]models.Tunnel{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].ID != second.ID {
+		t.Fatalf("learnPrefixes() changed %+v, want only the second tunnel", changed)
+	}
+
+	contains := func(allowed []net.IPNet) bool {
+		return slices.ContainsFunc(allowed, func(p net.IPNet) bool {
+			return p.String() == lan.String()
+		})
+	}
+	allowed, err := m.peerAllowedIPs(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(allowed) {
+		t.Errorf("peerAllowedIPs(second) = %v, want it to contain %s", allowed, lan)
+	}
+	if allowed[0].String() != "172.31.0.5/32" {
+		t.Errorf("peerAllowedIPs(second) = %v, want the remote tunnel address first", allowed)
+	}
+
+	allowed, err = m.peerAllowedIPs(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(allowed) {
+		t.Errorf("peerAllowedIPs(first) = %v, want it without %s", allowed, lan)
+	}
+
+	// Learning the same prefixes again changes nothing
+	changed, err = m.learnPrefixes([]models.Tunnel{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("learnPrefixes() again changed %+v, want none", changed)
+	}
+}
+
+func TestDedicatedPeerAllowsEverything(t *testing.T) {
+	t.Parallel()
+
+	m := &Manager{config: &config.Config{}}
+	allowed, err := m.peerAllowedIPs(models.Tunnel{IP: "172.31.0.0", WireguardServerKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 2 || allowed[0].String() != "0.0.0.0/0" || allowed[1].String() != "::/0" {
+		t.Errorf("peerAllowedIPs() = %v, want the default routes", allowed)
+	}
+}
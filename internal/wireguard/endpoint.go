@@ -0,0 +1,213 @@
+package wireguard
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// endpointState tracks which of a client tunnel's endpoints is in use
+type endpointState struct {
+	index     int
+	changedAt time.Time
+}
+
+// peerEndpoints returns the hostname of a client tunnel followed by its fallbacks
+func peerEndpoints(peer models.Tunnel) []string {
+	return append([]string{peer.Hostname}, peer.FallbackEndpoints...)
+}
+
+// resolveEndpoint resolves a host:port or [ipv6]:port endpoint to a UDP address,
+// preferring addresses of the given family when a hostname has both A and AAAA records
+func resolveEndpoint(endpoint string, family config.AddressFamily) (*net.UDPAddr, error) {
+	host, port, err := utils.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostname format: %w", err)
+	}
+
+	// Check if the hostname is an IP address or a domain name
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// It's a domain name
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup IPs for hostname: %w", err)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no IPs found for hostname %s", host)
+		}
+		ip = preferFamily(ips, family)
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// preferFamily picks the first address of the preferred family, falling back to the first address
+func preferFamily(ips []net.IP, family config.AddressFamily) net.IP {
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil
+		if (family == config.AddressFamilyIPv4 && isIPv4) || (family == config.AddressFamilyIPv6 && !isIPv4) {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// currentEndpoint resolves the endpoint a client tunnel is currently using.
+// If it doesn't resolve, the following endpoints are tried in turn.
+func (m *Manager) currentEndpoint(peer models.Tunnel) (*net.UDPAddr, error) {
+	endpoints := peerEndpoints(peer)
+	start := m.endpointIndex(peer)
+
+	var err error
+	for i := range endpoints {
+		index := (start + i) % len(endpoints)
+		var addr *net.UDPAddr
+		addr, err = resolveEndpoint(endpoints[index], m.config.Wireguard.EndpointFamily)
+		if err != nil {
+			slog.Warn("failed to resolve wireguard endpoint", "peer", peer.Hostname, "endpoint", endpoints[index], "error", err)
+			continue
+		}
+		m.endpoints.Store(peer.ID, endpointState{index: index, changedAt: time.Now()})
+		return addr, nil
+	}
+	return nil, err
+}
+
+// endpointIndex returns which of a client tunnel's endpoints is in use
+func (m *Manager) endpointIndex(peer models.Tunnel) int {
+	if value, ok := m.endpoints.Load(peer.ID); ok {
+		if state, ok := value.(endpointState); ok {
+			return state.index % len(peerEndpoints(peer))
+		}
+	}
+	return 0
+}
+
+// endpointMatches reports whether a UDP address is one the endpoint resolves to
+func endpointMatches(endpoint string, addr *net.UDPAddr) (bool, error) {
+	host, port, err := utils.SplitHostPort(endpoint)
+	if err != nil {
+		return false, fmt.Errorf("invalid hostname format: %w", err)
+	}
+	if addr.Port != int(port) {
+		return false, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(addr.IP), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup IPs for hostname: %w", err)
+	}
+	return slices.ContainsFunc(ips, addr.IP.Equal), nil
+}
+
+func (m *Manager) endpointLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.loopStopChan:
+			return
+		case <-ticker.C:
+			m.checkEndpoints()
+		}
+	}
+}
+
+// checkEndpoints looks for client tunnels without a recent handshake and either
+// re-resolves their endpoint, in case its DNS has changed, or fails over to the next one
+func (m *Manager) checkEndpoints() {
+	timeout := time.Duration(m.config.Wireguard.HandshakeTimeout) * time.Second
+	m.activePeers.Range(func(_, value interface{}) bool {
+		peer, ok := value.(models.Tunnel)
+		if !ok || peer.WireguardServerKey != "" {
+			return true
+		}
+
+		var state endpointState
+		if value, ok := m.endpoints.Load(peer.ID); ok {
+			state, _ = value.(endpointState)
+		}
+		// Give the current endpoint a chance to handshake before moving on
+		if time.Since(state.changedAt) < timeout {
+			return true
+		}
+
+		m.configureLock.Lock()
+		err := m.checkEndpoint(peer, state, timeout)
+		m.configureLock.Unlock()
+		if err != nil {
+			slog.Error("failed to check wireguard endpoint", "peer", peer.Hostname, "error", err)
+		}
+		return true
+	})
+}
+
+// checkEndpoint checks a single client tunnel. Callers must hold configureLock.
+func (m *Manager) checkEndpoint(peer models.Tunnel, state endpointState, timeout time.Duration) error {
+	iface := GenerateWireguardInterfaceName(peer)
+	_, remotePubkey, err := peerKeys(peer)
+	if err != nil {
+		return err
+	}
+
+	dev, err := m.wgClient.Device(iface)
+	if err != nil {
+		return fmt.Errorf("failed to read wireguard device: %w", err)
+	}
+
+	var current *wgtypes.Peer
+	for i := range dev.Peers {
+		if dev.Peers[i].PublicKey == remotePubkey {
+			current = &dev.Peers[i]
+			break
+		}
+	}
+	if current == nil {
+		// The reconciler will put the peer back
+		return nil
+	}
+	if !current.LastHandshakeTime.IsZero() && time.Since(current.LastHandshakeTime) < timeout {
+		return nil
+	}
+
+	endpoints := peerEndpoints(peer)
+	index := state.index % len(endpoints)
+	addr, err := resolveEndpoint(endpoints[index], m.config.Wireguard.EndpointFamily)
+	if err != nil || (current.Endpoint != nil && addr.String() == current.Endpoint.String()) {
+		// The address hasn't changed, so try the next endpoint. With no
+		// fallbacks this re-resolves the same hostname on the next pass.
+		index = (index + 1) % len(endpoints)
+		addr, err = resolveEndpoint(endpoints[index], m.config.Wireguard.EndpointFamily)
+	}
+	m.endpoints.Store(peer.ID, endpointState{index: index, changedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to resolve endpoint %s: %w", endpoints[index], err)
+	}
+
+	if current.Endpoint != nil && addr.String() == current.Endpoint.String() {
+		return nil
+	}
+
+	slog.Info("updating stale wireguard endpoint", "iface", iface, "peer", peer.Hostname, "endpoint", endpoints[index], "address", addr.String())
+	err = m.wgClient.ConfigureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  remotePubkey,
+			UpdateOnly: true,
+			Endpoint:   addr,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update endpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/utils"
+)
+
+// ErrNotServerTunnel is returned when exporting a client config for a tunnel we are the client of
+var ErrNotServerTunnel = errors.New("only server tunnels have a client config")
+
+// ClientConfig renders a wg-quick config for the remote end of a server tunnel.
+// endpointHost is the hostname or address the client should connect to.
+func ClientConfig(peer models.Tunnel, endpointHost string, defaults config.Tunnels) (string, error) {
+	if peer.WireguardServerKey == "" {
+		return "", ErrNotServerTunnel
+	}
+	err := peer.ValidateWireguardKeys()
+	if err != nil {
+		return "", fmt.Errorf("tunnel credential is invalid: %w", err)
+	}
+
+	ip := net.ParseIP(peer.IP).To4()
+	if ip == nil {
+		return "", fmt.Errorf("invalid tunnel IP %q", peer.IP)
+	}
+	clientIP := nextIP(ip)
+	clientIP6, err := utils.GenerateIPv6LinkLocalAddress(clientIP)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate IPv6 link-local address: %w", err)
+	}
+
+	tuning := peer.Tuning.Resolve(defaults)
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", peer.WireguardClientPrivkey)
+	fmt.Fprintf(&b, "Address = %s/32, %s/64\n", clientIP, clientIP6)
+	// Both ends have to agree, and the shared interface only has the one MTU
+	fmt.Fprintf(&b, "MTU = %d\n", tunnelMTU(peer, defaults))
+	// Mesh routes come from OLSR or Babel, not from wg-quick
+	b.WriteString("Table = off\n")
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", peer.WireguardServerPubkey)
+	if peer.WireguardPresharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey = %s\n", peer.WireguardPresharedKey)
+	}
+	b.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&b, "Endpoint = %s\n", utils.JoinHostPort(endpointHost, peer.WireguardPort))
+	if tuning.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", tuning.PersistentKeepalive)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,55 @@
+package wireguard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestClientConfigMTU(t *testing.T) {
+	t.Parallel()
+
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtu := 1280
+	defaults := config.Tunnels{MTU: 1420}
+
+	tests := []struct {
+		name   string
+		shared bool
+		want   string
+	}{
+		{"dedicated interface", false, "MTU = 1280\n"},
+		{"shared interface", true, "MTU = 1420\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tunnel := models.Tunnel{
+				IP:                 "10.54.0.0",
+				WireguardServerKey: serverKey.String(),
+				WireguardPort:      5527,
+				SharedInterface:    tt.shared,
+				Tuning:             models.TunnelTuning{MTU: &mtu},
+			}
+			tunnel.SetWireguardCredential(models.NewWireguardCredential(serverKey, clientKey, nil))
+
+			conf, err := ClientConfig(tunnel, "node.example.com", defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(conf, tt.want) {
+				t.Errorf("ClientConfig() = %q, want it to contain %q", conf, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+)
+
+// ErrFirewall is returned when a peer's firewall policy couldn't be loaded
+var ErrFirewall = errors.New("failed to apply tunnel firewall")
+
+// applyFirewall renders the firewall policies of the active peers and loads
+// them if they changed. nft is never run until a peer has a policy.
+func (m *Manager) applyFirewall() error {
+	peers, err := m.firewallPeers()
+	if err != nil {
+		return err
+	}
+	ruleset := firewall.Render(peers)
+
+	m.firewallLock.Lock()
+	defer m.firewallLock.Unlock()
+	if ruleset == m.firewallRuleset {
+		return nil
+	}
+	err = firewall.Apply(ruleset)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFirewall, err)
+	}
+	m.firewallRuleset = ruleset
+	return nil
+}
+
+// firewallMissing reports whether the ruleset we loaded has disappeared from
+// the kernel, forgetting it so the next apply loads it again
+func (m *Manager) firewallMissing() (bool, error) {
+	m.firewallLock.Lock()
+	defer m.firewallLock.Unlock()
+	if m.firewallRuleset == "" {
+		return false, nil
+	}
+	loaded, err := firewall.Loaded()
+	if err != nil || loaded {
+		return false, err
+	}
+	m.firewallRuleset = ""
+	return true, nil
+}
+
+// firewallPeers returns the active peers as the firewall sees them
+func (m *Manager) firewallPeers() ([]firewall.Peer, error) {
+	var peers []firewall.Peer
+	var err error
+	m.activePeers.Range(func(_, value interface{}) bool {
+		tunnel, ok := value.(models.Tunnel)
+		if !ok {
+			return true
+		}
+		peer := firewall.Peer{
+			ID:     tunnel.ID,
+			Iface:  GenerateWireguardInterfaceName(tunnel),
+			Policy: tunnel.FirewallPolicy,
+			Rules:  tunnel.FirewallRules,
+		}
+		if tunnel.SharedInterface {
+			// WireGuard only accepts packets from a peer's AllowedIPs, so they tell the peers apart
+			peer.Sources, err = m.peerAllowedIPs(tunnel)
+			if err != nil {
+				err = fmt.Errorf("failed to get firewall sources of %s: %w", tunnel.Hostname, err)
+				return false
+			}
+		}
+		peers = append(peers, peer)
+		return true
+	})
+	return peers, err
+}
+
+// admitPeer loads the firewall policy of a filtered peer that isn't up yet,
+// before it is brought up, so it never forwards anything unfiltered. The
+// peer is left out again if the policy can't be loaded.
+func (m *Manager) admitPeer(peer models.Tunnel) error {
+	if !filtered(peer) {
+		return nil
+	}
+	if _, ok := m.activePeers.Load(peer.ID); ok {
+		return nil
+	}
+	m.activePeers.Store(peer.ID, peer)
+	err := m.applyFirewall()
+	if err != nil {
+		m.activePeers.Delete(peer.ID)
+		return err
+	}
+	return nil
+}
+
+// filtered reports whether a peer's traffic is only safe to forward once its firewall policy is loaded
+func filtered(peer models.Tunnel) bool {
+	return peer.FirewallPolicy.Effective() != models.FirewallAllowAll
+}
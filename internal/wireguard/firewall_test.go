@@ -0,0 +1,79 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+)
+
+func TestSharedPeerFirewallSources(t *testing.T) {
+	t.Parallel()
+
+	m := &Manager{config: &config.Config{}}
+	restricted := models.Tunnel{ID: 3, IP: "172.31.0.8", WireguardServerKey: "key", SharedInterface: true, FirewallPolicy: models.FirewallMeshOnly}
+	open := models.Tunnel{ID: 4, IP: "172.31.0.12", WireguardServerKey: "key", SharedInterface: true, FirewallPolicy: models.FirewallAllowAll}
+	m.activePeers.Store(restricted.ID, restricted)
+	m.activePeers.Store(open.ID, open)
+
+	peers, err := m.firewallPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := slices.IndexFunc(peers, func(p firewall.Peer) bool { return p.ID == restricted.ID })
+	if idx < 0 {
+		t.Fatalf("firewallPeers() = %+v, want tunnel %d", peers, restricted.ID)
+	}
+	allowed, err := m.peerAllowedIPs(restricted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := peers[idx]; peer.Iface != SharedInterfaceName || !slices.EqualFunc(peer.Sources, allowed, func(a, b net.IPNet) bool { return a.String() == b.String() }) {
+		t.Errorf("firewall peer = %+v, want it on %s with sources %v", peer, SharedInterfaceName, allowed)
+	}
+
+	// Only the restricted peer's addresses are sent through its chain
+	ruleset := firewall.Render(peers)
+	want := `iifname "wgsrv" ip saddr 172.31.0.9/32 jump tunnel_3`
+	if !strings.Contains(ruleset, want) {
+		t.Errorf("Render() = %q, want it to contain %q", ruleset, want)
+	}
+	if strings.Contains(ruleset, "172.31.0.13") || strings.Contains(ruleset, "tunnel_4") {
+		t.Errorf("Render() = %q, want the allow-all peer left out", ruleset)
+	}
+}
+
+func TestAdmitPeerWithoutFirewall(t *testing.T) {
+	t.Parallel()
+	if firewall.Available() {
+		t.Skip("nft is installed, admitting a filtered peer would load a ruleset")
+	}
+
+	m := &Manager{config: &config.Config{}}
+	open := models.Tunnel{ID: 1, IP: "172.31.0.0", WireguardServerKey: "key", FirewallPolicy: models.FirewallAllowAll}
+	if err := m.admitPeer(open); err != nil {
+		t.Errorf("admitPeer() = %v for an allow-all peer, want nil", err)
+	}
+
+	restricted := models.Tunnel{ID: 2, IP: "172.31.0.4", WireguardServerKey: "key", FirewallPolicy: models.FirewallMeshOnly}
+	if err := m.admitPeer(restricted); !errors.Is(err, ErrFirewall) {
+		t.Errorf("admitPeer() = %v, want %v", err, ErrFirewall)
+	}
+	if _, ok := m.activePeers.Load(restricted.ID); ok {
+		t.Error("a peer whose firewall couldn't be loaded was left active")
+	}
+}
+
+func TestFirewallMissingWithoutRuleset(t *testing.T) {
+	t.Parallel()
+	m := &Manager{config: &config.Config{}}
+	missing, err := m.firewallMissing()
+	if err != nil || missing {
+		t.Errorf("firewallMissing() = %v, %v before any ruleset was loaded, want false, nil", missing, err)
+	}
+}
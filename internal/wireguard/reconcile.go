@@ -0,0 +1,587 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type DriftKind string
+
+const (
+	DriftMissingInterface DriftKind = "missing_interface"
+	DriftStaleInterface   DriftKind = "stale_interface"
+	DriftInterfaceDown    DriftKind = "interface_down"
+	DriftMTU              DriftKind = "mtu"
+	DriftMissingAddress   DriftKind = "missing_address"
+	DriftMissingRule      DriftKind = "missing_rule"
+	DriftStaleRule        DriftKind = "stale_rule"
+	DriftDeviceConfig     DriftKind = "device_config"
+	DriftMissingPeer      DriftKind = "missing_peer"
+	DriftStalePeer        DriftKind = "stale_peer"
+	DriftAllowedIPs       DriftKind = "allowed_ips"
+	DriftPresharedKey     DriftKind = "preshared_key"
+	DriftKeepalive        DriftKind = "persistent_keepalive"
+	DriftEndpoint         DriftKind = "endpoint"
+	DriftFirewall         DriftKind = "firewall"
+)
+
+// Drift is a single difference found between the database and the kernel
+type Drift struct {
+	Kind      DriftKind `json:"kind"`
+	Interface string    `json:"interface"`
+	TunnelID  uint      `json:"tunnel_id,omitempty"`
+	Detail    string    `json:"detail"`
+	Repaired  bool      `json:"repaired"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ReconcileReport is the result of one reconciliation pass
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Tunnels    int       `json:"tunnels"`
+	Drift      []Drift   `json:"drift"`
+}
+
+// Interfaces we own are wgs<id>, wgc<id> and the shared wgsrv. wg0 and anything else is left alone.
+var managedInterfaceRegex = regexp.MustCompile(`^(wg[sc][0-9]+|wgsrv)$`)
+
+func (m *Manager) reconcileLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.loopStopChan:
+			return
+		case <-ticker.C:
+			_, err := m.Reconcile()
+			if err != nil {
+				slog.Error("failed to reconcile wireguard tunnels", "error", err)
+			}
+		}
+	}
+}
+
+// LastReconcileReport returns the report from the most recent reconciliation pass, or nil if none has run
+func (m *Manager) LastReconcileReport() *ReconcileReport {
+	return m.lastReport.Load()
+}
+
+// Reconcile diffs the tunnels in the database against the kernel state and repairs any differences
+func (m *Manager) Reconcile() (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		StartedAt: time.Now(),
+		Drift:     []Drift{},
+	}
+
+	tunnels, err := models.ListWireguardTunnels(m.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+
+	// Every interface has one tunnel, except the shared interface
+	desired := make(map[string][]models.Tunnel)
+	for _, tunnel := range tunnels {
+		if tunnel.Enabled {
+			iface := GenerateWireguardInterfaceName(tunnel)
+			desired[iface] = append(desired[iface], tunnel)
+			report.Tunnels++
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+
+	existing := make(map[string]netlink.Link)
+	forgotPeers := false
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !managedInterfaceRegex.MatchString(name) {
+			continue
+		}
+		existing[name] = link
+		if _, ok := desired[name]; !ok {
+			m.configureLock.Lock()
+			err := deleteInterface(name)
+			if err == nil {
+				err = removeRules(name)
+			}
+			m.configureLock.Unlock()
+			if err == nil && m.forgetPeers(func(t models.Tunnel) bool { return GenerateWireguardInterfaceName(t) == name }) {
+				forgotPeers = true
+			}
+			report.add(Drift{
+				Kind:      DriftStaleInterface,
+				Interface: name,
+				Detail:    "interface has no enabled tunnel",
+			}, err)
+		}
+	}
+
+	// The firewall would otherwise keep a chain for the removed peers
+	if forgotPeers {
+		err := m.applyFirewall()
+		if err != nil {
+			slog.Error("failed to update tunnel firewall", "error", err)
+		}
+	}
+
+	// Rules survive their interface being deleted, so look for leftovers
+	// from interfaces that are already gone
+	staleRuleIfaces := make(map[string]bool)
+	for _, rule := range rules {
+		if !ownedRule(rule) {
+			continue
+		}
+		if _, ok := desired[rule.IifName]; ok {
+			continue
+		}
+		if _, ok := existing[rule.IifName]; ok {
+			continue
+		}
+		staleRuleIfaces[rule.IifName] = true
+	}
+	for iface := range staleRuleIfaces {
+		m.configureLock.Lock()
+		err := removeRules(iface)
+		m.configureLock.Unlock()
+		report.add(Drift{
+			Kind:      DriftStaleRule,
+			Interface: iface,
+			Detail:    "policy routing rules remain for a removed interface",
+		}, err)
+	}
+
+	for iface, ifaceTunnels := range desired {
+		m.configureLock.Lock()
+		m.reconcileInterface(report, iface, ifaceTunnels, existing[iface], rules)
+		m.configureLock.Unlock()
+	}
+
+	m.reconcileFirewall(report)
+
+	report.FinishedAt = time.Now()
+	m.lastReport.Store(report)
+
+	if len(report.Drift) > 0 {
+		slog.Info("reconciled wireguard tunnels", "tunnels", report.Tunnels, "drift", len(report.Drift))
+	} else {
+		slog.Debug("reconciled wireguard tunnels", "tunnels", report.Tunnels, "drift", 0)
+	}
+
+	return report, nil
+}
+
+// reconcileInterface checks a single interface and the tunnels on it. Callers must hold configureLock.
+func (m *Manager) reconcileInterface(report *ReconcileReport, iface string, tunnels []models.Tunnel, link netlink.Link, rules []netlink.Rule) {
+	tunnelID := interfaceTunnelID(tunnels)
+
+	if link == nil {
+		var err error
+		for _, tunnel := range tunnels {
+			admitErr := m.admitPeer(tunnel)
+			if admitErr != nil {
+				err = admitErr
+				continue
+			}
+			err = m.configurePeer(tunnel)
+			if err != nil {
+				break
+			}
+			m.activePeers.Store(tunnel.ID, tunnel)
+		}
+		report.add(Drift{
+			Kind:      DriftMissingInterface,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    "interface does not exist",
+		}, err)
+		return
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		report.add(Drift{
+			Kind:      DriftInterfaceDown,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    "interface is down",
+		}, netlink.LinkSetUp(link))
+	}
+
+	if mtu := m.interfaceMTU(tunnels[0]); link.Attrs().MTU != mtu {
+		report.add(Drift{
+			Kind:      DriftMTU,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    fmt.Sprintf("MTU is %d, expected %d", link.Attrs().MTU, mtu),
+		}, netlink.LinkSetMTU(link, mtu))
+	}
+
+	m.reconcileAddresses(report, iface, tunnels, link)
+	refused := m.reconcileDevice(report, iface, tunnels)
+
+	for _, rule := range tunnelRules(iface) {
+		if ruleInstalled(rules, rule) {
+			continue
+		}
+		report.add(Drift{
+			Kind:      DriftMissingRule,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    fmt.Sprintf("rule priority %d table %d is missing", rule.Priority, rule.Table),
+		}, netlink.RuleAdd(rule))
+	}
+
+	for _, tunnel := range tunnels {
+		if !refused[tunnel.ID] {
+			m.activePeers.Store(tunnel.ID, tunnel)
+		}
+	}
+}
+
+// interfaceTunnelID returns the tunnel ID to report drift against, which
+// is only meaningful for interfaces that carry a single tunnel
+func interfaceTunnelID(tunnels []models.Tunnel) uint {
+	if len(tunnels) == 1 {
+		return tunnels[0].ID
+	}
+	return 0
+}
+
+func (m *Manager) reconcileAddresses(report *ReconcileReport, iface string, tunnels []models.Tunnel, link netlink.Link) {
+	var want []*netlink.Addr
+	for _, tunnel := range tunnels {
+		addrs, err := peerAddresses(tunnel)
+		if err != nil {
+			report.add(Drift{
+				Kind:      DriftMissingAddress,
+				Interface: iface,
+				TunnelID:  tunnel.ID,
+				Detail:    "unable to determine tunnel addresses",
+			}, err)
+			return
+		}
+		want = append(want, addrs...)
+	}
+
+	have, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		slog.Error("failed to list addresses", "iface", iface, "error", err)
+		return
+	}
+
+	for _, addr := range want {
+		found := false
+		for _, existing := range have {
+			if existing.IPNet.String() == addr.IPNet.String() {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		report.add(Drift{
+			Kind:      DriftMissingAddress,
+			Interface: iface,
+			TunnelID:  interfaceTunnelID(tunnels),
+			Detail:    fmt.Sprintf("address %s is missing", addr.IPNet),
+		}, netlink.AddrReplace(link, addr))
+	}
+}
+
+// reconcileDevice checks the wireguard device of an interface and each of its
+// peers. Only what drifted is repaired, so the sessions of the other peers on
+// the shared interface carry on, and a client keeps the port it listens on.
+// It returns the tunnels whose missing peer was left out because its firewall
+// policy couldn't be loaded.
+func (m *Manager) reconcileDevice(report *ReconcileReport, iface string, tunnels []models.Tunnel) map[uint]bool {
+	refused := make(map[uint]bool)
+	tunnelID := interfaceTunnelID(tunnels)
+
+	dev, err := m.wgClient.Device(iface)
+	if err != nil {
+		report.add(Drift{
+			Kind:      DriftDeviceConfig,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    "unable to read wireguard device",
+		}, err)
+		return refused
+	}
+
+	// Tunnels on the shared interface all have the same key and port
+	tunnel := tunnels[0]
+	privkey, _, err := peerKeys(tunnel)
+	if err != nil {
+		report.add(Drift{
+			Kind:      DriftDeviceConfig,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    "unable to parse tunnel keys",
+		}, err)
+		return refused
+	}
+	if dev.PrivateKey != privkey {
+		report.add(Drift{
+			Kind:      DriftDeviceConfig,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    "private key does not match",
+		}, m.wgClient.ConfigureDevice(iface, wgtypes.Config{PrivateKey: &privkey}))
+	}
+	// Clients listen on whichever port was free when they came up
+	if tunnel.WireguardServerKey != "" && dev.ListenPort != int(tunnel.WireguardPort) {
+		port := int(tunnel.WireguardPort)
+		report.add(Drift{
+			Kind:      DriftDeviceConfig,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    fmt.Sprintf("listen port is %d, expected %d", dev.ListenPort, tunnel.WireguardPort),
+		}, m.wgClient.ConfigureDevice(iface, wgtypes.Config{ListenPort: &port}))
+	}
+
+	have := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, peer := range dev.Peers {
+		have[peer.PublicKey] = peer
+	}
+	want := make(map[wgtypes.Key]bool, len(tunnels))
+	for _, tunnel := range tunnels {
+		// Keep the peer even if its configuration can't be built below
+		if _, remotePubkey, err := peerKeys(tunnel); err == nil {
+			want[remotePubkey] = true
+		}
+		wantPeer, err := m.peerConfig(tunnel)
+		if err != nil {
+			report.add(Drift{
+				Kind:      DriftDeviceConfig,
+				Interface: iface,
+				TunnelID:  tunnel.ID,
+				Detail:    "unable to build peer configuration",
+			}, err)
+			continue
+		}
+		if peer, ok := have[wantPeer.PublicKey]; ok {
+			m.reconcilePeer(report, iface, tunnel, peer, wantPeer)
+			continue
+		}
+
+		err = m.admitPeer(tunnel)
+		if err != nil {
+			refused[tunnel.ID] = true
+		} else if tunnel.WireguardServerKey == "" {
+			wantPeer.Endpoint, err = resolveEndpoint(peerEndpoints(tunnel)[m.endpointIndex(tunnel)], m.config.Wireguard.EndpointFamily)
+		}
+		if err == nil {
+			err = m.wgClient.ConfigureDevice(iface, wgtypes.Config{Peers: []wgtypes.PeerConfig{wantPeer}})
+		}
+		report.add(Drift{
+			Kind:      DriftMissingPeer,
+			Interface: iface,
+			TunnelID:  tunnel.ID,
+			Detail:    fmt.Sprintf("peer %s is missing", wantPeer.PublicKey),
+		}, err)
+	}
+
+	for _, peer := range dev.Peers {
+		if want[peer.PublicKey] {
+			continue
+		}
+		report.add(Drift{
+			Kind:      DriftStalePeer,
+			Interface: iface,
+			TunnelID:  tunnelID,
+			Detail:    fmt.Sprintf("peer %s has no enabled tunnel", peer.PublicKey),
+		}, m.wgClient.ConfigureDevice(iface, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{PublicKey: peer.PublicKey, Remove: true}},
+		}))
+		forgot := m.forgetPeers(func(t models.Tunnel) bool {
+			_, remotePubkey, err := peerKeys(t)
+			return err == nil && GenerateWireguardInterfaceName(t) == iface && remotePubkey == peer.PublicKey
+		})
+		if forgot {
+			err = m.applyFirewall()
+			if err != nil {
+				slog.Error("failed to update tunnel firewall", "error", err)
+			}
+		}
+	}
+	return refused
+}
+
+// reconcilePeer compares a peer on the device with its configuration,
+// updating each setting that drifted on its own
+func (m *Manager) reconcilePeer(report *ReconcileReport, iface string, tunnel models.Tunnel, peer wgtypes.Peer, want wgtypes.PeerConfig) {
+	update := func(kind DriftKind, detail string, set func(*wgtypes.PeerConfig)) {
+		peerConfig := wgtypes.PeerConfig{PublicKey: peer.PublicKey, UpdateOnly: true}
+		set(&peerConfig)
+		report.add(Drift{
+			Kind:      kind,
+			Interface: iface,
+			TunnelID:  tunnel.ID,
+			Detail:    detail,
+		}, m.wgClient.ConfigureDevice(iface, wgtypes.Config{Peers: []wgtypes.PeerConfig{peerConfig}}))
+	}
+
+	if !sameIPNets(peer.AllowedIPs, want.AllowedIPs) {
+		update(DriftAllowedIPs, fmt.Sprintf("allowed IPs are %s, expected %s", formatIPNets(peer.AllowedIPs), formatIPNets(want.AllowedIPs)), func(c *wgtypes.PeerConfig) {
+			c.ReplaceAllowedIPs = true
+			c.AllowedIPs = want.AllowedIPs
+		})
+	}
+
+	// A zero key clears the preshared key
+	var psk wgtypes.Key
+	if want.PresharedKey != nil {
+		psk = *want.PresharedKey
+	}
+	if peer.PresharedKey != psk {
+		update(DriftPresharedKey, "preshared key does not match", func(c *wgtypes.PeerConfig) {
+			c.PresharedKey = &psk
+		})
+	}
+
+	if peer.PersistentKeepaliveInterval != *want.PersistentKeepaliveInterval {
+		update(DriftKeepalive, fmt.Sprintf("persistent keepalive is %s, expected %s", peer.PersistentKeepaliveInterval, *want.PersistentKeepaliveInterval), func(c *wgtypes.PeerConfig) {
+			c.PersistentKeepaliveInterval = want.PersistentKeepaliveInterval
+		})
+	}
+
+	if tunnel.WireguardServerKey != "" {
+		return
+	}
+	// Clients dial the endpoint in use, the endpoint loop takes care of failing over
+	endpoint := peerEndpoints(tunnel)[m.endpointIndex(tunnel)]
+	if peer.Endpoint != nil {
+		ok, err := endpointMatches(endpoint, peer.Endpoint)
+		if err != nil || ok {
+			// An endpoint that doesn't resolve right now is left to the endpoint loop
+			return
+		}
+	}
+	addr, err := resolveEndpoint(endpoint, m.config.Wireguard.EndpointFamily)
+	if err != nil {
+		report.add(Drift{
+			Kind:      DriftEndpoint,
+			Interface: iface,
+			TunnelID:  tunnel.ID,
+			Detail:    fmt.Sprintf("endpoint is %v, expected %s", peer.Endpoint, endpoint),
+		}, err)
+		return
+	}
+	update(DriftEndpoint, fmt.Sprintf("endpoint is %v, expected %s", peer.Endpoint, endpoint), func(c *wgtypes.PeerConfig) {
+		c.Endpoint = addr
+	})
+}
+
+// reconcileFirewall loads the firewall for the peers the pass kept or brought
+// up. If it can't be loaded, the filtered peers are taken down rather than
+// left forwarding unfiltered traffic, and only come back once it loads. The
+// cached ruleset isn't trusted: if the table went missing it is loaded again.
+func (m *Manager) reconcileFirewall(report *ReconcileReport) {
+	missing, err := m.firewallMissing()
+	if err != nil {
+		slog.Error("failed to check tunnel firewall", "error", err)
+	}
+	err = m.applyFirewall()
+	if missing {
+		report.add(Drift{
+			Kind:   DriftFirewall,
+			Detail: fmt.Sprintf("nftables table %s is missing", firewall.Table),
+		}, err)
+	}
+	if err == nil {
+		return
+	}
+	slog.Error("failed to apply tunnel firewall", "error", err)
+
+	var peers []models.Tunnel
+	m.activePeers.Range(func(_, value interface{}) bool {
+		tunnel, ok := value.(models.Tunnel)
+		if ok && filtered(tunnel) {
+			peers = append(peers, tunnel)
+		}
+		return true
+	})
+	for _, peer := range peers {
+		report.add(Drift{
+			Kind:      DriftFirewall,
+			Interface: GenerateWireguardInterfaceName(peer),
+			TunnelID:  peer.ID,
+			Detail:    "firewall policy is not loaded, tunnel taken down",
+		}, errors.Join(err, m.teardownPeer(peer)))
+	}
+}
+
+// sameIPNets reports whether two lists hold the same prefixes, in any order
+func sameIPNets(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	canonical := func(prefix net.IPNet) string {
+		return (&net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}).String()
+	}
+	want := make(map[string]int, len(b))
+	for _, prefix := range b {
+		want[canonical(prefix)]++
+	}
+	for _, prefix := range a {
+		key := canonical(prefix)
+		if want[key] == 0 {
+			return false
+		}
+		want[key]--
+	}
+	return true
+}
+
+func formatIPNets(prefixes []net.IPNet) string {
+	formatted := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		formatted = append(formatted, prefix.String())
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
+
+// forgetPeers stops tracking the active peers that match, for when the
+// reconciler removed them from the kernel. It reports whether any matched.
+func (m *Manager) forgetPeers(match func(models.Tunnel) bool) bool {
+	forgot := false
+	m.activePeers.Range(func(_, value interface{}) bool {
+		tunnel, ok := value.(models.Tunnel)
+		if ok && match(tunnel) {
+			m.forgetPeer(tunnel.ID)
+			forgot = true
+		}
+		return true
+	})
+	return forgot
+}
+
+func (r *ReconcileReport) add(drift Drift, err error) {
+	if err != nil {
+		drift.Error = err.Error()
+		slog.Error("failed to repair wireguard drift", "kind", drift.Kind, "iface", drift.Interface, "detail", drift.Detail, "error", err)
+	} else {
+		drift.Repaired = true
+		slog.Warn("repaired wireguard drift", "kind", drift.Kind, "iface", drift.Interface, "detail", drift.Detail)
+	}
+	r.Drift = append(r.Drift, drift)
+}
@@ -0,0 +1,100 @@
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestSameIPNets(t *testing.T) {
+	t.Parallel()
+
+	parse := func(cidrs ...string) []net.IPNet {
+		prefixes := make([]net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			ip, prefix, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Keep the host bits, the kernel reports them masked off
+			prefix.IP = ip
+			prefixes = append(prefixes, *prefix)
+		}
+		return prefixes
+	}
+
+	tests := []struct {
+		name string
+		a, b []net.IPNet
+		want bool
+	}{
+		{"same order", parse("172.31.0.1/32", "fe80::1/128"), parse("172.31.0.1/32", "fe80::1/128"), true},
+		{"any order", parse("10.1.2.0/24", "172.31.0.1/32"), parse("172.31.0.1/32", "10.1.2.0/24"), true},
+		{"host bits", parse("10.1.2.0/24"), parse("10.1.2.7/24"), true},
+		{"widened", parse("0.0.0.0/0", "::/0"), parse("172.31.0.1/32", "fe80::1/128"), false},
+		{"extra prefix", parse("172.31.0.1/32", "10.1.2.0/24"), parse("172.31.0.1/32"), false},
+		{"duplicates", parse("172.31.0.1/32", "172.31.0.1/32"), parse("172.31.0.1/32", "10.1.2.0/24"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := sameIPNets(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameIPNets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointMatches(t *testing.T) {
+	t.Parallel()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5527}
+	tests := []struct {
+		endpoint string
+		want     bool
+	}{
+		{"192.0.2.10:5527", true},
+		{"192.0.2.11:5527", false},
+		{"192.0.2.10:5528", false},
+		{"[2001:db8::1]:5527", false},
+	}
+	for _, tt := range tests {
+		got, err := endpointMatches(tt.endpoint, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("endpointMatches(%q) = %v, want %v", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestForgetPeers(t *testing.T) {
+	t.Parallel()
+
+	m := &Manager{}
+	for _, tunnel := range []models.Tunnel{{ID: 1}, {ID: 2}} {
+		m.activePeers.Store(tunnel.ID, tunnel)
+		m.endpoints.Store(tunnel.ID, endpointState{})
+	}
+
+	if !m.forgetPeers(func(t models.Tunnel) bool { return t.ID == 1 }) {
+		t.Fatal("forgetPeers() = false, want true")
+	}
+	if _, ok := m.activePeers.Load(uint(1)); ok {
+		t.Error("forgotten peer is still active")
+	}
+	if _, ok := m.endpoints.Load(uint(1)); ok {
+		t.Error("forgotten peer still has an endpoint")
+	}
+	if _, ok := m.activePeers.Load(uint(2)); !ok {
+		t.Error("other peer was forgotten")
+	}
+	if !m.CausedDisconnect(1) {
+		t.Error("forgetting an active peer wasn't recorded as a teardown")
+	}
+	if m.forgetPeers(func(t models.Tunnel) bool { return t.ID == 1 }) {
+		t.Error("forgetPeers() = true with nothing left to forget")
+	}
+}
@@ -0,0 +1,242 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+const keyRotationCheckInterval = time.Minute
+
+var (
+	ErrKeyRotationInProgress = errors.New("a key rotation is already in progress")
+	ErrNoKeyRotation         = errors.New("no key rotation is in progress")
+)
+
+func (m *Manager) keyRotationLoop() {
+	ticker := time.NewTicker(keyRotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.loopStopChan:
+			return
+		case <-ticker.C:
+			m.checkKeyRotations()
+		}
+	}
+}
+
+// checkKeyRotations applies rotations whose deadline has passed and, if
+// scheduled rotation is enabled, starts rotations for tunnels with old keys
+func (m *Manager) checkKeyRotations() {
+	expired, err := models.ListTunnelsWithExpiredKeyRotation(m.db, time.Now())
+	if err != nil {
+		slog.Error("failed to list expired key rotations", "error", err)
+		return
+	}
+	for _, tunnel := range expired {
+		slog.Info("key rotation deadline passed, switching to new keys", "tunnel", tunnel.Hostname)
+		_, err := m.CompleteKeyRotation(tunnel, models.KeyRotationExpired)
+		if err != nil {
+			slog.Error("failed to complete key rotation", "tunnel", tunnel.Hostname, "error", err)
+		}
+	}
+
+	if m.config.Wireguard.KeyRotationInterval <= 0 {
+		return
+	}
+
+	interval := time.Duration(m.config.Wireguard.KeyRotationInterval) * 24 * time.Hour
+	due, err := models.ListTunnelsDueForKeyRotation(m.db, time.Now().Add(-interval))
+	if err != nil {
+		slog.Error("failed to list tunnels due for key rotation", "error", err)
+		return
+	}
+	for _, tunnel := range due {
+		slog.Info("starting scheduled key rotation", "tunnel", tunnel.Hostname)
+		_, err := m.StartKeyRotation(tunnel, m.KeyRotationDeadline())
+		if err != nil {
+			slog.Error("failed to start key rotation", "tunnel", tunnel.Hostname, "error", err)
+		}
+	}
+}
+
+// KeyRotationDeadline returns the default deadline for a rotation started now
+func (m *Manager) KeyRotationDeadline() time.Time {
+	return time.Now().Add(time.Duration(m.config.Wireguard.KeyRotationWindow) * time.Hour)
+}
+
+// StartKeyRotation generates new keys for a server tunnel and stores them as pending.
+// The current keys stay in use until the rotation is completed.
+func (m *Manager) StartKeyRotation(tunnel models.Tunnel, deadline time.Time) (models.Tunnel, error) {
+	if tunnel.WireguardServerKey == "" {
+		return tunnel, ErrNotServerTunnel
+	}
+	if tunnel.KeyRotationDeadline != nil {
+		return tunnel, ErrKeyRotationInProgress
+	}
+
+	// Tunnels on the shared interface can't have their own server key
+	var serverKey wgtypes.Key
+	var err error
+	if tunnel.SharedInterface {
+		serverKey, err = m.SharedKey()
+	} else {
+		serverKey, err = wgtypes.GeneratePrivateKey()
+	}
+	if err != nil {
+		return tunnel, fmt.Errorf("failed to generate server key: %w", err)
+	}
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return tunnel, fmt.Errorf("failed to generate client key: %w", err)
+	}
+
+	tunnel.PendingWireguardServerKey = serverKey.String()
+	tunnel.PendingWireguardClientPrivkey = clientKey.String()
+	tunnel.PendingWireguardPresharedKey = ""
+	if tunnel.WireguardPresharedKey != "" {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return tunnel, fmt.Errorf("failed to generate preshared key: %w", err)
+		}
+		tunnel.PendingWireguardPresharedKey = psk.String()
+	}
+	tunnel.KeyRotationDeadline = &deadline
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&tunnel).Select(
+			"PendingWireguardServerKey", "PendingWireguardClientPrivkey", "PendingWireguardPresharedKey", "KeyRotationDeadline",
+		).Updates(&tunnel).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.TunnelKeyRotation{
+			TunnelID:        tunnel.ID,
+			OldServerPubkey: tunnel.WireguardServerPubkey,
+			NewServerPubkey: serverKey.PublicKey().String(),
+			Deadline:        deadline,
+			Outcome:         models.KeyRotationPending,
+		}).Error
+	})
+	if err != nil {
+		return tunnel, fmt.Errorf("failed to save key rotation: %w", err)
+	}
+
+	return tunnel, nil
+}
+
+// CompleteKeyRotation switches a tunnel over to its pending keys
+func (m *Manager) CompleteKeyRotation(tunnel models.Tunnel, outcome models.KeyRotationOutcome) (models.Tunnel, error) {
+	if tunnel.KeyRotationDeadline == nil {
+		return tunnel, ErrNoKeyRotation
+	}
+
+	cred, ok := tunnel.PendingWireguardCredential()
+	if !ok {
+		return tunnel, fmt.Errorf("pending keys are invalid")
+	}
+
+	oldTunnel := tunnel
+	tunnel.WireguardServerKey = tunnel.PendingWireguardServerKey
+	tunnel.SetWireguardCredential(cred)
+	tunnel.KeysRotatedAt = time.Now()
+
+	err := m.finishKeyRotation(&tunnel, outcome)
+	if err != nil {
+		return oldTunnel, err
+	}
+
+	if !tunnel.Enabled {
+		return tunnel, nil
+	}
+
+	swapped, err := m.swapPeerKeys(oldTunnel, tunnel)
+	if err != nil {
+		return tunnel, fmt.Errorf("failed to switch peer to new keys: %w", err)
+	}
+	if !swapped {
+		// The peer isn't up, so bring it up with the new keys
+		err = m.AddPeer(tunnel)
+		if err != nil {
+			return tunnel, fmt.Errorf("failed to add peer with new keys: %w", err)
+		}
+	}
+
+	return tunnel, nil
+}
+
+// swapPeerKeys moves an active peer over to new keys without taking its
+// interface down. It reports false if the peer isn't active.
+func (m *Manager) swapPeerKeys(oldTunnel models.Tunnel, tunnel models.Tunnel) (bool, error) {
+	wgConfig, err := m.deviceConfig(tunnel)
+	if err != nil {
+		return false, err
+	}
+
+	m.configureLock.Lock()
+	defer m.configureLock.Unlock()
+	if _, ok := m.activePeers.Load(tunnel.ID); !ok {
+		return false, nil
+	}
+
+	// A dedicated interface has its peers replaced along with its key. The
+	// shared interface keeps its key and only swaps this tunnel's peer.
+	if tunnel.SharedInterface {
+		_, oldPubkey, err := peerKeys(oldTunnel)
+		if err != nil {
+			return false, err
+		}
+		wgConfig.Peers = append([]wgtypes.PeerConfig{{PublicKey: oldPubkey, Remove: true}}, wgConfig.Peers...)
+	}
+	// The peer has to handshake again with the new keys
+	m.tornDown(tunnel.ID)
+	err = m.wgClient.ConfigureDevice(GenerateWireguardInterfaceName(tunnel), wgConfig)
+	if err != nil {
+		return false, err
+	}
+	m.activePeers.Store(tunnel.ID, tunnel)
+	return true, nil
+}
+
+// CancelKeyRotation discards a tunnel's pending keys
+func (m *Manager) CancelKeyRotation(tunnel models.Tunnel) (models.Tunnel, error) {
+	if tunnel.KeyRotationDeadline == nil {
+		return tunnel, ErrNoKeyRotation
+	}
+
+	err := m.finishKeyRotation(&tunnel, models.KeyRotationCancelled)
+	return tunnel, err
+}
+
+// finishKeyRotation clears the pending keys and records the outcome in the rotation history
+func (m *Manager) finishKeyRotation(tunnel *models.Tunnel, outcome models.KeyRotationOutcome) error {
+	tunnel.PendingWireguardServerKey = ""
+	tunnel.PendingWireguardClientPrivkey = ""
+	tunnel.PendingWireguardPresharedKey = ""
+	tunnel.KeyRotationDeadline = nil
+
+	now := time.Now()
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(tunnel).Select(
+			"WireguardServerKey", "WireguardServerPubkey", "WireguardClientPrivkey", "WireguardClientPubkey", "WireguardPresharedKey", "KeysRotatedAt",
+			"PendingWireguardServerKey", "PendingWireguardClientPrivkey", "PendingWireguardPresharedKey", "KeyRotationDeadline",
+		).Updates(tunnel).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.TunnelKeyRotation{}).
+			Where("tunnel_id = ?", tunnel.ID).
+			Where("outcome = ?", models.KeyRotationPending).
+			Updates(map[string]interface{}{"outcome": outcome, "completed_at": now}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save key rotation: %w", err)
+	}
+	return nil
+}
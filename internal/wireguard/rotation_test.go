@@ -0,0 +1,201 @@
+package wireguard
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/glebarez/sqlite"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// newRotationManager returns a manager on a fresh database with one disabled
+// server tunnel, so rotations never touch the kernel
+func newRotationManager(t *testing.T) (*Manager, models.Tunnel) {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.AppSettings{}, &models.Tunnel{}, &models.TunnelKeyRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := models.Tunnel{
+		Hostname:           "KI5VMF-A",
+		IP:                 "10.54.0.0",
+		Wireguard:          true,
+		WireguardServerKey: serverKey.String(),
+		WireguardPort:      5527,
+	}
+	tunnel.SetWireguardCredential(models.NewWireguardCredential(serverKey, clientKey, nil))
+	err = db.Create(&tunnel).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enabled defaults to true on insert
+	err = db.Model(&tunnel).Update("enabled", false).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{
+		config: &config.Config{Wireguard: config.Wireguard{KeyRotationWindow: 24}},
+		db:     db,
+	}
+	return m, tunnel
+}
+
+func rotationOutcomes(t *testing.T, m *Manager, id uint) []models.KeyRotationOutcome {
+	t.Helper()
+	rotations, err := models.ListTunnelKeyRotations(m.db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := make([]models.KeyRotationOutcome, 0, len(rotations))
+	for _, rotation := range rotations {
+		outcomes = append(outcomes, rotation.Outcome)
+	}
+	return outcomes
+}
+
+func TestKeyRotationComplete(t *testing.T) {
+	t.Parallel()
+	m, tunnel := newRotationManager(t)
+	oldCred := tunnel.WireguardCredential()
+
+	tunnel, err := m.StartKeyRotation(tunnel, m.KeyRotationDeadline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.StartKeyRotation(tunnel, m.KeyRotationDeadline())
+	if !errors.Is(err, ErrKeyRotationInProgress) {
+		t.Errorf("second StartKeyRotation() = %v, want %v", err, ErrKeyRotationInProgress)
+	}
+
+	// The current keys stay in use until the rotation completes
+	stored, err := models.FindTunnelByID(m.db, tunnel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.WireguardCredential() != oldCred || stored.KeyRotationDeadline == nil {
+		t.Fatalf("started rotation stored %+v", stored)
+	}
+	pending, ok := stored.PendingWireguardCredential()
+	if !ok {
+		t.Fatal("pending keys were not stored")
+	}
+
+	tunnel, err = m.CompleteKeyRotation(stored, models.KeyRotationConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = models.FindTunnelByID(m.db, tunnel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.WireguardCredential() != pending {
+		t.Errorf("completed rotation kept %s, want the pending keys %s", stored.WireguardCredential(), pending)
+	}
+	if stored.KeyRotationDeadline != nil || stored.PendingWireguardServerKey != "" || stored.KeysRotatedAt.IsZero() {
+		t.Errorf("completed rotation left %+v", stored)
+	}
+	if got := rotationOutcomes(t, m, tunnel.ID); len(got) != 1 || got[0] != models.KeyRotationConfirmed {
+		t.Errorf("rotation history = %v, want [%s]", got, models.KeyRotationConfirmed)
+	}
+
+	_, err = m.CompleteKeyRotation(stored, models.KeyRotationConfirmed)
+	if !errors.Is(err, ErrNoKeyRotation) {
+		t.Errorf("CompleteKeyRotation() without a rotation = %v, want %v", err, ErrNoKeyRotation)
+	}
+}
+
+func TestKeyRotationCancel(t *testing.T) {
+	t.Parallel()
+	m, tunnel := newRotationManager(t)
+	oldCred := tunnel.WireguardCredential()
+
+	tunnel, err := m.StartKeyRotation(tunnel, m.KeyRotationDeadline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.CancelKeyRotation(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := models.FindTunnelByID(m.db, tunnel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.WireguardCredential() != oldCred || stored.KeyRotationDeadline != nil || stored.PendingWireguardServerKey != "" {
+		t.Errorf("cancelled rotation left %+v", stored)
+	}
+	if got := rotationOutcomes(t, m, tunnel.ID); len(got) != 1 || got[0] != models.KeyRotationCancelled {
+		t.Errorf("rotation history = %v, want [%s]", got, models.KeyRotationCancelled)
+	}
+
+	_, err = m.CancelKeyRotation(stored)
+	if !errors.Is(err, ErrNoKeyRotation) {
+		t.Errorf("CancelKeyRotation() without a rotation = %v, want %v", err, ErrNoKeyRotation)
+	}
+}
+
+func TestKeyRotationDeadline(t *testing.T) {
+	t.Parallel()
+	m, tunnel := newRotationManager(t)
+
+	tunnel, err := m.StartKeyRotation(tunnel, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := tunnel.PendingWireguardCredential()
+
+	m.checkKeyRotations()
+
+	stored, err := models.FindTunnelByID(m.db, tunnel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.WireguardCredential() != pending || stored.KeyRotationDeadline != nil {
+		t.Errorf("expired rotation left %+v", stored)
+	}
+	if got := rotationOutcomes(t, m, tunnel.ID); len(got) != 1 || got[0] != models.KeyRotationExpired {
+		t.Errorf("rotation history = %v, want [%s]", got, models.KeyRotationExpired)
+	}
+}
+
+func TestScheduledKeyRotation(t *testing.T) {
+	t.Parallel()
+	m, tunnel := newRotationManager(t)
+	m.config.Wireguard.KeyRotationInterval = 30
+
+	m.checkKeyRotations()
+	if got := rotationOutcomes(t, m, tunnel.ID); len(got) != 0 {
+		t.Fatalf("new tunnel was rotated: %v", got)
+	}
+
+	old := time.Now().AddDate(0, 0, -31)
+	err := m.db.Model(&tunnel).UpdateColumn("created_at", old).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.checkKeyRotations()
+	if got := rotationOutcomes(t, m, tunnel.ID); len(got) != 1 || got[0] != models.KeyRotationPending {
+		t.Errorf("rotation history = %v, want [%s]", got, models.KeyRotationPending)
+	}
+}
@@ -0,0 +1,99 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The policy routing rules for a tunnel interface live between these priorities
+const (
+	ruleMinPriority = 20010
+	ruleMaxPriority = 20099
+)
+
+// tunnelRules returns the policy routing rules installed for every tunnel interface.
+func tunnelRules(iface string) []*netlink.Rule {
+	tables := []struct {
+		priority int
+		table    int
+	}{
+		{20010, 29},
+		{20020, 20},
+		{20030, 30},
+		{20040, 21},
+		{20050, 22},
+		{20060, 28},
+		{20070, 31},
+	}
+
+	rules := make([]*netlink.Rule, 0, len(tables)+1)
+	for _, rt := range tables {
+		rule := netlink.NewRule()
+		rule.IifName = iface
+		rule.Priority = rt.priority
+		rule.Table = rt.table
+		rule.Family = netlink.FAMILY_ALL
+		rules = append(rules, rule)
+	}
+
+	// ip rule add pref 20099 iif $iface unreachable
+	rule := netlink.NewRule()
+	rule.IifName = iface
+	rule.Priority = ruleMaxPriority
+	rule.Type = unix.RTN_UNREACHABLE
+	rule.Family = netlink.FAMILY_ALL
+	return append(rules, rule)
+}
+
+// ensureRules installs any missing policy routing rules for the interface.
+// A rule that already exists is treated as installed.
+func ensureRules(iface string) error {
+	for _, rule := range tunnelRules(iface) {
+		err := netlink.RuleAdd(rule)
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add rule %d for %s: %w", rule.Priority, iface, err)
+		}
+	}
+	return nil
+}
+
+// removeRules deletes every policy routing rule we own for the interface.
+// Rules that are already gone are skipped.
+func removeRules(iface string) error {
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %w", err)
+	}
+	for _, rule := range rules {
+		if !ownedRule(rule) || rule.IifName != iface {
+			continue
+		}
+		err := netlink.RuleDel(&rule)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("failed to delete rule %d for %s: %w", rule.Priority, iface, err)
+		}
+	}
+	return nil
+}
+
+// ownedRule reports whether a rule is one we install for a tunnel interface
+func ownedRule(rule netlink.Rule) bool {
+	return managedInterfaceRegex.MatchString(rule.IifName) &&
+		rule.Priority >= ruleMinPriority &&
+		rule.Priority <= ruleMaxPriority
+}
+
+func ruleInstalled(rules []netlink.Rule, want *netlink.Rule) bool {
+	for _, rule := range rules {
+		if rule.IifName == want.IifName &&
+			rule.Priority == want.Priority &&
+			rule.Table == want.Table &&
+			rule.Type == want.Type {
+			return true
+		}
+	}
+	return false
+}
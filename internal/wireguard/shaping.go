@@ -0,0 +1,351 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Tunnel rate limits are an HTB qdisc on egress and a policer on ingress.
+// A dedicated interface sends all its traffic through a single class, while
+// each peer on the shared interface gets a class of its own and filters
+// matching its allowed IPs, at a filter priority equal to its tunnel ID.
+const (
+	htbMajor           = 1
+	dedicatedClass     = 1
+	dedicatedPriority  = 1
+	ipv4SrcOffset      = 12
+	ipv4DstOffset      = 16
+	minPoliceBurst     = 16 * 1024
+	policeBurstDivisor = 10 // 100ms worth of traffic
+)
+
+//nolint:gochecknoglobals
+var (
+	htbHandle     = netlink.MakeHandle(htbMajor, 0)
+	ingressHandle = netlink.MakeHandle(0xffff, 0)
+)
+
+// applyShaping installs the rate limits of a peer on its interface, removing
+// any that were lifted. Callers must hold configureLock.
+func (m *Manager) applyShaping(link netlink.Link, peer models.Tunnel) error {
+	if !peer.SharedInterface {
+		return applyDedicatedShaping(link, peer.EffectiveRateLimit())
+	}
+
+	prefixes, err := m.peerAllowedIPs(peer)
+	if err != nil {
+		return err
+	}
+	return applySharedShaping(link, peer, prefixes)
+}
+
+// UpdateRateLimit applies a change to an active peer's rate limits in place,
+// without taking the tunnel down
+func (m *Manager) UpdateRateLimit(peer models.Tunnel) error {
+	m.configureLock.Lock()
+	defer m.configureLock.Unlock()
+	if _, ok := m.activePeers.Load(peer.ID); !ok {
+		return nil
+	}
+	link, err := netlink.LinkByName(GenerateWireguardInterfaceName(peer))
+	if err != nil {
+		return fmt.Errorf("failed to get wireguard device: %w", err)
+	}
+	err = m.applyShaping(link, peer)
+	if err != nil {
+		return err
+	}
+	m.activePeers.Store(peer.ID, peer)
+	return nil
+}
+
+func applyDedicatedShaping(link netlink.Link, limit models.TunnelRateLimit) error {
+	if limit.EgressKbps > 0 {
+		err := ensureHTB(link, dedicatedClass)
+		if err != nil {
+			return err
+		}
+		err = netlink.ClassReplace(htbClass(link, dedicatedClass, limit.EgressKbps))
+		if err != nil {
+			return fmt.Errorf("failed to set egress rate limit: %w", err)
+		}
+	} else {
+		err := deleteQdisc(link, netlink.HANDLE_ROOT, htbHandle)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit.IngressKbps > 0 {
+		err := ensureIngress(link)
+		if err != nil {
+			return err
+		}
+		// No selector matches every packet
+		err = replaceFilters(link, netlink.HANDLE_INGRESS, dedicatedPriority, unix.ETH_P_ALL, []*netlink.U32{{
+			Actions: []netlink.Action{policer(0, limit.IngressKbps)},
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to set ingress rate limit: %w", err)
+		}
+	} else {
+		err := deleteQdisc(link, netlink.HANDLE_INGRESS, ingressHandle)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySharedShaping(link netlink.Link, peer models.Tunnel, prefixes []net.IPNet) error {
+	if peer.ID > math.MaxUint16 {
+		if peer.EffectiveRateLimit().Limited() {
+			return fmt.Errorf("tunnel ID %d is too large to rate limit on the shared interface", peer.ID)
+		}
+		return nil
+	}
+	//nolint:gosec
+	id := uint16(peer.ID)
+	limit := peer.EffectiveRateLimit()
+
+	if limit.EgressKbps > 0 {
+		err := ensureHTB(link, 0)
+		if err != nil {
+			return err
+		}
+		err = netlink.ClassReplace(htbClass(link, id, limit.EgressKbps))
+		if err != nil {
+			return fmt.Errorf("failed to set egress rate limit: %w", err)
+		}
+		filters := prefixFilters(prefixes, ipv4DstOffset, func(filter *netlink.U32) {
+			filter.ClassId = netlink.MakeHandle(htbMajor, id)
+		})
+		err = replaceFilters(link, htbHandle, id, unix.ETH_P_IP, filters)
+		if err != nil {
+			return fmt.Errorf("failed to set egress rate limit: %w", err)
+		}
+	} else {
+		err := removeSharedEgress(link, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit.IngressKbps > 0 {
+		err := ensureIngress(link)
+		if err != nil {
+			return err
+		}
+		// The filters share one policer so the limit covers all of the peer's prefixes together
+		filters := prefixFilters(prefixes, ipv4SrcOffset, func(filter *netlink.U32) {
+			filter.Actions = []netlink.Action{policer(int(id), limit.IngressKbps)}
+		})
+		err = replaceFilters(link, netlink.HANDLE_INGRESS, id, unix.ETH_P_IP, filters)
+		if err != nil {
+			return fmt.Errorf("failed to set ingress rate limit: %w", err)
+		}
+	} else {
+		err := deleteFilters(link, netlink.HANDLE_INGRESS, id, unix.ETH_P_IP)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSharedShaping removes the class and filters of a peer leaving the shared interface.
+// Callers must hold configureLock.
+func removeSharedShaping(link netlink.Link, peer models.Tunnel) error {
+	if peer.ID > math.MaxUint16 {
+		return nil
+	}
+	//nolint:gosec
+	id := uint16(peer.ID)
+	err := removeSharedEgress(link, id)
+	if err != nil {
+		return err
+	}
+	return deleteFilters(link, netlink.HANDLE_INGRESS, id, unix.ETH_P_IP)
+}
+
+func removeSharedEgress(link netlink.Link, id uint16) error {
+	err := deleteFilters(link, htbHandle, id, unix.ETH_P_IP)
+	if err != nil {
+		return err
+	}
+	err = netlink.ClassDel(&netlink.HtbClass{ClassAttrs: netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    htbHandle,
+		Handle:    netlink.MakeHandle(htbMajor, id),
+	}})
+	if err != nil && !isMissing(err) {
+		return fmt.Errorf("failed to remove egress rate limit: %w", err)
+	}
+	return nil
+}
+
+// ensureHTB adds the root HTB qdisc if it isn't there already. Replacing an
+// existing one would drop the classes of every other peer on the interface.
+func ensureHTB(link netlink.Link, defaultClass uint32) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs: %w", err)
+	}
+	for _, qdisc := range qdiscs {
+		htb, ok := qdisc.(*netlink.Htb)
+		if ok && htb.Parent == netlink.HANDLE_ROOT && htb.Handle == htbHandle && htb.Defcls == defaultClass {
+			return nil
+		}
+	}
+
+	htb := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    htbHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	htb.Defcls = defaultClass
+	err = netlink.QdiscReplace(htb)
+	if err != nil {
+		return fmt.Errorf("failed to add htb qdisc: %w", err)
+	}
+	return nil
+}
+
+func ensureIngress(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs: %w", err)
+	}
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Ingress); ok {
+			return nil
+		}
+	}
+
+	err = netlink.QdiscAdd(&netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    ingressHandle,
+		Parent:    netlink.HANDLE_INGRESS,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to add ingress qdisc: %w", err)
+	}
+	return nil
+}
+
+func deleteQdisc(link netlink.Link, parent, handle uint32) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs: %w", err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent != parent || qdisc.Attrs().Handle != handle {
+			continue
+		}
+		err = netlink.QdiscDel(qdisc)
+		if err != nil && !isMissing(err) {
+			return fmt.Errorf("failed to delete %s qdisc: %w", qdisc.Type(), err)
+		}
+	}
+	return nil
+}
+
+// replaceFilters swaps out every filter at a priority for the given ones
+func replaceFilters(link netlink.Link, parent uint32, priority uint16, protocol uint16, filters []*netlink.U32) error {
+	err := deleteFilters(link, parent, priority, protocol)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		filter.FilterAttrs = netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Priority:  priority,
+			Protocol:  protocol,
+		}
+		err = netlink.FilterAdd(filter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFilters(link netlink.Link, parent uint32, priority uint16, protocol uint16) error {
+	err := netlink.FilterDel(&netlink.U32{FilterAttrs: netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Priority:  priority,
+		Protocol:  protocol,
+	}})
+	if err != nil && !isMissing(err) {
+		return fmt.Errorf("failed to delete filters: %w", err)
+	}
+	return nil
+}
+
+// prefixFilters returns a filter matching the IPv4 address at the offset against each prefix
+func prefixFilters(prefixes []net.IPNet, offset int32, configure func(*netlink.U32)) []*netlink.U32 {
+	filters := make([]*netlink.U32, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ip := prefix.IP.To4()
+		if ip == nil {
+			continue
+		}
+		ones, _ := prefix.Mask.Size()
+		mask := uint32(math.MaxUint32)
+		if ones < net.IPv4len*8 {
+			mask = ^(math.MaxUint32 >> ones)
+		}
+		filter := &netlink.U32{
+			Sel: &netlink.TcU32Sel{
+				Flags: netlink.TC_U32_TERMINAL,
+				Keys: []netlink.TcU32Key{{
+					Mask: mask,
+					Val:  binary.BigEndian.Uint32(ip) & mask,
+					Off:  offset,
+				}},
+			},
+		}
+		configure(filter)
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+func htbClass(link netlink.Link, minor uint16, kbps uint32) *netlink.HtbClass {
+	return netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    htbHandle,
+		Handle:    netlink.MakeHandle(htbMajor, minor),
+	}, netlink.HtbClassAttrs{
+		Rate: uint64(kbps) * 1000,
+	})
+}
+
+// policer drops traffic over the rate. Policers with the same non-zero index are shared.
+func policer(index int, kbps uint32) *netlink.PoliceAction {
+	bytesPerSec := uint64(kbps) * 1000 / 8
+	police := netlink.NewPoliceAction()
+	police.Index = index
+	//nolint:gosec
+	police.Rate = uint32(min(bytesPerSec, math.MaxUint32))
+	//nolint:gosec
+	police.Burst = uint32(min(max(bytesPerSec/policeBurstDivisor, minPoliceBurst), math.MaxUint32))
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	police.NotExceedAction = netlink.TC_POLICE_OK
+	return police
+}
+
+// isMissing reports whether a delete failed because there was nothing to delete.
+// Deleting under a qdisc that was never added fails with EINVAL.
+func isMissing(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODEV) || errors.Is(err, unix.EINVAL)
+}
@@ -0,0 +1,99 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// SharedInterfaceName is the interface carrying every server tunnel created in shared interface mode.
+// Peers on it are told apart by public key and their per-peer AllowedIPs.
+const SharedInterfaceName = "wgsrv"
+
+// SharedKey returns the private key of the shared interface, generating and storing one on first use
+func (m *Manager) SharedKey() (wgtypes.Key, error) {
+	m.sharedKeyLock.Lock()
+	defer m.sharedKeyLock.Unlock()
+
+	var settings models.AppSettings
+	err := m.db.First(&settings).Error
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to load app settings: %w", err)
+	}
+
+	if settings.WireguardSharedKey != "" {
+		return wgtypes.ParseKey(settings.WireguardSharedKey)
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to generate shared interface key: %w", err)
+	}
+
+	settings.WireguardSharedKey = key.String()
+	err = m.db.Save(&settings).Error
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to save shared interface key: %w", err)
+	}
+
+	return key, nil
+}
+
+// removeSharedPeer drops a single peer from the shared interface and
+// deletes the interface once no peers remain. Callers must hold configureLock.
+func (m *Manager) removeSharedPeer(peer models.Tunnel) error {
+	link, err := netlink.LinkByName(SharedInterfaceName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return removeRules(SharedInterfaceName)
+		}
+		return fmt.Errorf("failed to get link: %w", err)
+	}
+
+	_, remotePubkey, err := peerKeys(peer)
+	if err != nil {
+		return err
+	}
+
+	err = m.wgClient.ConfigureDevice(SharedInterfaceName, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: remotePubkey, Remove: true}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove peer from shared interface: %w", err)
+	}
+
+	err = removeSharedShaping(link, peer)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := peerAddresses(peer)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		err = netlink.AddrDel(link, addr)
+		if err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+			return fmt.Errorf("failed to delete address %s: %w", addr.IPNet, err)
+		}
+	}
+
+	dev, err := m.wgClient.Device(SharedInterfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to read shared interface: %w", err)
+	}
+	if len(dev.Peers) > 0 {
+		return nil
+	}
+
+	err = deleteInterface(SharedInterfaceName)
+	if err != nil {
+		return err
+	}
+	return removeRules(SharedInterfaceName)
+}
@@ -0,0 +1,130 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DeviceState is the live kernel view of a tunnel's interface
+type DeviceState struct {
+	Interface  string      `json:"interface"`
+	Up         bool        `json:"up"`
+	MTU        int         `json:"mtu"`
+	ListenPort int         `json:"listen_port"`
+	PublicKey  string      `json:"public_key"`
+	Addresses  []string    `json:"addresses"`
+	Peer       *PeerState  `json:"peer"`
+	Rules      []RuleState `json:"rules"`
+}
+
+// PeerState is the live state of a tunnel's wireguard peer
+type PeerState struct {
+	PublicKey           string    `json:"public_key"`
+	Endpoint            string    `json:"endpoint"`
+	LastHandshake       time.Time `json:"last_handshake"`
+	PersistentKeepalive int       `json:"persistent_keepalive"`
+	RXBytes             int64     `json:"rx_bytes"`
+	TXBytes             int64     `json:"tx_bytes"`
+	AllowedIPs          []string  `json:"allowed_ips"`
+}
+
+// RuleState is a policy routing rule installed for a tunnel's interface
+type RuleState struct {
+	Family   string `json:"family"`
+	Priority int    `json:"priority"`
+	Table    int    `json:"table"`
+	Action   string `json:"action"`
+}
+
+// DeviceState reads the interface, wireguard device and policy routing rules of a tunnel.
+// A tunnel whose interface doesn't exist is reported as down rather than as an error.
+func (m *Manager) DeviceState(tunnel models.Tunnel) (DeviceState, error) {
+	iface := GenerateWireguardInterfaceName(tunnel)
+	state := DeviceState{Interface: iface}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to get link: %w", err)
+	}
+	state.Up = link.Attrs().Flags&net.FlagUp != 0
+	state.MTU = link.Attrs().MTU
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return state, fmt.Errorf("failed to list addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, addr.IPNet.String())
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return state, fmt.Errorf("failed to list rules: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.IifName != iface || !ownedRule(rule) {
+			continue
+		}
+		state.Rules = append(state.Rules, newRuleState(rule))
+	}
+
+	dev, err := m.wgClient.Device(iface)
+	if err != nil {
+		return state, fmt.Errorf("failed to get wireguard device: %w", err)
+	}
+	state.ListenPort = dev.ListenPort
+	state.PublicKey = dev.PublicKey.String()
+
+	_, remotePubkey, err := peerKeys(tunnel)
+	if err != nil {
+		return state, err
+	}
+	for _, peer := range dev.Peers {
+		if peer.PublicKey != remotePubkey {
+			continue
+		}
+		peerState := &PeerState{
+			PublicKey:           peer.PublicKey.String(),
+			LastHandshake:       peer.LastHandshakeTime,
+			PersistentKeepalive: int(peer.PersistentKeepaliveInterval / time.Second),
+			RXBytes:             peer.ReceiveBytes,
+			TXBytes:             peer.TransmitBytes,
+		}
+		if peer.Endpoint != nil {
+			peerState.Endpoint = peer.Endpoint.String()
+		}
+		for _, allowed := range peer.AllowedIPs {
+			peerState.AllowedIPs = append(peerState.AllowedIPs, allowed.String())
+		}
+		state.Peer = peerState
+		break
+	}
+	return state, nil
+}
+
+func newRuleState(rule netlink.Rule) RuleState {
+	state := RuleState{
+		Family:   "ipv4",
+		Priority: rule.Priority,
+		Table:    rule.Table,
+		Action:   "lookup",
+	}
+	if rule.Family == unix.AF_INET6 {
+		state.Family = "ipv6"
+	}
+	if rule.Type == unix.RTN_UNREACHABLE {
+		state.Action = "unreachable"
+		state.Table = 0
+	}
+	return state
+}
@@ -0,0 +1,115 @@
+package wireguard
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// UpdatePeer brings an edited tunnel's kernel state in line with the
+// database. Tuning, rate limit and firewall changes are applied to the running
+// peer, it is only brought down and up again when its keys, port, addresses or
+// endpoints change.
+func (m *Manager) UpdatePeer(oldPeer models.Tunnel, peer models.Tunnel) error {
+	if needsRecreate(oldPeer, peer) {
+		err := m.RemovePeer(oldPeer)
+		if err != nil {
+			return err
+		}
+		return m.AddPeer(peer)
+	}
+
+	updated, err := m.updatePeer(peer)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// Nothing is running yet, so there is nothing to update in place
+		return m.AddPeer(peer)
+	}
+	if oldPeer.EffectiveRateLimit() != peer.EffectiveRateLimit() {
+		err = m.UpdateRateLimit(peer)
+		if err != nil {
+			return err
+		}
+	}
+	err = m.applyFirewall()
+	if err != nil {
+		slog.Error("failed to apply tunnel firewall", "peer", peer.Hostname, "error", err)
+		if !filtered(peer) {
+			return nil
+		}
+		// Take the peer down rather than forward its traffic unfiltered
+		removeErr := m.RemovePeer(peer)
+		if removeErr != nil {
+			slog.Error("failed to remove wireguard peer", "peer", peer.Hostname, "error", removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// needsRecreate reports whether an edit changes something the running peer
+// can't pick up in place
+func needsRecreate(oldPeer models.Tunnel, peer models.Tunnel) bool {
+	if oldPeer.Enabled != peer.Enabled ||
+		oldPeer.SharedInterface != peer.SharedInterface ||
+		oldPeer.IP != peer.IP ||
+		oldPeer.WireguardPort != peer.WireguardPort ||
+		oldPeer.WireguardServerKey != peer.WireguardServerKey ||
+		oldPeer.WireguardCredential() != peer.WireguardCredential() {
+		return true
+	}
+	// Clients dial out, so their endpoints are part of the device config
+	return peer.WireguardServerKey == "" &&
+		(oldPeer.Hostname != peer.Hostname || !slices.Equal(oldPeer.FallbackEndpoints, peer.FallbackEndpoints))
+}
+
+// updatePeer applies the MTU and keepalive of an active peer in place. It
+// reports false if the peer isn't active.
+func (m *Manager) updatePeer(peer models.Tunnel) (bool, error) {
+	_, remotePubkey, err := peerKeys(peer)
+	if err != nil {
+		return false, err
+	}
+	iface := GenerateWireguardInterfaceName(peer)
+
+	m.configureLock.Lock()
+	defer m.configureLock.Unlock()
+	if _, ok := m.activePeers.Load(peer.ID); !ok {
+		return false, nil
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return false, fmt.Errorf("failed to get wireguard device: %w", err)
+	}
+	mtu := m.interfaceMTU(peer)
+	if link.Attrs().MTU != mtu {
+		err = netlink.LinkSetMTU(link, mtu)
+		if err != nil {
+			return false, fmt.Errorf("failed to set wireguard device MTU: %w", err)
+		}
+	}
+
+	// Zero turns keepalives off
+	keepalive := time.Second * time.Duration(peer.Tuning.Resolve(m.config.Tunnels).PersistentKeepalive)
+	err = m.wgClient.ConfigureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   remotePubkey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: &keepalive,
+		}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to configure wireguard device: %w", err)
+	}
+
+	m.activePeers.Store(peer.ID, peer)
+	return true, nil
+}
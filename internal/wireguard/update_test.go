@@ -0,0 +1,44 @@
+package wireguard
+
+import (
+	"testing"
+
+	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+)
+
+func TestNeedsRecreate(t *testing.T) {
+	t.Parallel()
+
+	server := models.Tunnel{ID: 1, Hostname: "KI5VMF-A", IP: "10.54.0.0", Enabled: true, WireguardServerKey: "key", WireguardPort: 5527}
+	client := models.Tunnel{ID: 2, Hostname: "peer.example.com:5527", IP: "10.54.0.4", Enabled: true}
+
+	tests := []struct {
+		name   string
+		old    models.Tunnel
+		edit   func(*models.Tunnel)
+		expect bool
+	}{
+		{"unchanged", server, func(*models.Tunnel) {}, false},
+		{"mtu", server, func(t *models.Tunnel) { mtu := 1380; t.Tuning.MTU = &mtu }, false},
+		{"keepalive", server, func(t *models.Tunnel) { keepalive := 25; t.Tuning.PersistentKeepalive = &keepalive }, false},
+		{"rate limit", server, func(t *models.Tunnel) { t.RateLimit.EgressKbps = 1000 }, false},
+		{"server hostname", server, func(t *models.Tunnel) { t.Hostname = "KI5VMF-B" }, false},
+		{"port", server, func(t *models.Tunnel) { t.WireguardPort = 5528 }, true},
+		{"server key", server, func(t *models.Tunnel) { t.WireguardServerKey = "other" }, true},
+		{"ip", server, func(t *models.Tunnel) { t.IP = "10.54.0.8" }, true},
+		{"disabled", server, func(t *models.Tunnel) { t.Enabled = false }, true},
+		{"client hostname", client, func(t *models.Tunnel) { t.Hostname = "other.example.com:5527" }, true},
+		{"client fallbacks", client, func(t *models.Tunnel) { t.FallbackEndpoints = []string{"backup.example.com:5527"} }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			peer := tt.old
+			tt.edit(&peer)
+			if got := needsRecreate(tt.old, peer); got != tt.expect {
+				t.Errorf("needsRecreate() = %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
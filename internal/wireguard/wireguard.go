@@ -5,17 +5,16 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/USA-RedDragon/mesh-manager/internal/config"
 	"github.com/USA-RedDragon/mesh-manager/internal/db/models"
+	"github.com/USA-RedDragon/mesh-manager/internal/firewall"
 	"github.com/USA-RedDragon/mesh-manager/internal/utils"
-	"github.com/phayes/freeport"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gorm.io/gorm"
@@ -23,31 +22,54 @@ import (
 
 const defTimeout = 10 * time.Second
 
+// teardownGrace is how long a disconnect the manager caused waits to be
+// noticed, a record older than that can't excuse a real disconnect
+const teardownGrace = time.Minute
+
+// peerResult confirms a peer was added, or carries why it couldn't be
+type peerResult struct {
+	peer models.Tunnel
+	err  error
+}
+
 type Manager struct {
+	config                *config.Config
 	db                    *gorm.DB
 	peerAddChan           chan models.Tunnel
-	peerAddConfirmChan    chan models.Tunnel
+	peerAddConfirmChan    chan peerResult
 	peerRemoveChan        chan models.Tunnel
 	peerRemoveConfirmChan chan models.Tunnel
 	shutdownChan          chan struct{}
 	shutdownConfirmChan   chan struct{}
 	activePeers           sync.Map
 	wgClient              *wgctrl.Client
+	configureLock         sync.Mutex
+	sharedKeyLock         sync.Mutex
+	loopStopChan          chan struct{}
+	lastReport            atomic.Pointer[ReconcileReport]
+	endpoints             sync.Map
+	prefixSources         []PrefixSource
+	learnedPrefixes       sync.Map
+	firewallLock          sync.Mutex
+	firewallRuleset       string
+	teardowns             sync.Map
 }
 
-func NewManager(db *gorm.DB) (*Manager, error) {
+func NewManager(config *config.Config, db *gorm.DB) (*Manager, error) {
 	wgClient, err := wgctrl.New()
 	if err != nil {
 		return nil, err
 	}
 	return &Manager{
+		config:                config,
 		db:                    db,
 		peerAddChan:           make(chan models.Tunnel),
-		peerAddConfirmChan:    make(chan models.Tunnel),
+		peerAddConfirmChan:    make(chan peerResult),
 		peerRemoveChan:        make(chan models.Tunnel),
 		peerRemoveConfirmChan: make(chan models.Tunnel),
 		shutdownChan:          make(chan struct{}),
 		shutdownConfirmChan:   make(chan struct{}),
+		loopStopChan:          make(chan struct{}),
 		activePeers:           sync.Map{},
 		wgClient:              wgClient,
 	}, nil
@@ -55,7 +77,29 @@ func NewManager(db *gorm.DB) (*Manager, error) {
 
 func (m *Manager) Run() error {
 	go m.run()
-	return m.initializeTunnels()
+	// Clear out policies left behind if we didn't shut down cleanly
+	if firewall.Available() {
+		err := firewall.Remove()
+		if err != nil {
+			slog.Warn("failed to remove stale tunnel firewall", "error", err)
+		}
+	}
+	err := m.initializeTunnels()
+	if err != nil {
+		return err
+	}
+	if m.config.Wireguard.ReconcileInterval > 0 {
+		go m.reconcileLoop(time.Duration(m.config.Wireguard.ReconcileInterval) * time.Second)
+	}
+	if m.config.Wireguard.EndpointCheckInterval > 0 {
+		go m.endpointLoop(time.Duration(m.config.Wireguard.EndpointCheckInterval) * time.Second)
+	}
+	go m.keyRotationLoop()
+	// Shared interface peers need their prefixes learned even outside strict mode
+	if (m.config.Wireguard.StrictAllowedIPs || m.config.Wireguard.SharedInterface) && len(m.prefixSources) > 0 {
+		go m.allowedIPsLoop(time.Duration(m.config.Wireguard.AllowedIPsInterval) * time.Second)
+	}
+	return nil
 }
 
 func (m *Manager) removeAllPeers() error {
@@ -75,6 +119,9 @@ func (m *Manager) removeAllPeers() error {
 }
 
 func (m *Manager) Stop() error {
+	// Stop the background loops so removed peers aren't brought back up
+	close(m.loopStopChan)
+
 	// Remove all peers, then stop the thread and close the channels
 	err := m.removeAllPeers()
 	if err != nil {
@@ -120,6 +167,9 @@ func (m *Manager) run() {
 }
 
 func GenerateWireguardInterfaceName(peer models.Tunnel) string {
+	if peer.SharedInterface {
+		return SharedInterfaceName
+	}
 	if peer.WireguardServerKey != "" {
 		return fmt.Sprintf("wgs%d", peer.ID)
 	}
@@ -138,26 +188,75 @@ func (wglink *WG) Type() string {
 	return "wireguard"
 }
 
-//nolint:gocyclo
 func (m *Manager) addPeer(peer models.Tunnel) {
+	iface := GenerateWireguardInterfaceName(peer)
+
+	_, wasActive := m.activePeers.Load(peer.ID)
+	err := m.admitPeer(peer)
+	if err != nil {
+		slog.Error("failed to apply tunnel firewall", "iface", iface, "peer", peer.Hostname, "error", err)
+		m.peerAddConfirmChan <- peerResult{peer: peer, err: err}
+		return
+	}
+
+	m.configureLock.Lock()
+	err = m.configurePeer(peer)
+	m.configureLock.Unlock()
+	if err != nil {
+		slog.Error("failed to add wireguard peer", "iface", iface, "peer", peer.Hostname, "error", err)
+		if !wasActive {
+			m.activePeers.Delete(peer.ID)
+		}
+		m.peerAddConfirmChan <- peerResult{peer: peer, err: err}
+		return
+	}
+
+	m.activePeers.Store(peer.ID, peer)
+	err = m.applyFirewall()
+	if err != nil {
+		slog.Error("failed to apply tunnel firewall", "iface", iface, "peer", peer.Hostname, "error", err)
+		if filtered(peer) {
+			// Take the peer back down rather than forward its traffic unfiltered
+			teardownErr := m.teardownPeer(peer)
+			if teardownErr != nil {
+				slog.Error("failed to remove wireguard peer", "iface", iface, "peer", peer.Hostname, "error", teardownErr)
+			}
+			m.peerAddConfirmChan <- peerResult{peer: peer, err: err}
+			return
+		}
+	}
+	m.peerAddConfirmChan <- peerResult{peer: peer}
+}
+
+// configurePeer brings the kernel state for a peer in line with the database:
+// the interface, its addresses, the WireGuard device and the policy routing rules.
+// Callers must hold configureLock.
+func (m *Manager) configurePeer(peer models.Tunnel) error {
 	// Create a new wireguard interface listening on the port from the peer tunnel
 	// If the peer is a client, then the password is the public key of the client
 	// If the peer is a server, then the password is the private key of the server
 	iface := GenerateWireguardInterfaceName(peer)
 
+	mtu := m.interfaceMTU(peer)
+
 	// Check if device exists
 	wgdev, err := netlink.LinkByName(iface)
 	if err == nil {
-		slog.Warn("wireguard interface already exists", "iface", iface, "peer", peer.Hostname)
+		slog.Debug("wireguard interface already exists", "iface", iface, "peer", peer.Hostname)
+		if wgdev.Attrs().MTU != mtu {
+			err = netlink.LinkSetMTU(wgdev, mtu)
+			if err != nil {
+				return fmt.Errorf("failed to set wireguard device MTU: %w", err)
+			}
+		}
 	} else {
 		la := netlink.NewLinkAttrs()
 		la.Name = iface
-		la.MTU = 1420
+		la.MTU = mtu
 		wgdev = &WG{LinkAttrs: la}
 		err := netlink.LinkAdd(wgdev)
 		if err != nil {
-			slog.Error("failed to add wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-			return
+			return fmt.Errorf("failed to add wireguard device: %w", err)
 		}
 	}
 
@@ -165,313 +264,280 @@ func (m *Manager) addPeer(peer models.Tunnel) {
 	if wgdev.Attrs().Flags&net.FlagUp == 0 {
 		err = netlink.LinkSetUp(wgdev)
 		if err != nil {
-			slog.Error("failed to bring up wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-			return
+			return fmt.Errorf("failed to bring up wireguard device: %w", err)
 		}
 	}
 
-	// Add an IP address to the interface
-	peerIP := net.ParseIP(peer.IP)
-	if peer.WireguardServerKey == "" {
-		// Add one to the peer IP for the client side
-		peerIP = peerIP.To4()
-		peerIP[3]++
-		if peerIP[3] == 0 {
-			peerIP[2]++
-			peerIP[3] = 1
-			if peerIP[2] == 0 {
-				peerIP[1]++
-				if peerIP[1] == 0 {
-					peerIP[0]++
-				}
-			}
+	addrs, err := peerAddresses(peer)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		err = netlink.AddrReplace(wgdev, addr)
+		if err != nil {
+			return fmt.Errorf("failed to add address %s to wireguard device: %w", addr.IPNet, err)
 		}
 	}
 
-	err = netlink.AddrReplace(wgdev, &netlink.Addr{IPNet: &net.IPNet{IP: peerIP, Mask: net.CIDRMask(32, 32)}})
+	wgConfig, err := m.deviceConfig(peer)
 	if err != nil {
-		slog.Error("failed to add address to wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return err
 	}
 
-	// Add an IPv6 link-local address to the interface
-	peerIP6, err := utils.GenerateIPv6LinkLocalAddress(peerIP)
+	err = m.wgClient.ConfigureDevice(iface, wgConfig)
 	if err != nil {
-		slog.Error("failed to generate IPv6 link-local address", "peer", peer.Hostname, "error", err)
-		return
+		return fmt.Errorf("failed to configure wireguard device: %w", err)
 	}
-	slog.Debug("Generated IPv6 link-local address", "address", peerIP6)
 
-	err = netlink.AddrAdd(wgdev, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(peerIP6), Mask: net.CIDRMask(64, 128)}})
+	// Look the link up again, one we just added doesn't know its index
+	wgdev, err = netlink.LinkByName(iface)
 	if err != nil {
-		slog.Error("failed to add IPv6 link-local address to wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return fmt.Errorf("failed to get wireguard device: %w", err)
+	}
+	err = m.applyShaping(wgdev, peer)
+	if err != nil {
+		return err
 	}
 
-	var privkey wgtypes.Key
-	portInt := int(peer.WireguardPort)
-	var peers []wgtypes.PeerConfig
+	return ensureRules(iface)
+}
 
-	_, netip, err := net.ParseCIDR("0.0.0.0/0")
-	if err != nil {
-		slog.Error("failed to parse 0.0.0.0/0", "error", err)
-		return
+// peerAddresses returns the IPv4 tunnel address and the derived IPv6 link-local
+// address that belong on the local side of the peer's interface.
+func peerAddresses(peer models.Tunnel) ([]*netlink.Addr, error) {
+	peerIP := net.ParseIP(peer.IP).To4()
+	if peerIP == nil {
+		return nil, fmt.Errorf("invalid tunnel IP %q", peer.IP)
+	}
+	if peer.WireguardServerKey == "" {
+		// Add one to the peer IP for the client side
+		peerIP = nextIP(peerIP)
 	}
 
-	_, ipv6netip, err := net.ParseCIDR("::/0")
+	// Add an IPv6 link-local address to the interface
+	peerIP6, err := utils.GenerateIPv6LinkLocalAddress(peerIP)
 	if err != nil {
-		slog.Error("failed to parse ::/0", "error", err)
-		return
+		return nil, fmt.Errorf("failed to generate IPv6 link-local address: %w", err)
 	}
 
-	duration := time.Second * 25
+	return []*netlink.Addr{
+		{IPNet: &net.IPNet{IP: peerIP, Mask: net.CIDRMask(32, 32)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP(peerIP6), Mask: net.CIDRMask(64, 128)}},
+	}, nil
+}
 
-	if peer.WireguardServerKey != "" {
-		var err error
-		privkey, err = wgtypes.ParseKey(peer.WireguardServerKey)
-		if err != nil {
-			slog.Error("failed to parse server private key", "error", err)
-			return
-		}
+// interfaceMTU returns the MTU of the interface a tunnel is on. The shared
+// interface carries many tunnels, so it always uses the configured default.
+func (m *Manager) interfaceMTU(peer models.Tunnel) int {
+	return tunnelMTU(peer, m.config.Tunnels)
+}
 
-		// tunnel.Password is our server pubkey + client privkey + client pubkey
-		pubkeyPart := peer.Password[88:]
-		clientPubkey, err := wgtypes.ParseKey(pubkeyPart)
-		if err != nil {
-			slog.Error("failed to parse client pubkey", "error", err)
-			return
-		}
+// tunnelMTU is interfaceMTU given the configured defaults
+func tunnelMTU(peer models.Tunnel, defaults config.Tunnels) int {
+	if peer.SharedInterface {
+		return defaults.MTU
+	}
+	return peer.Tuning.Resolve(defaults).MTU
+}
 
-		peers = []wgtypes.PeerConfig{
-			{
-				PublicKey:                   clientPubkey,
-				AllowedIPs:                  []net.IPNet{*netip, *ipv6netip},
-				PersistentKeepaliveInterval: &duration,
-			},
+// nextIP returns the IPv4 address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	next[3]++
+	if next[3] == 0 {
+		next[2]++
+		next[3] = 1
+		if next[2] == 0 {
+			next[1]++
+			if next[1] == 0 {
+				next[0]++
+			}
 		}
-	} else {
-		var err error
-		portInt = freeport.GetPort()
+	}
+	return next
+}
 
-		// tunnel.Password is the server pubkey + client privkey + client pubkey
-		serverPubkeyStr := peer.Password[:44]
-		serverPubkey, err := wgtypes.ParseKey(serverPubkeyStr)
-		if err != nil {
-			slog.Error("failed to parse server pubkey", "error", err)
-			return
-		}
-		clientPrivkeyStr := peer.Password[44:88]
-		privkey, err = wgtypes.ParseKey(clientPrivkeyStr)
+// peerKeys returns our private key and the remote public key for a peer.
+func peerKeys(peer models.Tunnel) (privkey wgtypes.Key, remotePubkey wgtypes.Key, err error) {
+	if peer.WireguardServerKey != "" {
+		privkey, err = wgtypes.ParseKey(peer.WireguardServerKey)
 		if err != nil {
-			slog.Error("failed to parse client privkey", "error", err)
-			return
+			return privkey, remotePubkey, fmt.Errorf("failed to parse server private key: %w", err)
 		}
 
-		// Parse tunnel.Hostname as an address and port
-		hostnameParts := strings.Split(peer.Hostname, ":")
-		if len(hostnameParts) != 2 {
-			slog.Error("invalid hostname format", "hostname", peer.Hostname)
-			return
-		}
-
-		port64, err := strconv.ParseInt(hostnameParts[1], 10, 32)
+		remotePubkey, err = wgtypes.ParseKey(peer.WireguardClientPubkey)
 		if err != nil {
-			slog.Error("failed to parse port from hostname", "hostname", peer.Hostname, "error", err)
-			return
-		}
-		port := int(port64)
-
-		// Check if the hostname is an IP address or a domain name
-		if net.ParseIP(hostnameParts[0]) == nil {
-			// It's a domain name
-			ips, err := net.LookupIP(hostnameParts[0])
-			if err != nil {
-				slog.Error("failed to lookup IPs for hostname", "hostname", hostnameParts[0], "error", err)
-				return
-			}
-			if len(ips) == 0 {
-				slog.Error("no IPs found for hostname", "hostname", hostnameParts[0])
-				return
-			}
-			hostnameParts[0] = ips[0].String()
-		}
-
-		peers = []wgtypes.PeerConfig{
-			{
-				PublicKey:                   serverPubkey,
-				AllowedIPs:                  []net.IPNet{*netip, *ipv6netip},
-				PersistentKeepaliveInterval: &duration,
-				Endpoint:                    &net.UDPAddr{IP: net.ParseIP(hostnameParts[0]), Port: port},
-			},
+			return privkey, remotePubkey, fmt.Errorf("failed to parse client pubkey: %w", err)
 		}
+		return privkey, remotePubkey, nil
 	}
 
-	err = m.wgClient.ConfigureDevice(iface, wgtypes.Config{
-		PrivateKey:   &privkey,
-		ListenPort:   &portInt,
-		ReplacePeers: true,
-		Peers:        peers,
-	})
-
+	remotePubkey, err = wgtypes.ParseKey(peer.WireguardServerPubkey)
 	if err != nil {
-		slog.Error("failed to configure wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return privkey, remotePubkey, fmt.Errorf("failed to parse server pubkey: %w", err)
 	}
-
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20010,
-		Table:             29,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	privkey, err = wgtypes.ParseKey(peer.WireguardClientPrivkey)
 	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return privkey, remotePubkey, fmt.Errorf("failed to parse client privkey: %w", err)
 	}
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20020,
-		Table:             20,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	return privkey, remotePubkey, nil
+}
+
+func (m *Manager) deviceConfig(peer models.Tunnel) (wgtypes.Config, error) {
+	privkey, _, err := peerKeys(peer)
 	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return wgtypes.Config{}, err
 	}
 
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20030,
-		Table:             30,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	peerConfig, err := m.peerConfig(peer)
 	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return wgtypes.Config{}, err
 	}
 
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20040,
-		Table:             21,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
-	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+	portInt := int(peer.WireguardPort)
+	if peer.WireguardServerKey == "" {
+		// Wireguard listens on both IPv4 and IPv6, so the port has to be free on both
+		portInt, err = utils.FreeUDPPort()
+		if err != nil {
+			return wgtypes.Config{}, err
+		}
+
+		peerConfig.Endpoint, err = m.currentEndpoint(peer)
+		if err != nil {
+			return wgtypes.Config{}, err
+		}
 	}
 
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20050,
-		Table:             22,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	return wgtypes.Config{
+		PrivateKey: &privkey,
+		ListenPort: &portInt,
+		// Peers on the shared interface are added alongside each other
+		ReplacePeers: !peer.SharedInterface,
+		Peers:        []wgtypes.PeerConfig{peerConfig},
+	}, nil
+}
+
+// peerConfig returns the configuration of the remote side of a tunnel. The
+// endpoint of a client tunnel is left for the caller to resolve.
+func (m *Manager) peerConfig(peer models.Tunnel) (wgtypes.PeerConfig, error) {
+	_, remotePubkey, err := peerKeys(peer)
 	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return wgtypes.PeerConfig{}, err
 	}
 
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20060,
-		Table:             28,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	allowedIPs, err := m.peerAllowedIPs(peer)
 	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return wgtypes.PeerConfig{}, err
 	}
 
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20070,
-		Table:             31,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
-	if err != nil {
-		slog.Error("failed to add rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+	// Zero turns keepalives off
+	duration := time.Second * time.Duration(peer.Tuning.Resolve(m.config.Tunnels).PersistentKeepalive)
+
+	peerConfig := wgtypes.PeerConfig{
+		PublicKey:                   remotePubkey,
+		AllowedIPs:                  allowedIPs,
+		ReplaceAllowedIPs:           true,
+		PersistentKeepaliveInterval: &duration,
 	}
 
-	// ip rule add pref 20099 iif $iface unreachable
-	err = netlink.RuleAdd(&netlink.Rule{
-		IifName:           iface,
-		Priority:          20099,
-		Type:              unix.RTN_UNREACHABLE,
-		Family:            netlink.FAMILY_ALL,
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Goto:              -1,
-		Flow:              -1,
-	})
+	if peer.WireguardPresharedKey != "" {
+		psk, err := wgtypes.ParseKey(peer.WireguardPresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("failed to parse preshared key: %w", err)
+		}
+		peerConfig.PresharedKey = &psk
+	}
+	return peerConfig, nil
+}
+
+func (m *Manager) removePeer(peer models.Tunnel) {
+	err := m.teardownPeer(peer)
 	if err != nil {
-		slog.Error("failed to add unreachable rule for wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
+		slog.Error("failed to remove wireguard peer", "iface", GenerateWireguardInterfaceName(peer), "peer", peer.Hostname, "error", err)
 		return
 	}
 
-	m.activePeers.Store(iface, peer)
-	m.peerAddConfirmChan <- peer
+	m.peerRemoveConfirmChan <- peer
 }
 
-func (m *Manager) removePeer(peer models.Tunnel) {
+// teardownPeer removes a peer from the kernel and stops tracking it
+func (m *Manager) teardownPeer(peer models.Tunnel) error {
 	iface := GenerateWireguardInterfaceName(peer)
 
-	_, ok := m.activePeers.LoadAndDelete(iface)
+	ok := m.forgetPeer(peer.ID)
+
+	m.configureLock.Lock()
+	var err error
+	if peer.SharedInterface {
+		err = m.removeSharedPeer(peer)
+	} else {
+		if ok {
+			err = deleteInterface(iface)
+		}
+		if err == nil {
+			// Rules are keyed on the interface name and outlive the link, so
+			// clear them even if we weren't tracking the peer as active
+			err = removeRules(iface)
+		}
+	}
+	m.configureLock.Unlock()
+	fwErr := m.applyFirewall()
+	if fwErr != nil {
+		slog.Error("failed to update tunnel firewall", "error", fwErr)
+	}
+	return err
+}
+
+// forgetPeer stops tracking a peer, reporting whether it was active
+func (m *Manager) forgetPeer(id uint) bool {
+	_, ok := m.activePeers.LoadAndDelete(id)
+	if ok {
+		m.tornDown(id)
+	}
+	m.endpoints.Delete(id)
+	m.learnedPrefixes.Delete(id)
+	return ok
+}
+
+// tornDown records that the manager is taking a tunnel's session down itself
+func (m *Manager) tornDown(id uint) {
+	m.teardowns.Store(id, time.Now())
+}
+
+// CausedDisconnect reports whether the manager recently took a tunnel's session
+// down itself, by removing its peer or changing its keys. The record is used
+// up, so it only accounts for the one disconnect.
+func (m *Manager) CausedDisconnect(id uint) bool {
+	value, ok := m.teardowns.LoadAndDelete(id)
 	if !ok {
-		m.peerRemoveConfirmChan <- peer
-		return
+		return false
 	}
+	at, ok := value.(time.Time)
+	return ok && time.Since(at) < teardownGrace
+}
 
+// deleteInterface removes a tunnel interface from the kernel. A missing interface is not an error.
+// Callers must hold configureLock.
+func deleteInterface(iface string) error {
 	// Check if device exists
 	wgdev, err := netlink.LinkByName(iface)
 	if err != nil {
-		slog.Warn("wireguard interface does not exist", "iface", iface, "peer", peer.Hostname)
-		m.peerRemoveConfirmChan <- peer
-		return
+		slog.Warn("wireguard interface does not exist", "iface", iface)
+		return nil
 	}
 
 	err = netlink.LinkSetDown(wgdev)
 	if err != nil {
-		slog.Error("failed to bring down wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return fmt.Errorf("failed to bring down wireguard device: %w", err)
 	}
 
 	err = netlink.LinkDel(wgdev)
 	if err != nil {
-		slog.Error("failed to delete wireguard device", "iface", iface, "peer", peer.Hostname, "error", err)
-		return
+		return fmt.Errorf("failed to delete wireguard device: %w", err)
 	}
 
-	m.peerRemoveConfirmChan <- peer
+	return nil
 }
 
 func (m *Manager) AddPeer(peer models.Tunnel) error {
@@ -493,13 +559,13 @@ func (m *Manager) waitForPeerAddition(ctx context.Context, peer models.Tunnel) e
 	case <-ctx.Done():
 		slog.Warn("peerAddConfirm timed out", "peer", peer.Hostname)
 		return ctx.Err()
-	case addedPeer := <-m.peerAddConfirmChan:
-		if addedPeer.ID != peer.ID {
+	case result := <-m.peerAddConfirmChan:
+		if result.peer.ID != peer.ID {
 			// Pop the wrong peer back onto the channel
-			m.peerAddConfirmChan <- addedPeer
+			m.peerAddConfirmChan <- result
 			return m.waitForPeerAddition(ctx, peer)
 		}
-		return nil
+		return result.err
 	}
 }
 
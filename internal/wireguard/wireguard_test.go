@@ -0,0 +1,29 @@
+package wireguard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCausedDisconnect(t *testing.T) {
+	t.Parallel()
+
+	m := &Manager{}
+	if m.CausedDisconnect(1) {
+		t.Error("CausedDisconnect() = true for a tunnel that was never torn down")
+	}
+
+	m.tornDown(1)
+	if !m.CausedDisconnect(1) {
+		t.Error("CausedDisconnect() = false right after a teardown")
+	}
+	if m.CausedDisconnect(1) {
+		t.Error("CausedDisconnect() = true twice for a single teardown")
+	}
+
+	// A teardown nobody noticed in time doesn't excuse a later disconnect
+	m.teardowns.Store(uint(2), time.Now().Add(-teardownGrace))
+	if m.CausedDisconnect(2) {
+		t.Error("CausedDisconnect() = true for a stale teardown")
+	}
+}